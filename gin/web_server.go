@@ -3,7 +3,9 @@ package gin
 
 import (
 	"encoding/json"
+	"io"
 	"io/fs"
+	"net"
 	"net/http"
 	"strings"
 )
@@ -13,6 +15,23 @@ type H map[string]interface{}
 type Context struct {
 	W http.ResponseWriter
 	R *http.Request
+
+	aborted bool
+}
+
+// Abort 中止请求，中间件调用后不再执行后续的中间件和处理函数
+func (c *Context) Abort() {
+	c.aborted = true
+}
+
+// AbortWithStatusJSON 返回JSON响应并中止请求
+func (c *Context) AbortWithStatusJSON(code int, obj interface{}) {
+	c.Abort()
+	c.JSON(code, obj)
+}
+
+func (c *Context) IsAborted() bool {
+	return c.aborted
 }
 
 func (c *Context) JSON(code int, obj interface{}) {
@@ -31,6 +50,61 @@ func (c *Context) ShouldBindJSON(obj interface{}) error {
 	return json.NewDecoder(c.R.Body).Decode(obj)
 }
 
+// Flush 将已写入的响应立即发送给客户端，用于流式响应
+func (c *Context) Flush() {
+	if flusher, ok := c.W.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Stream 持续调用 step 写入流式响应，每次调用后刷新
+// step 返回false或客户端断开时结束，返回值表示客户端是否已断开
+func (c *Context) Stream(step func(w io.Writer) bool) bool {
+	done := c.R.Context().Done()
+	for {
+		select {
+		case <-done:
+			return true
+		default:
+			keepOpen := step(c.W)
+			c.Flush()
+			if !keepOpen {
+				return false
+			}
+		}
+	}
+}
+
+// SSEvent 写入一条Server-Sent Events事件，data 为字符串时原样写入，否则编码为JSON
+func (c *Context) SSEvent(name string, data interface{}) error {
+	header := c.W.Header()
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "text/event-stream")
+	}
+	var payload string
+	switch v := data.(type) {
+	case string:
+		payload = v
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		payload = string(encoded)
+	}
+	var buf strings.Builder
+	if name != "" {
+		buf.WriteString("event: " + name + "\n")
+	}
+	// 多行数据每行都需要 data: 前缀
+	for _, line := range strings.Split(payload, "\n") {
+		buf.WriteString("data: " + line + "\n")
+	}
+	buf.WriteString("\n")
+	_, err := io.WriteString(c.W, buf.String())
+	return err
+}
+
 // --- Engine ---
 
 type handlerFunc func(*Context)
@@ -82,6 +156,11 @@ func (e *Engine) Run(addr string) error {
 	return http.ListenAndServe(addr, e)
 }
 
+// RunListener 在指定的监听器上提供服务，如Unix域套接字
+func (e *Engine) RunListener(listener net.Listener) error {
+	return http.Serve(listener, e)
+}
+
 func (e *Engine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := &Context{W: w, R: r}
 	method := r.Method
@@ -110,16 +189,37 @@ func (e *Engine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // --- Group ---
 
 type Group struct {
-	prefix string
-	engine *Engine
+	prefix      string
+	engine      *Engine
+	middlewares []handlerFunc
+}
+
+// Use 添加中间件，按添加顺序在处理函数之前执行，只对之后注册的路由生效
+func (g *Group) Use(middlewares ...handlerFunc) {
+	g.middlewares = append(g.middlewares, middlewares...)
 }
 
 func (g *Group) GET(path string, handler handlerFunc) {
-	g.engine.GET(pathJoin(g.prefix, path), handler)
+	g.engine.GET(pathJoin(g.prefix, path), g.chain(handler))
 }
 
 func (g *Group) POST(path string, handler handlerFunc) {
-	g.engine.POST(pathJoin(g.prefix, path), handler)
+	g.engine.POST(pathJoin(g.prefix, path), g.chain(handler))
+}
+
+// chain 将分组当前的中间件和处理函数串联，中间件中止请求后不再继续执行
+func (g *Group) chain(handler handlerFunc) handlerFunc {
+	if len(g.middlewares) == 0 {
+		return handler
+	}
+	handlers := append(append([]handlerFunc{}, g.middlewares...), handler)
+	return func(c *Context) {
+		for _, h := range handlers {
+			if h(c); c.IsAborted() {
+				return
+			}
+		}
+	}
 }
 
 func pathJoin(prefix, path string) string {
@@ -69,6 +69,35 @@ func (j *Json) GetInt64(key string) int64 {
 	return 0
 }
 
+// GetBool - 获取指定字段的布尔值
+func (j *Json) GetBool(key string) bool {
+	if obj, ok := j.data.(map[string]interface{}); ok {
+		if val, exists := obj[key]; exists {
+			if b, ok := val.(bool); ok {
+				return b
+			}
+		}
+	}
+	return false
+}
+
+// GetStrings - 获取指定字段的字符串数组，忽略其中的非字符串元素
+func (j *Json) GetStrings(key string) []string {
+	var result []string
+	if obj, ok := j.data.(map[string]interface{}); ok {
+		if val, exists := obj[key]; exists {
+			if arr, ok := val.([]interface{}); ok {
+				for _, item := range arr {
+					if str, ok := item.(string); ok {
+						result = append(result, str)
+					}
+				}
+			}
+		}
+	}
+	return result
+}
+
 // Set - 设置指定字段的值
 func (j *Json) Set(key string, value interface{}) error {
 	if obj, ok := j.data.(map[string]interface{}); ok {
@@ -78,6 +107,13 @@ func (j *Json) Set(key string, value interface{}) error {
 	return fmt.Errorf("无法设置值，数据格式不正确")
 }
 
+// Remove - 删除指定字段
+func (j *Json) Remove(key string) {
+	if obj, ok := j.data.(map[string]interface{}); ok {
+		delete(obj, key)
+	}
+}
+
 // LoadContent - 解析 JSON 字符串
 func LoadContent(content string) (*Json, error) {
 	var data interface{}
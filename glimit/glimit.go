@@ -0,0 +1,128 @@
+// Package glimit - 失败尝试计数与指数退避
+package glimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter 按键（来源ID、来源IP、目标ID等）统计失败次数
+// 超过免费次数后按指数退避拒绝后续尝试，失败次数过多则锁定一段时间
+type Limiter struct {
+	FreeAttempts    int           // 不受限制的失败次数
+	BaseDelay       time.Duration // 第一次退避时长，之后每次翻倍
+	MaxDelay        time.Duration // 退避时长上限
+	LockoutAfter    int           // 累计失败达到此次数后锁定
+	LockoutDuration time.Duration // 锁定时长
+	ResetAfter      time.Duration // 超过此时长没有新的失败则清零
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+type entry struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// New 使用默认参数创建限制器：5次免费，之后1秒起指数退避，20次失败锁定15分钟
+func New() *Limiter {
+	return &Limiter{
+		FreeAttempts:    5,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutAfter:    20,
+		LockoutDuration: 15 * time.Minute,
+		ResetAfter:      time.Hour,
+		entries:         make(map[string]*entry),
+	}
+}
+
+// Allow 判断指定键当前是否允许尝试，不允许时返回需要等待的时长
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := l.get(key, time.Now())
+	if e == nil {
+		return true, 0
+	}
+	if wait := time.Until(e.blockedUntil); wait > 0 {
+		return false, wait
+	}
+	return true, 0
+}
+
+// Fail 记录一次失败，返回该键当前累计失败次数
+func (l *Limiter) Fail(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	e := l.get(key, now)
+	if e == nil {
+		if len(l.entries) >= 1024 {
+			l.prune(now)
+		}
+		e = &entry{}
+		l.entries[key] = e
+	}
+	e.failures++
+	e.lastFailure = now
+	switch {
+	case e.failures >= l.LockoutAfter:
+		e.blockedUntil = now.Add(l.LockoutDuration)
+	case e.failures > l.FreeAttempts:
+		delay := l.BaseDelay << (e.failures - l.FreeAttempts - 1)
+		if delay > l.MaxDelay || delay <= 0 {
+			delay = l.MaxDelay
+		}
+		e.blockedUntil = now.Add(delay)
+	}
+	return e.failures
+}
+
+// Succeed 认证成功后清除该键的失败记录
+func (l *Limiter) Succeed(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+}
+
+// Blocked 返回当前处于退避或锁定状态的键数量
+func (l *Limiter) Blocked() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	count := 0
+	for _, e := range l.entries {
+		if e.blockedUntil.After(now) {
+			count++
+		}
+	}
+	return count
+}
+
+// get 获取键对应的记录，过期的记录视为不存在
+func (l *Limiter) get(key string, now time.Time) *entry {
+	if l.entries == nil {
+		l.entries = make(map[string]*entry)
+	}
+	e := l.entries[key]
+	if e != nil && l.expired(e, now) {
+		delete(l.entries, key)
+		return nil
+	}
+	return e
+}
+
+func (l *Limiter) expired(e *entry, now time.Time) bool {
+	return now.After(e.blockedUntil) && now.Sub(e.lastFailure) > l.ResetAfter
+}
+
+func (l *Limiter) prune(now time.Time) {
+	for key, e := range l.entries {
+		if l.expired(e, now) {
+			delete(l.entries, key)
+		}
+	}
+}
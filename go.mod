@@ -5,6 +5,7 @@ go 1.23.0
 toolchain go1.24.1
 
 require (
+	filippo.io/nistec v0.0.3
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
 	golang.zx2c4.com/wintun v0.0.0-20230126152724-0fa3db229ce2 // indirect
 )
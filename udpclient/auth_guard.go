@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/venshao/natun/glimit"
+	"github.com/venshao/natun/glog"
+)
+
+// 本机作为被连接方时的失败尝试限制
+// 同时按来源ID和本机整体计数，避免攻击者更换ID绕过限制
+var authLimiter = glimit.New()
+
+// 本机整体的计数键
+const selfAttemptKey = "self"
+
+// 最多保留的失败尝试记录条数
+const maxFailedAttempts = 50
+
+// FailedAttempt 一次针对本机的失败连接尝试
+type FailedAttempt struct {
+	SrcId  string `json:"srcId"`
+	Addr   string `json:"addr"`
+	Time   int64  `json:"time"`
+	Reason string `json:"reason"`
+}
+
+// incomingAttempt 一次尚未完成密码验证的入站连接
+type incomingAttempt struct {
+	srcId     string
+	addr      string
+	confirmed bool
+}
+
+var (
+	attemptMu       sync.Mutex
+	failedAttempts  []FailedAttempt
+	pendingAttempts = make(map[string]*incomingAttempt)
+)
+
+// allowIncomingAttempt 判断是否接受来自 srcId 的连接请求，被拒绝时记录一次失败尝试
+func allowIncomingAttempt(srcId string, srcAddr string) bool {
+	for _, key := range []string{"src:" + srcId, selfAttemptKey} {
+		if ok, wait := authLimiter.Allow(key); !ok {
+			glog.Warningf("[AUTH]拒绝来自 %s 的连接请求，尝试过于频繁，%d秒后解除", srcId, int(wait.Seconds())+1)
+			recordFailedAttempt(srcId, srcAddr, "尝试过于频繁，已拒绝")
+			return false
+		}
+	}
+	return true
+}
+
+// beginIncomingAttempt 记录一次入站连接尝试
+// 在密码验证通过前先按失败计数，超时仍未通过则记为失败尝试
+func beginIncomingAttempt(srcId string, srcAddr string) {
+	authLimiter.Fail("src:" + srcId)
+	authLimiter.Fail(selfAttemptKey)
+
+	attempt := &incomingAttempt{srcId: srcId, addr: srcAddr}
+	attemptMu.Lock()
+	pendingAttempts[srcId] = attempt
+	attemptMu.Unlock()
+
+	timeout := time.Duration(GetConfig().PunchHole.PunchTimeout+30) * time.Second
+	time.AfterFunc(timeout, func() {
+		attemptMu.Lock()
+		if pendingAttempts[srcId] == attempt {
+			delete(pendingAttempts, srcId)
+		}
+		confirmed := attempt.confirmed
+		attemptMu.Unlock()
+		if !confirmed {
+			glog.Warningf("[AUTH]来自 %s 的连接未通过密码验证", srcId)
+			recordFailedAttempt(srcId, attempt.addr, "密码错误或验证超时")
+			reportAuthResult(srcId, false)
+		}
+	})
+}
+
+// confirmIncomingAttempt 对方通过了密码验证，清除失败计数
+func confirmIncomingAttempt(srcId string) {
+	attemptMu.Lock()
+	attempt := pendingAttempts[srcId]
+	if attempt == nil || attempt.confirmed {
+		attemptMu.Unlock()
+		return
+	}
+	attempt.confirmed = true
+	attemptMu.Unlock()
+
+	authLimiter.Succeed("src:" + srcId)
+	authLimiter.Succeed(selfAttemptKey)
+	reportAuthResult(srcId, true)
+}
+
+// reportAuthResult 向注册中心报告入站连接的验证结果，服务器据此重置或保留其计数
+func reportAuthResult(srcId string, ok bool) {
+	if natConnection.listen == nil {
+		return
+	}
+	err := callServer(natConnection.listen, "authResult", map[string]interface{}{
+		"clientId": getClientId(),
+		"srcId":    srcId,
+		"ok":       ok,
+	})
+	if err != nil {
+		glog.Errorf("[AUTH]向注册中心报告验证结果失败：%v", err)
+	}
+}
+
+func recordFailedAttempt(srcId string, addr string, reason string) {
+	attemptMu.Lock()
+	defer attemptMu.Unlock()
+	failedAttempts = append(failedAttempts, FailedAttempt{
+		SrcId:  srcId,
+		Addr:   addr,
+		Time:   time.Now().UnixMilli(),
+		Reason: reason,
+	})
+	if len(failedAttempts) > maxFailedAttempts {
+		failedAttempts = failedAttempts[len(failedAttempts)-maxFailedAttempts:]
+	}
+}
+
+// getFailedAttempts 获取最近的失败尝试记录（新的在前）
+func getFailedAttempts() []FailedAttempt {
+	attemptMu.Lock()
+	defer attemptMu.Unlock()
+	result := make([]FailedAttempt, 0, len(failedAttempts))
+	for i := len(failedAttempts) - 1; i >= 0; i-- {
+		result = append(result, failedAttempts[i])
+	}
+	return result
+}
@@ -60,6 +60,23 @@ go build -o bin\windows\cli.exe ^
     is_admin_windows.go ^
     main.go ^
     tun_windows.go ^
+    gateway_windows.go ^
+    sockfd_windows.go ^
+    control_windows.go ^
+    handshake.go ^
+    pake.go ^
+    auth_guard.go ^
+    subnet.go ^
+    nat_detect.go ^
+    punch_strategy.go ^
+    port_mapping.go ^
+    upnp.go ^
+    reconnect.go ^
+    cli.go ^
+    control_socket.go ^
+    web_auth.go ^
+    events.go ^
+    traffic_stats.go ^
     tun_common.go ^
     web_controller.go ^
     net_device.go
@@ -92,6 +109,23 @@ go build -o bin\linux\cli ^
     is_admin_linux.go ^
     main.go ^
     tun_linux.go ^
+    gateway_linux.go ^
+    sockfd_unix.go ^
+    control_unix.go ^
+    handshake.go ^
+    pake.go ^
+    auth_guard.go ^
+    subnet.go ^
+    nat_detect.go ^
+    punch_strategy.go ^
+    port_mapping.go ^
+    upnp.go ^
+    reconnect.go ^
+    cli.go ^
+    control_socket.go ^
+    web_auth.go ^
+    events.go ^
+    traffic_stats.go ^
     tun_common.go ^
     web_controller.go ^
     net_device.go
@@ -124,6 +158,23 @@ go build -o bin\darwin\cli ^
     is_admin_darwin.go ^
     main.go ^
     tun_darwin.go ^
+    gateway_darwin.go ^
+    sockfd_unix.go ^
+    control_unix.go ^
+    handshake.go ^
+    pake.go ^
+    auth_guard.go ^
+    subnet.go ^
+    nat_detect.go ^
+    punch_strategy.go ^
+    port_mapping.go ^
+    upnp.go ^
+    reconnect.go ^
+    cli.go ^
+    control_socket.go ^
+    web_auth.go ^
+    events.go ^
+    traffic_stats.go ^
     tun_common.go ^
     web_controller.go ^
     net_device.go
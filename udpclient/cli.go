@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// 命令行客户端通过守护进程的 /api 接口操作正在运行的客户端，适用于没有浏览器的服务器和容器
+// 本机控制套接字存在时优先使用，否则使用Web控制台的接口
+const defaultApiAddr = "http://127.0.0.1:8898"
+
+// 命令行的退出码
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+// runCli 执行子命令，返回进程退出码
+func runCli(args []string) int {
+	switch args[0] {
+	case "up":
+		return cliUp(args[1:])
+	case "connect":
+		return cliConnect(args[1:])
+	case "disconnect":
+		return cliDisconnect(args[1:])
+	case "status":
+		return cliStatus(args[1:])
+	case "peers":
+		return cliPeers(args[1:])
+	case "stats":
+		return cliStats(args[1:])
+	case "down":
+		return cliDown(args[1:])
+	case "loglevel":
+		return cliLogLevel(args[1:])
+	case "help", "-h", "--help":
+		printUsage(os.Stdout)
+		return exitOK
+	default:
+		fmt.Fprintf(os.Stderr, "未知命令：%s\n\n", args[0])
+		printUsage(os.Stderr)
+		return exitUsage
+	}
+}
+
+func printUsage(w io.Writer) {
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(w, `用法：%[1]s [命令] [参数]
+
+不带命令时启动客户端并打开Web控制台。
+
+命令：
+  up [--config 文件]                         以无界面方式启动客户端（守护进程）
+  connect <设备ID> [--password 密码] [--wait 秒] 连接设备，密码也可以通过环境变量 NATUN_PASSWORD 传入
+  disconnect [设备ID]                        断开与设备的连接，不指定设备时断开全部连接
+  status                                     查看本机信息和整体连接状态
+  peers                                      查看全部对等节点
+  stats [设备ID] [--reset]                   查看流量统计，--reset 清零统计，不指定设备时清零全部统计
+  down                                       退出客户端（需要控制套接字）
+  loglevel <DEBUG|INFO|WARN|ERROR>           修改日志级别（需要控制套接字）
+
+除 up 外的命令都支持：
+  --socket 路径  本机控制套接字，默认为 %[3]s，存在时优先使用
+  --api 地址     Web控制台的接口地址，默认为 %[2]s
+  --token 令牌   Web控制台的访问令牌（配置文件中的 web_token），也可以通过环境变量 NATUN_WEB_TOKEN 传入，
+                 使用控制套接字时不需要
+  --json         以JSON格式输出
+`, name, defaultApiAddr, defaultControlSocket)
+}
+
+// parseFlags 解析命令行参数，参数可以出现在位置参数之后，如 connect <设备ID> --password 123456
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// cliCommand 连接守护进程的子命令的公共参数
+type cliCommand struct {
+	fs      *flag.FlagSet
+	apiAddr string
+	socket  string
+	token   string
+	asJson  bool
+}
+
+func newCliCommand(name string) *cliCommand {
+	cmd := &cliCommand{fs: flag.NewFlagSet(name, flag.ContinueOnError)}
+	cmd.fs.StringVar(&cmd.apiAddr, "api", "", "Web控制台的接口地址")
+	cmd.fs.StringVar(&cmd.socket, "socket", defaultControlSocket, "本机控制套接字")
+	cmd.fs.StringVar(&cmd.token, "token", os.Getenv("NATUN_WEB_TOKEN"), "Web控制台的访问令牌")
+	cmd.fs.BoolVar(&cmd.asJson, "json", false, "以JSON格式输出")
+	return cmd
+}
+
+// endpoint 选择访问守护进程的方式：指定了 --api 时使用Web控制台的接口，否则控制套接字存在时使用控制套接字
+func (cmd *cliCommand) endpoint() (http.Client, string, string) {
+	client := http.Client{Timeout: 10 * time.Second}
+	if cmd.apiAddr == "" && cmd.socket != "" {
+		if info, err := os.Stat(cmd.socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			client.Transport = &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", cmd.socket)
+				},
+			}
+			// 经套接字访问时主机名不起作用
+			return client, "http://natun", cmd.socket
+		}
+	}
+	addr := cmd.apiAddr
+	if addr == "" {
+		addr = defaultApiAddr
+	}
+	return client, strings.TrimSuffix(addr, "/"), addr
+}
+
+// apiResult 操作类接口的返回结果
+type apiResult struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// statsResult /api/stats 的返回结果
+type statsResult struct {
+	Code         int             `json:"code"`
+	Message      string          `json:"message,omitempty"`
+	Peers        []PeerTraffic   `json:"peers"`
+	Unattributed TrafficSnapshot `json:"unattributed"`
+	Total        TrafficSnapshot `json:"total"`
+}
+
+// peerStatusResult /api/peerStatus 的返回结果
+type peerStatusResult struct {
+	Status ConnectionStatus `json:"status"`
+	Peers  []PeerStatus     `json:"peers"`
+}
+
+func (cmd *cliCommand) do(method string, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	client, base, target := cmd.endpoint()
+	req, err := http.NewRequest(method, base+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	// 控制套接字不校验令牌
+	if cmd.token != "" {
+		req.Header.Set("Authorization", "Bearer "+cmd.token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("没有权限访问控制套接字 %s，请使用root运行或加入 control_group 指定的属组", target)
+		}
+		return fmt.Errorf("无法连接到守护进程 %s，请先运行 up 启动客户端：%v", target, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("Web控制台拒绝访问，请通过 --token 或环境变量 NATUN_WEB_TOKEN 指定正确的访问令牌")
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("守护进程返回了无法解析的响应（HTTP %d）：%v", resp.StatusCode, err)
+	}
+	return nil
+}
+
+// action 调用操作类接口，接口返回的错误码不为0时返回错误
+func (cmd *cliCommand) action(path string, body interface{}) (apiResult, error) {
+	var result apiResult
+	if err := cmd.do(http.MethodPost, path, body, &result); err != nil {
+		return result, err
+	}
+	if result.Code != 0 {
+		return result, errors.New(result.Message)
+	}
+	return result, nil
+}
+
+func (cmd *cliCommand) peerStatus() (*peerStatusResult, error) {
+	var result peerStatusResult
+	if err := cmd.do(http.MethodGet, "/api/peerStatus", nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// fail 输出错误，--json 时以与接口相同的格式输出到标准输出
+func (cmd *cliCommand) fail(err error) int {
+	if cmd.asJson {
+		cmd.print(apiResult{Code: -1, Message: err.Error()})
+	} else {
+		fmt.Fprintf(os.Stderr, "错误：%v\n", err)
+	}
+	return exitError
+}
+
+func (cmd *cliCommand) print(v interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+// cliUp 以无界面方式启动客户端，不等待输入也不打开浏览器
+func cliUp(args []string) int {
+	fs := flag.NewFlagSet("up", flag.ContinueOnError)
+	fs.StringVar(&configFile, "config", configFile, "配置文件路径")
+	if _, err := parseFlags(fs, args); err != nil {
+		return exitUsage
+	}
+	if !IsAdmin() {
+		fmt.Fprintln(os.Stderr, "请以管理员/root身份运行")
+		return exitError
+	}
+	runClient(false)
+	return exitOK
+}
+
+func cliConnect(args []string) int {
+	cmd := newCliCommand("connect")
+	password := cmd.fs.String("password", os.Getenv("NATUN_PASSWORD"), "对方的连接密码")
+	wait := cmd.fs.Int("wait", 0, "等待连接建立的秒数，0表示发起连接后立即返回")
+	positional, err := parseFlags(cmd.fs, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "用法：connect <设备ID> [--password 密码] [--wait 秒]")
+		return exitUsage
+	}
+	targetId := positional[0]
+	result, err := cmd.action("/api/connect", ConnectRequest{TargetId: targetId, TargetPwd: *password})
+	if err != nil {
+		return cmd.fail(err)
+	}
+	if *wait <= 0 {
+		return cmd.done(result)
+	}
+
+	// 连接是异步建立的，轮询对等节点状态直到连通或超时
+	deadline := time.Now().Add(time.Duration(*wait) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+		status, err := cmd.peerStatus()
+		if err != nil {
+			return cmd.fail(err)
+		}
+		for _, peer := range status.Peers {
+			if peer.ClientId == targetId && peer.Alive {
+				return cmd.done(apiResult{Message: fmt.Sprintf("已连接 %s（%s）", targetId, peer.StatusText)})
+			}
+		}
+		if status.Status.ConnectFailed {
+			return cmd.fail(errors.New(status.Status.ConnectMessage))
+		}
+	}
+	return cmd.fail(fmt.Errorf("%d秒内未能与 %s 建立连接", *wait, targetId))
+}
+
+func cliDisconnect(args []string) int {
+	cmd := newCliCommand("disconnect")
+	positional, err := parseFlags(cmd.fs, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) > 1 {
+		fmt.Fprintln(os.Stderr, "用法：disconnect [设备ID]")
+		return exitUsage
+	}
+	targets := positional
+	if len(targets) == 0 {
+		status, err := cmd.peerStatus()
+		if err != nil {
+			return cmd.fail(err)
+		}
+		for _, peer := range status.Peers {
+			targets = append(targets, peer.ClientId)
+		}
+		if len(targets) == 0 {
+			return cmd.done(apiResult{Message: "没有需要断开的连接"})
+		}
+	}
+	for _, targetId := range targets {
+		if _, err := cmd.action("/api/disconnect", PeerRequest{TargetId: targetId}); err != nil {
+			return cmd.fail(err)
+		}
+	}
+	return cmd.done(apiResult{Message: fmt.Sprintf("已断开与 %s 的连接", strings.Join(targets, "、"))})
+}
+
+// cliDown 经控制套接字退出客户端，Web控制台不提供该接口
+func cliDown(args []string) int {
+	cmd := newCliCommand("down")
+	if _, err := parseFlags(cmd.fs, args); err != nil {
+		return exitUsage
+	}
+	result, err := cmd.action("/api/shutdown", struct{}{})
+	if err != nil {
+		return cmd.fail(err)
+	}
+	return cmd.done(result)
+}
+
+// cliLogLevel 经控制套接字修改守护进程的日志级别
+func cliLogLevel(args []string) int {
+	cmd := newCliCommand("loglevel")
+	positional, err := parseFlags(cmd.fs, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "用法：loglevel <DEBUG|INFO|WARN|ERROR>")
+		return exitUsage
+	}
+	result, err := cmd.action("/api/logLevel", LogLevelRequest{Level: positional[0]})
+	if err != nil {
+		return cmd.fail(err)
+	}
+	return cmd.done(result)
+}
+
+// done 输出操作类命令的结果
+func (cmd *cliCommand) done(result apiResult) int {
+	if cmd.asJson {
+		cmd.print(result)
+	} else {
+		fmt.Println(result.Message)
+	}
+	return exitOK
+}
+
+func cliStatus(args []string) int {
+	cmd := newCliCommand("status")
+	if _, err := parseFlags(cmd.fs, args); err != nil {
+		return exitUsage
+	}
+	var device DeviceInfo
+	if err := cmd.do(http.MethodGet, "/api/device", nil, &device); err != nil {
+		return cmd.fail(err)
+	}
+	status, err := cmd.peerStatus()
+	if err != nil {
+		return cmd.fail(err)
+	}
+	if cmd.asJson {
+		cmd.print(map[string]interface{}{
+			"device": device,
+			"status": status.Status,
+		})
+		return exitOK
+	}
+	alive := 0
+	for _, peer := range status.Peers {
+		if peer.Alive {
+			alive++
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "设备ID\t%s\n", device.ClientId)
+	fmt.Fprintf(w, "虚拟IP\t%s/%d\n", device.IP, device.PrefixLen)
+	if device.IP6 != "" {
+		fmt.Fprintf(w, "IPv6虚拟地址\t%s\n", device.IP6)
+	}
+	fmt.Fprintf(w, "NAT类型\t%s\n", device.NatType)
+	if device.MappedAddr != "" {
+		fmt.Fprintf(w, "端口映射\t%s %s\n", device.MappingProtocol, device.MappedAddr)
+	}
+	fmt.Fprintf(w, "连接状态\t%s\n", status.Status.StatusText)
+	if status.Status.ConnectMessage != "" {
+		fmt.Fprintf(w, "连接消息\t%s\n", status.Status.ConnectMessage)
+	}
+	fmt.Fprintf(w, "已连通设备\t%d\n", alive)
+	w.Flush()
+	return exitOK
+}
+
+func cliPeers(args []string) int {
+	cmd := newCliCommand("peers")
+	if _, err := parseFlags(cmd.fs, args); err != nil {
+		return exitUsage
+	}
+	status, err := cmd.peerStatus()
+	if err != nil {
+		return cmd.fail(err)
+	}
+	if cmd.asJson {
+		cmd.print(status.Peers)
+		return exitOK
+	}
+	if len(status.Peers) == 0 {
+		fmt.Println("没有对等节点")
+		return exitOK
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "设备ID\t虚拟IP\t模式\t延迟\t模式切换")
+	for _, peer := range status.Peers {
+		latency := "-"
+		if peer.Latency >= 0 {
+			latency = fmt.Sprintf("%dms", peer.Latency)
+		}
+		change := "-"
+		if peer.ModeSince > 0 {
+			change = time.UnixMilli(peer.ModeSince).Format("2006-01-02 15:04:05") + " " + peer.ModeReason
+		}
+		ip := peer.IP
+		if ip == "" {
+			ip = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", peer.ClientId, ip, peer.StatusText, latency, change)
+	}
+	w.Flush()
+	return exitOK
+}
+
+func cliStats(args []string) int {
+	cmd := newCliCommand("stats")
+	var reset bool
+	cmd.fs.BoolVar(&reset, "reset", false, "清零流量统计")
+	positional, err := parseFlags(cmd.fs, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) > 1 {
+		fmt.Fprintln(os.Stderr, "用法：stats [设备ID] [--reset]")
+		return exitUsage
+	}
+	targetId := ""
+	if len(positional) == 1 {
+		targetId = positional[0]
+	}
+	if reset {
+		result, err := cmd.action("/api/stats/reset", PeerRequest{TargetId: targetId})
+		if err != nil {
+			return cmd.fail(err)
+		}
+		return cmd.done(result)
+	}
+
+	var result statsResult
+	if err := cmd.do(http.MethodGet, "/api/stats", nil, &result); err != nil {
+		return cmd.fail(err)
+	}
+	if result.Code != 0 {
+		return cmd.fail(errors.New(result.Message))
+	}
+	peers := result.Peers
+	if targetId != "" {
+		peers = nil
+		for _, peer := range result.Peers {
+			if peer.ClientId == targetId {
+				peers = append(peers, peer)
+			}
+		}
+		if len(peers) == 0 {
+			return cmd.fail(fmt.Errorf("未连接设备 %s", targetId))
+		}
+	}
+	if cmd.asJson {
+		if targetId != "" {
+			cmd.print(peers[0])
+		} else {
+			cmd.print(result)
+		}
+		return exitOK
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "设备ID\t模式\t发送\t接收\t发送速率\t接收速率\t中转占比\t丢包\t解密失败")
+	printRow := func(name string, mode string, s TrafficSnapshot) {
+		drops := s.Drops.LengthMismatch + s.Drops.NoTun + s.Drops.NoPeer + s.Drops.Filtered + s.Drops.Spoofed + s.ParseErrors
+		relayShare := "-"
+		if total := s.TxBytes + s.RxBytes; total > 0 {
+			relayShare = fmt.Sprintf("%.0f%%", float64(s.Relay.TxBytes+s.Relay.RxBytes)*100/float64(total))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s/%d包\t%s/%d包\t%s/s\t%s/s\t%s\t%d\t%d\n", name, mode,
+			formatBytes(s.TxBytes), s.TxPackets, formatBytes(s.RxBytes), s.RxPackets,
+			formatBytes(s.TxRate), formatBytes(s.RxRate), relayShare, drops, s.DecryptErrors)
+	}
+	for _, peer := range peers {
+		printRow(peer.ClientId, peer.Mode, peer.Stats)
+	}
+	if targetId == "" {
+		printRow("未归属", "-", result.Unattributed)
+		printRow("合计", "-", result.Total)
+	}
+	w.Flush()
+	return exitOK
+}
+
+// formatBytes 以合适的单位显示字节数
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	value := float64(n) / unit
+	for _, suffix := range []string{"KB", "MB", "GB"} {
+		if value < unit {
+			return fmt.Sprintf("%.1f%s", value, suffix)
+		}
+		value /= unit
+	}
+	return fmt.Sprintf("%.1fTB", value)
+}
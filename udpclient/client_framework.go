@@ -3,7 +3,13 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"math/rand"
 	"net"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/venshao/natun/gjson"
@@ -16,20 +22,87 @@ type NatConnection struct {
 	responseHandlerMap map[string]ResponseHandler
 	listen             *net.UDPConn
 	cancelBeatRoutine  *context.CancelFunc
+	forcePing          atomic.Bool // 网络变化后立即发送ping，不等待下一个心跳间隔
 }
 
 var serverAddr *net.UDPAddr
 
-// initServerAddr 初始化服务器地址
+// initServerAddr 初始化服务器地址，支持IPv4、IPv6地址和域名
 func initServerAddr() {
 	cfg := GetConfig()
-	serverAddr = &net.UDPAddr{
-		IP:   net.ParseIP(cfg.Server.Host),
-		Port: cfg.Server.Port,
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(cfg.Server.Host, strconv.Itoa(cfg.Server.Port)))
+	if err != nil {
+		glog.Errorf("[SERVER]解析服务器地址 %s 失败: %v", cfg.Server.Host, err)
+		addr = &net.UDPAddr{
+			IP:   net.ParseIP(cfg.Server.Host),
+			Port: cfg.Server.Port,
+		}
 	}
+	serverAddr = addr
 	glog.Debugf("[SERVER]服务器地址: %s", serverAddr.String())
 }
 
+// hasIPv6 本机是否有可用于直连的全局IPv6地址
+func hasIPv6() bool {
+	return len(localIPv6Candidates(0)) > 0
+}
+
+// localIPv6Candidates 本机的全局IPv6地址与监听端口组成的直连候选地址
+// IPv6通常没有NAT，对等节点可以直接向这些地址打洞；虚拟网段和私有地址不作为候选
+func localIPv6Candidates(port int) []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		glog.Debugf("[INNER]获取本机网卡地址失败: %v", err)
+		return nil
+	}
+	var candidates []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() != nil || !ipNet.IP.IsGlobalUnicast() || ipNet.IP.IsPrivate() || inOverlay(ipNet.IP) {
+			continue
+		}
+		candidates = append(candidates, net.JoinHostPort(ipNet.IP.String(), strconv.Itoa(port)))
+	}
+	return candidates
+}
+
+// callServer 向注册中心发送消息
+// 消息附带本机ID、时间戳和随机数，并以本机签名密钥签名，注册中心据此拒绝伪造的客户端ID
+func callServer(conn *net.UDPConn, path string, data map[string]interface{}) error {
+	return callServerAt(conn, serverAddr, path, data)
+}
+
+// signMessage 将消息封装为 {"body":<原始消息>,"sig":"<签名>"}
+// 签名针对 body 的原始字节，注册中心直接校验收到的字节，不依赖两端JSON序列化的结果一致
+func signMessage(body []byte) []byte {
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(getSigningKey(), body))
+	packet := make([]byte, 0, len(body)+len(sig)+20)
+	packet = append(packet, `{"body":`...)
+	packet = append(packet, body...)
+	packet = append(packet, `,"sig":"`...)
+	packet = append(packet, sig...)
+	return append(packet, `"}`...)
+}
+
+// callServerAt 向注册中心的指定地址发送签名消息，用于NAT探测端口
+func callServerAt(conn *net.UDPConn, addr *net.UDPAddr, path string, data map[string]interface{}) error {
+	data["path"] = path
+	data["id"] = getClientId()
+	data["ts"] = time.Now().UnixMilli()
+	data["n"] = rand.Int63()
+	body, err := gjson.New(data).ToJson()
+	if err != nil {
+		glog.Errorf("[INNER]JSON序列化失败: %v", err)
+		return err
+	}
+	packet := signMessage(body)
+	if _, err := conn.WriteToUDP(packet, addr); err != nil {
+		glog.Errorf("[INNER]发送数据失败: %v", err)
+		return err
+	}
+	return nil
+}
+
 func (p *NatConnection) RegisterResponseHandler(path string, handler ResponseHandler) {
 	if p.responseHandlerMap == nil {
 		p.responseHandlerMap = make(map[string]ResponseHandler)
@@ -40,8 +113,8 @@ func (p *NatConnection) RegisterResponseHandler(path string, handler ResponseHan
 func (p *NatConnection) StartClient(port int) {
 	// 创建UDP监听
 	var err error = nil
+	// 不指定IP时同时监听IPv4和IPv6，IPv6直连与IPv4打洞共用同一个端口
 	p.listen, err = net.ListenUDP("udp", &net.UDPAddr{
-		IP:   net.IPv4(0, 0, 0, 0),
 		Port: port,
 	})
 	if err != nil {
@@ -49,80 +122,9 @@ func (p *NatConnection) StartClient(port int) {
 	}
 
 	// 启动goroutine处理数据接收
-	go func() {
-		body := make([]byte, 65536) // 增大缓冲区到64KB，支持更大的UDP包
-		magicHeader := []byte{0x12, 0x34, 0x56, 0x78}
-		for {
-			n, addr, err := p.listen.ReadFromUDP(body)
-			if err != nil {
-				glog.Warningf("[INNER]读取UDP数据包失败 %v", err)
-				break
-			}
-			if n >= 5 && bytes.Equal(body[:4], magicHeader) {
-				// 统一协议头: [魔数4B] + [模式标识(1B)] + [其他数据]
-				mode := body[4]
-				if mode == 0x01 {
-					// 直连模式: [魔数4B] + [0x01] + [数据长度(2B)] + [TUN数据]
-					if n >= 7 {
-						length := int(body[5])<<8 | int(body[6])
-						if n-7 != length {
-							glog.Errorf("[TUN]收到的UDP报文长度%d不符合预期%d", n-7, length)
-							continue
-						}
-						//glog.Debugf("[TUN]收到直连 IP 报文 %d 字节，实际 %d 字节", n, length)
-						HandleReceivedPacket(p.listen, body[7:n])
-					}
-				} else if mode == 0x02 {
-					// 中转模式: [魔数4B] + [0x02] + [targetId长度(1B)] + [targetId] + [数据长度(2B)] + [数据]
-					if n >= 6 {
-						targetIdLen := int(body[5])
-						if n >= 6+targetIdLen+2 {
-							targetId := string(body[6 : 6+targetIdLen])
-							dataLen := int(body[6+targetIdLen])<<8 | int(body[6+targetIdLen+1])
-							data := body[6+targetIdLen+2 : n]
-
-							// 检查数据长度是否匹配
-							if len(data) != dataLen {
-								glog.Errorf("[TUN]中转数据长度不匹配: 期望%d, 实际%d", dataLen, len(data))
-								continue
-							}
-
-							// 检查是否为发给自己的数据
-							if targetId == getClientId() {
-								// 将数据写入TUN设备
-								HandleReceivedPacket(p.listen, data)
-								glog.Debugf("[TUN]收到中转数据%d字节", len(data))
-							}
-						}
-					}
-				}
-			} else {
-				// 处理内部通信数据包
-				content := string(body[:n])
-				//glog.Debugf("[INNER]内部通信数据包,来自 %s 内容: %s", addr.String(), content)
-				parseJSON, err := gjson.LoadContent(content)
-				if err != nil {
-					glog.Warningf("[INNER]JSON解析失败: %v 原始内容: %s", err, content)
-					continue
-				}
-
-				// 获取请求路径
-				path := parseJSON.GetString("path")
-				if path == "" {
-					glog.Warningf("[INNER]缺少必要字段: path, 原始内容: %s", content)
-					continue
-				}
-
-				// 路由匹配
-				if handler, exists := p.responseHandlerMap[path]; exists {
-					handler(p.listen, addr, path, parseJSON)
-				} else {
-					glog.Warningf("[INNER]不支持的请求路径: %s", path)
-				}
-			}
-		}
-		glog.Debug("数据读取协程退出")
-	}()
+	go p.serve(p.listen)
+	// 在路由器上为新端口申请映射，请求网关可能耗时数秒，不阻塞调用方
+	go portMapping.Start(p.listen.LocalAddr().(*net.UDPAddr).Port)
 	ctx, cancel := context.WithCancel(context.Background())
 	p.cancelBeatRoutine = &cancel
 	var lastBeatTime int64 = 0
@@ -135,14 +137,27 @@ func (p *NatConnection) StartClient(port int) {
 				glog.Debugf("心跳协程退出")
 				return
 			default:
-				if time.Now().Unix()-lastBeatTime < 3 {
+				if time.Now().Unix()-lastBeatTime < 3 && !p.forcePing.Swap(false) {
 					time.Sleep(time.Millisecond * 1)
 					continue
 				}
 				lastBeatTime = time.Now().Unix()
 				// 发送保活心跳
-				err := call(p.listen, serverAddr, "ping", map[string]interface{}{
-					"id": getClientId(),
+				// ping 同时携带签名公钥，首次ping时注册中心据此登记本机身份
+				// 并携带网络名称、IPv4和IPv6虚拟网段和当前虚拟IP，注册中心据此分配或续租虚拟IP
+				// 本机的IPv6候选地址和路由器映射的外部地址由注册中心随connectPeer转交给对等节点
+				natInfo := natDetector.GetNatInfo()
+				err := callServer(p.listen, "ping", map[string]interface{}{
+					"pk":      getSigningPublicKey(),
+					"net":     GetConfig().Network,
+					"subnet":  GetConfig().Subnet,
+					"subnet6": GetConfig().Subnet6,
+					"vip":     getTunIP(),
+					"ip6":     localIPv6Candidates(p.listen.LocalAddr().(*net.UDPAddr).Port),
+					"mapped":  portMapping.Advertised(),
+					// NAT类型由注册中心随connectPeer转交给对等节点，对方据此选择打洞策略
+					"natType":   natInfo.Type,
+					"portDelta": natInfo.PortDelta,
 				})
 				if err != nil {
 					glog.Errorf("[INNER]发送ping到注册中心失败 %v", err)
@@ -155,6 +170,136 @@ func (p *NatConnection) StartClient(port int) {
 	}(ctx)
 }
 
+// serve 读取并分发套接字收到的数据，套接字关闭后退出
+// 除主套接字外，生日攻击打洞时额外打开的套接字也由此处理，处理函数收到的是实际收到数据的套接字
+func (p *NatConnection) serve(conn *net.UDPConn) {
+	body := make([]byte, 65536) // 增大缓冲区到64KB，支持更大的UDP包
+	magicHeader := []byte{0x12, 0x34, 0x56, 0x78}
+	for {
+		n, addr, err := conn.ReadFromUDP(body)
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
+		if err != nil {
+			glog.Warningf("[INNER]读取UDP数据包失败 %v", err)
+			break
+		}
+		if n >= 5 && bytes.Equal(body[:4], magicHeader) {
+			// 统一协议头: [魔数4B] + [模式标识(1B)] + [其他数据]
+			mode := body[4]
+			if mode == 0x01 {
+				// 直连模式: [魔数4B] + [0x01] + [数据长度(2B)] + [TUN数据]
+				if n >= 7 {
+					length := int(body[5])<<8 | int(body[6])
+					// 直连帧不携带发送方ID，按来源地址找到对等节点
+					peer := GetConnectionManager().PeerByAddr(addr)
+					if n-7 != length {
+						glog.Errorf("[TUN]收到的UDP报文长度%d不符合预期%d", n-7, length)
+						statsOf(peer).dropLength.Add(1)
+						continue
+					}
+					//glog.Debugf("[TUN]收到直连 IP 报文 %d 字节，实际 %d 字节", n, length)
+					if peer == nil {
+						glog.Warningf("[TUN]丢弃来自未知地址 %s 的直连数据", addr.String())
+						unattributedTraffic.dropNoPeer.Add(1)
+						continue
+					}
+					if plain, ok := openTunnelFrame(peer, mode, body[7:n]); ok {
+						peer.TouchDirect()
+						peer.stats.CountReceived(ModeDirect, len(plain))
+						HandleReceivedPacket(conn, plain, peer)
+					}
+				}
+			} else if mode == 0x02 {
+				// 中转模式: [魔数4B] + [0x02] + [srcId长度(1B)] + [srcId] + [数据长度(2B)] + [数据]
+				// 服务器转发时已将帧头中的目标ID改写为经过验证的发送方ID
+				if n >= 6 {
+					srcIdLen := int(body[5])
+					if n >= 6+srcIdLen+2 {
+						srcId := string(body[6 : 6+srcIdLen])
+						dataLen := int(body[6+srcIdLen])<<8 | int(body[6+srcIdLen+1])
+						data := body[6+srcIdLen+2 : n]
+
+						// 只接受来自已建立连接的对等节点的数据，且必须来自注册中心
+						peer := GetConnectionManager().GetPeer(srcId)
+						if peer == nil || addr.String() != serverAddr.String() {
+							glog.Warningf("[TUN]丢弃来自非对等节点 %s 的中转数据", srcId)
+							unattributedTraffic.dropNoPeer.Add(1)
+							continue
+						}
+
+						// 检查数据长度是否匹配
+						if len(data) != dataLen {
+							glog.Errorf("[TUN]中转数据长度不匹配: 期望%d, 实际%d", dataLen, len(data))
+							peer.stats.dropLength.Add(1)
+							continue
+						}
+
+						// 解密后将数据写入TUN设备
+						if plain, ok := openTunnelFrame(peer, mode, data); ok {
+							peer.stats.CountReceived(ModeRelay, len(plain))
+							HandleReceivedPacket(conn, plain, peer)
+							glog.Debugf("[TUN]收到中转数据%d字节", len(plain))
+						}
+					}
+				}
+			}
+		} else {
+			// 处理内部通信数据包
+			content := string(body[:n])
+			//glog.Debugf("[INNER]内部通信数据包,来自 %s 内容: %s", addr.String(), content)
+			parseJSON, err := gjson.LoadContent(content)
+			if err != nil {
+				glog.Warningf("[INNER]JSON解析失败: %v 原始内容: %s", err, content)
+				continue
+			}
+
+			// 获取请求路径
+			path := parseJSON.GetString("path")
+			if path == "" {
+				glog.Warningf("[INNER]缺少必要字段: path, 原始内容: %s", content)
+				continue
+			}
+
+			// 注册中心拒绝了本机的请求（如签名校验失败）
+			if parseJSON.GetString("status") == "error" {
+				glog.Warningf("[INNER]注册中心拒绝请求 %s: %s", path, parseJSON.GetString("message"))
+				continue
+			}
+
+			// 路由匹配
+			if handler, exists := p.responseHandlerMap[path]; exists {
+				handler(conn, addr, path, parseJSON)
+			} else {
+				glog.Warningf("[INNER]不支持的请求路径: %s", path)
+			}
+		}
+	}
+	glog.Debug("数据读取协程退出")
+}
+
+// openTunnelFrame 使用与对等节点的会话密钥解密隧道帧，失败时计数并丢弃
+func openTunnelFrame(peer *Peer, mode byte, sealed []byte) ([]byte, bool) {
+	sessionCipher := peer.GetCipher()
+	if sessionCipher == nil {
+		peer.stats.decryptErrors.Add(1)
+		glog.Warningf("[CRYPTO]与 %s 的会话密钥未建立，丢弃隧道数据%d字节，累计失败%d次", peer.clientId, len(sealed), countDecryptFail())
+		return nil, false
+	}
+	plain, err := sessionCipher.Open(mode, sealed)
+	if err != nil {
+		peer.stats.decryptErrors.Add(1)
+		glog.Warningf("[CRYPTO]隧道数据解密失败：%v，累计失败%d次", err, countDecryptFail())
+		return nil, false
+	}
+	return plain, true
+}
+
+// pingNow 立即向注册中心发送ping
+func (p *NatConnection) pingNow() {
+	p.forcePing.Store(true)
+}
+
 func (p *NatConnection) changePort(port int) {
 	if p.cancelBeatRoutine != nil {
 		(*p.cancelBeatRoutine)()
@@ -2,9 +2,11 @@ package main
 
 import (
 	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	mathrand "math/rand"
+	"net"
+	"net/netip"
 	"os"
 	"sync"
 
@@ -13,12 +15,25 @@ import (
 
 // Config 配置结构体
 type Config struct {
-	PunchHole PunchHoleConfig `json:"punch_hole"`
-	Server    ServerConfig    `json:"server"`
-	LogLevel  string          `json:"log_level"`
-	TunIP     string          `json:"tun_ip"`
-	ClientID  string          `json:"client_id"`
-	ClientPwd string          `json:"client_pwd"`
+	PunchHole  PunchHoleConfig   `json:"punch_hole"`
+	Server     ServerConfig      `json:"server"`
+	LogLevel   string            `json:"log_level"`
+	TunIP      string            `json:"tun_ip"`  // 本机虚拟IP，以注册中心分配的地址为准
+	Network    string            `json:"network"` // 虚拟网络名称，注册中心按网络分配虚拟IP
+	Subnet     string            `json:"subnet"`  // 虚拟局域网IPv4网段，决定虚拟IP范围和TUN路由
+	Subnet6    string            `json:"subnet6"` // 虚拟局域网IPv6网段，配置为空时不启用IPv6
+	ClientID   string            `json:"client_id"`
+	ClientPwd  string            `json:"client_pwd"`
+	PrivateKey string            `json:"private_key"` // 本机X25519身份私钥（base64）
+	KnownPeers map[string]string `json:"known_peers"` // 已连接过的对等节点ID -> 身份公钥
+	// 网络变化或对方掉线后自动重连本机主动连接过的对等节点
+	AutoReconnect bool `json:"auto_reconnect"`
+	// 本机控制套接字的路径和允许访问的属组，路径为空时不启用
+	ControlSocket string `json:"control_socket"`
+	ControlGroup  string `json:"control_group"`
+	// Web控制台的监听地址和访问令牌
+	WebAddr  string `json:"web_addr"`
+	WebToken string `json:"web_token"`
 }
 
 // ServerConfig 服务器配置
@@ -29,12 +44,18 @@ type ServerConfig struct {
 
 // PunchHoleConfig 打洞配置
 type PunchHoleConfig struct {
-	MaxConcurrency int  `json:"max_concurrency"`
-	PortRange      int  `json:"port_range"`
-	BasePortOffset int  `json:"base_port_offset"`
-	EnableRelay    bool `json:"enable_relay"`
-	PunchTimeout   int  `json:"punch_timeout"`
-	RelayFallback  bool `json:"relay_fallback"`
+	MaxConcurrency  int    `json:"max_concurrency"`
+	PortRange       int    `json:"port_range"`
+	BasePortOffset  int    `json:"base_port_offset"`
+	EnableRelay     bool   `json:"enable_relay"`
+	PunchTimeout    int    `json:"punch_timeout"`
+	RelayFallback   bool   `json:"relay_fallback"`
+	Strategy        string `json:"strategy"`         // 打洞策略：auto、scan、delta、birthday
+	BirthdaySockets int    `json:"birthday_sockets"` // 生日攻击打洞时打开的本地套接字数量
+	PrimingTTL      int    `json:"priming_ttl"`      // 预热报文的TTL，0表示不发送预热报文
+	PortMapping     bool   `json:"port_mapping"`     // 通过UPnP、NAT-PMP或PCP在路由器上申请端口映射
+	RepunchInterval int    `json:"repunch_interval"` // 中转模式下重新打洞的间隔秒数，0表示不重新打洞
+	DirectTimeout   int    `json:"direct_timeout"`   // 直连模式下超过该秒数未收到对方报文则认为直连路径失效
 }
 
 var (
@@ -47,28 +68,96 @@ var (
 func createDefaultConfig() *Config {
 	return &Config{
 		PunchHole: PunchHoleConfig{
-			MaxConcurrency: 2,
-			PortRange:      16,
-			BasePortOffset: 0,
-			EnableRelay:    true,
-			PunchTimeout:   20,
-			RelayFallback:  true,
+			MaxConcurrency:  2,
+			PortRange:       16,
+			BasePortOffset:  0,
+			EnableRelay:     true,
+			PunchTimeout:    20,
+			RelayFallback:   true,
+			Strategy:        PunchAuto,
+			BirthdaySockets: 64,
+			PrimingTTL:      3,
+			PortMapping:     true,
+			RepunchInterval: 60,
+			DirectTimeout:   20,
 		},
 		Server: ServerConfig{
 			Host: "117.72.206.26",
 			Port: 17709,
 		},
-		LogLevel:  "INFO",
-		TunIP:     generateRandomTunIP(),
-		ClientID:  generateRandomClientId(8),
-		ClientPwd: generateRandomPwd(6),
+		LogLevel:      "INFO",
+		TunIP:         generateRandomTunIP(netip.MustParsePrefix(defaultSubnet)),
+		Network:       "default",
+		Subnet:        defaultSubnet,
+		Subnet6:       generateSubnet6(),
+		ClientID:      generateRandomClientId(8),
+		ClientPwd:     generateRandomPwd(6),
+		PrivateKey:    generatePrivateKey(),
+		KnownPeers:    make(map[string]string),
+		AutoReconnect: true,
+		ControlSocket: defaultControlSocket,
+		WebAddr:       defaultWebAddr,
 	}
 }
 
-// ensureConfigDefaults 确保配置字段有默认值
-func ensureConfigDefaults(cfg *Config) {
-	if cfg.TunIP == "" {
-		cfg.TunIP = generateRandomTunIP()
+// ensureConfigDefaults 确保配置字段有默认值，返回是否需要回写配置文件
+func ensureConfigDefaults(cfg *Config) bool {
+	changed := false
+	subnet, err := parseSubnet(cfg.Subnet)
+	if err != nil {
+		if cfg.Subnet != "" {
+			glog.Warningf("[CONFIG]%v，使用默认网段 %s", err, defaultSubnet)
+		}
+		cfg.Subnet = defaultSubnet
+		subnet = netip.MustParsePrefix(defaultSubnet)
+		changed = true
+	} else if subnet.String() != cfg.Subnet {
+		cfg.Subnet = subnet.String()
+		changed = true
+	}
+	if _, err := parseSubnet6(cfg.Subnet6); err != nil {
+		glog.Warningf("[CONFIG]%v，不启用IPv6虚拟网段", err)
+		cfg.Subnet6 = ""
+		changed = true
+	} else if cfg.Subnet6 == legacySubnet6 {
+		cfg.Subnet6 = generateSubnet6()
+		glog.Infof("[CONFIG]IPv6虚拟网段 %s 是旧版本的固定网段，改为随机生成的 %s", legacySubnet6, cfg.Subnet6)
+		changed = true
+	}
+	if addr, err := netip.ParseAddr(cfg.TunIP); err != nil || !isHostAddr(subnet, addr) {
+		if cfg.TunIP != "" {
+			glog.Warningf("[CONFIG]TUN IP %s 不在虚拟网段 %s 内，重新生成", cfg.TunIP, cfg.Subnet)
+		}
+		cfg.TunIP = generateRandomTunIP(subnet)
+		changed = true
+	}
+	if _, ok := punchStrategies[cfg.PunchHole.Strategy]; !ok && cfg.PunchHole.Strategy != PunchAuto {
+		if cfg.PunchHole.Strategy != "" {
+			glog.Warningf("[CONFIG]不支持的打洞策略 %s，改为自动选择", cfg.PunchHole.Strategy)
+		}
+		cfg.PunchHole.Strategy = PunchAuto
+		changed = true
+	}
+	// 每个套接字占用一个本地端口和文件描述符，数量需要限制
+	if cfg.PunchHole.BirthdaySockets <= 0 || cfg.PunchHole.BirthdaySockets > 256 {
+		cfg.PunchHole.BirthdaySockets = 64
+		changed = true
+	}
+	if cfg.PunchHole.PrimingTTL < 0 || cfg.PunchHole.PrimingTTL > 255 {
+		cfg.PunchHole.PrimingTTL = 0
+		changed = true
+	}
+	if cfg.PunchHole.RepunchInterval < 0 {
+		cfg.PunchHole.RepunchInterval = 60
+		changed = true
+	}
+	// 心跳间隔为5秒，超时时间至少覆盖两次心跳，避免偶发丢包导致误判
+	if cfg.PunchHole.DirectTimeout < 10 {
+		cfg.PunchHole.DirectTimeout = 20
+		changed = true
+	}
+	if cfg.Network == "" {
+		cfg.Network = "default"
 	}
 	if cfg.ClientID == "" {
 		cfg.ClientID = generateRandomClientId(8)
@@ -82,6 +171,27 @@ func ensureConfigDefaults(cfg *Config) {
 	if cfg.Server.Port == 0 {
 		cfg.Server.Port = 17709
 	}
+	if cfg.PrivateKey == "" {
+		// 身份密钥必须持久化，否则对等节点记录的公钥将失效
+		cfg.PrivateKey = generatePrivateKey()
+		changed = true
+	}
+	if cfg.KnownPeers == nil {
+		cfg.KnownPeers = make(map[string]string)
+	}
+	if _, _, err := net.SplitHostPort(cfg.WebAddr); err != nil {
+		if cfg.WebAddr != "" {
+			glog.Warningf("[CONFIG]Web控制台监听地址 %s 无效，改为 %s", cfg.WebAddr, defaultWebAddr)
+		}
+		cfg.WebAddr = defaultWebAddr
+		changed = true
+	}
+	if cfg.WebToken == "" {
+		// 不在默认配置中生成，确保旧配置文件升级后令牌被写回，否则每次启动的令牌都不同
+		cfg.WebToken = generateWebToken()
+		changed = true
+	}
+	return changed
 }
 
 // LoadConfig 加载配置文件
@@ -95,10 +205,14 @@ func LoadConfig() *Config {
 		if err != nil {
 			glog.Warningf("[CONFIG]读取配置文件失败，使用默认配置: %v", err)
 			// 保存默认配置文件
+			ensureConfigDefaults(config)
 			saveConfig(config)
 			return
 		}
 
+		// 旧版本以0644保存的配置文件收紧为仅所有者可读写
+		restrictConfigFile()
+
 		// 解析JSON配置
 		if err := json.Unmarshal(data, config); err != nil {
 			glog.Errorf("[CONFIG]解析配置文件失败: %v", err)
@@ -106,18 +220,36 @@ func LoadConfig() *Config {
 		}
 
 		// 确保配置字段有默认值
-		ensureConfigDefaults(config)
+		if ensureConfigDefaults(config) {
+			saveConfig(config)
+		}
 
 		glog.Debugf("[CONFIG]成功加载配置文件: %s", configFile)
-		glog.Debugf("[CONFIG]打洞配置 - 最大并发数: %d, 端口范围: %d, 基础端口偏移: %d, 启用中转: %v, 打洞超时: %d秒, 自动回退: %v",
+		glog.Debugf("[CONFIG]打洞配置 - 最大并发数: %d, 端口范围: %d, 基础端口偏移: %d, 启用中转: %v, 打洞超时: %d秒, 自动回退: %v, 打洞策略: %s",
 			config.PunchHole.MaxConcurrency, config.PunchHole.PortRange, config.PunchHole.BasePortOffset,
-			config.PunchHole.EnableRelay, config.PunchHole.PunchTimeout, config.PunchHole.RelayFallback)
-		glog.Debugf("[CONFIG]TUN IP: %s, 客户端ID: %s", config.TunIP, config.ClientID)
+			config.PunchHole.EnableRelay, config.PunchHole.PunchTimeout, config.PunchHole.RelayFallback, config.PunchHole.Strategy)
+		glog.Debugf("[CONFIG]TUN IP: %s, 虚拟网段: %s, 客户端ID: %s", config.TunIP, config.Subnet, config.ClientID)
 	})
 
 	return config
 }
 
+// 配置文件中保存了连接密码、私钥和Web控制台的访问令牌，只允许所有者读写
+const configFileMode = 0600
+
+// restrictConfigFile 配置文件允许其他用户访问时收紧权限（Windows上只影响只读属性）
+func restrictConfigFile() {
+	info, err := os.Stat(configFile)
+	if err != nil || info.Mode().Perm()&^configFileMode == 0 {
+		return
+	}
+	if err := os.Chmod(configFile, configFileMode); err != nil {
+		glog.Warningf("[CONFIG]配置文件 %s 的权限为 %v，其他用户可以读取，收紧权限失败: %v", configFile, info.Mode().Perm(), err)
+		return
+	}
+	glog.Infof("[CONFIG]已将配置文件 %s 的权限从 %v 收紧为 %v", configFile, info.Mode().Perm(), os.FileMode(configFileMode))
+}
+
 // saveConfig 保存配置到文件
 func saveConfig(cfg *Config) error {
 	data, err := json.MarshalIndent(cfg, "", "  ")
@@ -126,10 +258,12 @@ func saveConfig(cfg *Config) error {
 		return err
 	}
 
-	if err := os.WriteFile(configFile, data, 0644); err != nil {
+	if err := os.WriteFile(configFile, data, configFileMode); err != nil {
 		glog.Errorf("[CONFIG]保存配置文件失败: %v", err)
 		return err
 	}
+	// 文件已存在时 WriteFile 不修改权限
+	restrictConfigFile()
 
 	glog.Debugf("[CONFIG]已保存配置文件: %s", configFile)
 	return nil
@@ -151,11 +285,9 @@ func GetConfig() *Config {
 	return config
 }
 
-// generateRandomTunIP 生成随机TUN IP
-func generateRandomTunIP() string {
-	// 随机生成TUN设备IP地址
-	randomIp := fmt.Sprintf("10.10.10.%d", mathrand.Intn(250)+2)
-	return randomIp
+// generateRandomTunIP 在虚拟网段内生成随机TUN IP，仅在注册中心分配地址之前作为初始值
+func generateRandomTunIP(subnet netip.Prefix) string {
+	return randomHostAddr(subnet)
 }
 
 // generateRandomClientId 生成随机客户端ID
@@ -170,6 +302,15 @@ func generateRandomPwd(length int) string {
 	return string(randomBytes)
 }
 
+// generateWebToken 生成Web控制台的访问令牌
+func generateWebToken() string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(token)
+}
+
 // getRandomStrAsBytes 生成随机字符串字节数组
 func getRandomStrAsBytes(length int) []byte {
 	const charset = "123456789"
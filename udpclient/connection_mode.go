@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"sync"
 	"time"
@@ -17,75 +19,241 @@ const (
 	ModeDisconnected                       // 断开状态
 )
 
-// ConnectionManager 连接管理器
-type ConnectionManager struct {
-	mode           ConnectionMode
+// Peer 对等节点
+// 每个对等节点各自维护连接模式、心跳、延迟和会话密钥，本机可同时与多个对等节点保持连接
+type Peer struct {
+	clientId string
+
+	stats *TrafficStats // 隧道流量统计
+
+	mu             sync.RWMutex
 	peerAddr       *net.UDPAddr
-	peerClientId   string
+	conn           *net.UDPConn // 直连使用的本机套接字，生日攻击打洞经额外的套接字打通时不为nil
+	peerVirtualIp  string
+	peerVirtualIp6 string // 对等节点的IPv6虚拟地址，对方未启用IPv6时为空
+	leasedVip      string // 注册中心在双方共同网络中分配给对方的虚拟IP，非空时对方声明的虚拟IP必须与之一致
+	peerAlive      bool
+	mode           ConnectionMode
 	lastModeChange time.Time
+	modeReason     string    // 最近一次切换连接模式的原因
+	repunching     bool      // 中转模式下是否正在重新打洞
+	lastDirectRecv time.Time // 最近一次经直连路径收到对方报文的时间
+	latency        int
+	cancelRoutine  *context.CancelFunc // 取消向对等节点发心跳和延迟测试的协程
+	pake           *Pake
+	handshake      *Handshake
+	cipher         *SessionCipher
+}
+
+// ConnectionManager 连接管理器
+// 维护以客户端ID为键的对等节点表，以及虚拟IP、直连地址到对等节点的索引
+type ConnectionManager struct {
+	mu             sync.RWMutex
+	peers          map[string]*Peer
+	vipIndex       map[string]string // 对等节点虚拟IP（IPv4和IPv6） -> 客户端ID
+	addrIndex      map[string]string // 对等节点直连地址 -> 客户端ID
+	credentials    map[string]string // 本机主动连接时使用的对方密码，只保存在内存中，用于重新连接
 	isConnecting   bool
 	connectFailed  bool
 	connectMessage string
-	mu             sync.RWMutex
 }
 
 var connectionManager = &ConnectionManager{
-	mode:           ModeDisconnected,
-	peerAddr:       nil,
-	peerClientId:   "",
-	lastModeChange: time.Time{},
+	peers:       make(map[string]*Peer),
+	vipIndex:    make(map[string]string),
+	addrIndex:   make(map[string]string),
+	credentials: make(map[string]string),
 }
 
-// GetMode 获取当前连接模式
-func (cm *ConnectionManager) GetMode() ConnectionMode {
-	cm.mu.RLock()
-	defer cm.mu.RUnlock()
-	return cm.mode
+// GetMode 获取对等节点的连接模式
+func (p *Peer) GetMode() ConnectionMode {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.mode
 }
 
-// SetMode 设置连接模式
-func (cm *ConnectionManager) SetMode(mode ConnectionMode) {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
+// SetMode 设置对等节点的连接模式，模式变化时记录切换时间和原因
+// 断开由 closePeer 推送，其余模式变化推送到事件流
+func (p *Peer) SetMode(mode ConnectionMode, reason string) {
+	p.mu.Lock()
+	oldMode := p.mode
+	if oldMode == mode {
+		p.mu.Unlock()
+		return
+	}
+	p.mode = mode
+	p.lastModeChange = time.Now()
+	p.modeReason = reason
+	p.mu.Unlock()
+	glog.Infof("[CONNECTION]与 %s 的连接模式从 %s 切换到 %s：%s", p.clientId, getModeString(oldMode), getModeString(mode), reason)
+	if mode != ModeDisconnected {
+		publishPeerState(p.clientId, modeState(mode), reason)
+	}
+}
 
-	oldMode := cm.mode
-	cm.mode = mode
-	cm.lastModeChange = time.Now()
+// GetModeChange 获取最近一次切换连接模式的时间和原因
+func (p *Peer) GetModeChange() (time.Time, string) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.lastModeChange, p.modeReason
+}
 
-	if oldMode != mode {
-		glog.Infof("[CONNECTION]连接模式从 %s 切换到 %s", getModeString(oldMode), getModeString(mode))
+// beginRepunch 标记开始重新打洞，已在进行时返回false
+func (p *Peer) beginRepunch() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.repunching {
+		return false
 	}
+	p.repunching = true
+	return true
 }
 
-// SetPeerInfo 设置对等节点信息
-func (cm *ConnectionManager) SetPeerInfo(clientId string, addr *net.UDPAddr) {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-	cm.peerClientId = clientId
-	cm.peerAddr = addr
+// endRepunch 标记重新打洞结束
+func (p *Peer) endRepunch() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.repunching = false
 }
 
-// GetPeerInfo 获取对等节点信息
-func (cm *ConnectionManager) GetPeerInfo() (string, *net.UDPAddr) {
-	cm.mu.RLock()
-	defer cm.mu.RUnlock()
-	return cm.peerClientId, cm.peerAddr
+// TouchDirect 记录经直连路径收到了对方的报文
+func (p *Peer) TouchDirect() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastDirectRecv = time.Now()
+}
+
+// DirectIdle 距最近一次经直连路径收到对方报文的时长
+func (p *Peer) DirectIdle() time.Duration {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return time.Since(p.lastDirectRecv)
 }
 
 // IsDirectMode 是否为直连模式
-func (cm *ConnectionManager) IsDirectMode() bool {
-	return cm.GetMode() == ModeDirect
+func (p *Peer) IsDirectMode() bool {
+	return p.GetMode() == ModeDirect
 }
 
 // IsRelayMode 是否为中转模式
-func (cm *ConnectionManager) IsRelayMode() bool {
-	return cm.GetMode() == ModeRelay
+func (p *Peer) IsRelayMode() bool {
+	return p.GetMode() == ModeRelay
+}
+
+// IsAlive 对等节点是否已连通
+func (p *Peer) IsAlive() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.peerAlive
+}
+
+// GetAddr 获取对等节点的直连地址
+func (p *Peer) GetAddr() *net.UDPAddr {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.peerAddr
+}
+
+// GetConn 获取与对等节点直连使用的本机套接字，未单独指定时为主套接字
+func (p *Peer) GetConn() *net.UDPConn {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.conn != nil {
+		return p.conn
+	}
+	return natConnection.listen
+}
+
+// SetConn 指定与对等节点直连使用的本机套接字，传入主套接字时恢复默认
+func (p *Peer) SetConn(conn *net.UDPConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if conn == natConnection.listen {
+		conn = nil
+	}
+	p.conn = conn
+}
+
+// GetVirtualIp 获取对等节点的虚拟IP
+func (p *Peer) GetVirtualIp() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.peerVirtualIp
+}
+
+// SetLeasedVip 记录注册中心分配给对等节点的虚拟IP，为空时不修改（旧版本注册中心不下发）
+func (p *Peer) SetLeasedVip(vip string) {
+	if vip == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.leasedVip = vip
+}
+
+// GetVirtualIp6 获取对等节点的IPv6虚拟地址
+func (p *Peer) GetVirtualIp6() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.peerVirtualIp6
+}
+
+// GetLatency 获取往返延迟（毫秒），未测得时为-1
+func (p *Peer) GetLatency() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.latency
+}
+
+// SetLatency 设置往返延迟（毫秒），并推送到事件流
+func (p *Peer) SetLatency(latency int) {
+	p.mu.Lock()
+	p.latency = latency
+	p.mu.Unlock()
+	eventHub.Publish(EventLatency, LatencyEvent{PeerId: p.clientId, Latency: latency, Time: time.Now().UnixMilli()})
+}
+
+// GetPake 获取尚未完成的PAKE状态
+func (p *Peer) GetPake() *Pake {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.pake
+}
+
+// SetPake 设置本方发起连接时的PAKE状态
+func (p *Peer) SetPake(pake *Pake) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pake = pake
+}
+
+// GetHandshake 获取与对等节点的握手状态
+func (p *Peer) GetHandshake() *Handshake {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.handshake
+}
+
+// SetHandshake 完成PAKE后设置握手状态，清除PAKE状态
+func (p *Peer) SetHandshake(hs *Handshake) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pake = nil
+	p.handshake = hs
+}
+
+// GetCipher 获取与对等节点的会话加密器
+func (p *Peer) GetCipher() *SessionCipher {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.cipher
 }
 
-// IsConnected 是否已连接
-func (cm *ConnectionManager) IsConnected() bool {
-	mode := cm.GetMode()
-	return mode == ModeDirect || mode == ModeRelay
+// SetCipher 设置与对等节点的会话加密器
+func (p *Peer) SetCipher(sessionCipher *SessionCipher) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cipher = sessionCipher
 }
 
 // getModeString 获取模式字符串
@@ -102,6 +270,163 @@ func getModeString(mode ConnectionMode) string {
 	}
 }
 
+// AddPeer 在对等节点表中创建新的对等节点，已存在同ID节点时返回 nil
+func (cm *ConnectionManager) AddPeer(clientId string) *Peer {
+	cm.mu.Lock()
+	if _, exists := cm.peers[clientId]; exists {
+		cm.mu.Unlock()
+		return nil
+	}
+	p := &Peer{
+		clientId: clientId,
+		mode:     ModeDisconnected,
+		latency:  -1,
+		stats:    newTrafficStats(),
+	}
+	cm.peers[clientId] = p
+	cm.mu.Unlock()
+	publishPeerState(clientId, StateConnecting, "")
+	return p
+}
+
+// SetCredential 记录本机主动连接对等节点时使用的密码
+func (cm *ConnectionManager) SetCredential(clientId string, password string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.credentials[clientId] = password
+}
+
+// GetCredential 获取最近一次主动连接对等节点时使用的密码
+func (cm *ConnectionManager) GetCredential(clientId string) (string, bool) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	password, ok := cm.credentials[clientId]
+	return password, ok
+}
+
+// GetPeer 根据客户端ID获取对等节点
+func (cm *ConnectionManager) GetPeer(clientId string) *Peer {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return cm.peers[clientId]
+}
+
+// RemovePeer 从对等节点表中移除对等节点及其索引
+func (cm *ConnectionManager) RemovePeer(p *Peer) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.peers[p.clientId] != p {
+		return
+	}
+	delete(cm.peers, p.clientId)
+	for vip, clientId := range cm.vipIndex {
+		if clientId == p.clientId {
+			delete(cm.vipIndex, vip)
+		}
+	}
+	for addr, clientId := range cm.addrIndex {
+		if clientId == p.clientId {
+			delete(cm.addrIndex, addr)
+		}
+	}
+}
+
+// ClearDirectPath 直连路径失效后清除对等节点的直连地址及其索引，重新打洞成功时按新的地址登记
+// 返回打洞时为该节点额外打开的套接字，由调用方关闭
+func (cm *ConnectionManager) ClearDirectPath(p *Peer) *net.UDPConn {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, clientId := range cm.addrIndex {
+		if clientId == p.clientId {
+			delete(cm.addrIndex, addr)
+		}
+	}
+	p.peerAddr = nil
+	conn := p.conn
+	p.conn = nil
+	return conn
+}
+
+// GetPeers 获取全部对等节点
+func (cm *ConnectionManager) GetPeers() []*Peer {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	peers := make([]*Peer, 0, len(cm.peers))
+	for _, p := range cm.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// AlivePeerCount 已连通的对等节点数量
+func (cm *ConnectionManager) AlivePeerCount() int {
+	count := 0
+	for _, p := range cm.GetPeers() {
+		if p.IsAlive() {
+			count++
+		}
+	}
+	return count
+}
+
+// PeerByVip 根据虚拟IP查找对等节点，用于为TUN数据包选择目的节点
+func (cm *ConnectionManager) PeerByVip(vip string) *Peer {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return cm.peers[cm.vipIndex[vip]]
+}
+
+// PeerByAddr 根据直连地址查找对等节点，直连数据帧不携带发送方ID
+func (cm *ConnectionManager) PeerByAddr(addr *net.UDPAddr) *Peer {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return cm.peers[cm.addrIndex[addr.String()]]
+}
+
+// MarkAlive 标记对等节点已连通并登记其虚拟IP和直连地址（中转模式下 addr 为 nil）
+// 返回是否为第一次连通；虚拟IP已属于其他对等节点时保留原有归属，拒绝登记并返回错误
+func (cm *ConnectionManager) MarkAlive(p *Peer, vip string, vip6 string, addr *net.UDPAddr) (bool, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// 对方声明的虚拟IP必须与注册中心分配的租约一致，否则可以冒用同一网络中其他节点的地址
+	if p.leasedVip != "" && vip != "" && vip != p.leasedVip {
+		return false, fmt.Errorf("对等节点声明的虚拟IP %s 与注册中心分配的 %s 不一致", vip, p.leasedVip)
+	}
+	for _, claimed := range []string{vip, vip6} {
+		if other, exists := cm.vipIndex[claimed]; claimed != "" && exists && other != p.clientId {
+			return false, fmt.Errorf("虚拟IP %s 已属于对等节点 %s", claimed, other)
+		}
+	}
+	first := !p.peerAlive
+	p.peerAlive = true
+	cm.indexVip(p, &p.peerVirtualIp, vip)
+	cm.indexVip(p, &p.peerVirtualIp6, vip6)
+	if addr != nil {
+		// 对等节点可能同时通过IPv4和IPv6打通，两个地址都登记到索引，发送时优先使用IPv6地址
+		if p.peerAddr == nil || (p.peerAddr.IP.To4() != nil && addr.IP.To4() == nil) {
+			p.peerAddr = addr
+		}
+		cm.addrIndex[addr.String()] = p.clientId
+	}
+	return first, nil
+}
+
+// indexVip 更新对等节点的虚拟IP并维护虚拟IP索引，调用方需持有两把写锁并已确认虚拟IP未被其他对等节点占用
+func (cm *ConnectionManager) indexVip(p *Peer, current *string, vip string) {
+	if vip == "" || vip == *current {
+		return
+	}
+	if cm.vipIndex[*current] == p.clientId {
+		delete(cm.vipIndex, *current)
+	}
+	*current = vip
+	cm.vipIndex[vip] = p.clientId
+}
+
 // SetConnecting 设置连接状态
 func (cm *ConnectionManager) SetConnecting(connecting bool, message string) {
 	cm.mu.Lock()
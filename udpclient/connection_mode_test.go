@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func newTestConnectionManager() *ConnectionManager {
+	return &ConnectionManager{
+		peers:       make(map[string]*Peer),
+		vipIndex:    make(map[string]string),
+		addrIndex:   make(map[string]string),
+		credentials: make(map[string]string),
+	}
+}
+
+// TestMarkAliveChecksLeasedVip 对方声明的虚拟IP必须与注册中心分配的租约一致
+func TestMarkAliveChecksLeasedVip(t *testing.T) {
+	cm := newTestConnectionManager()
+	p := cm.AddPeer("b")
+	p.SetLeasedVip("10.10.10.3")
+	addr := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 4000}
+
+	if _, err := cm.MarkAlive(p, "10.10.10.9", "", addr); err == nil {
+		t.Fatal("与租约不一致的虚拟IP被接受")
+	}
+	if p.IsAlive() || cm.PeerByVip("10.10.10.9") != nil {
+		t.Fatal("校验失败后对等节点的状态被修改")
+	}
+	first, err := cm.MarkAlive(p, "10.10.10.3", "", addr)
+	if err != nil || !first {
+		t.Fatalf("MarkAlive = %v %v, want true nil", first, err)
+	}
+	if got := cm.PeerByVip("10.10.10.3"); got != p {
+		t.Fatal("虚拟IP索引没有指向对等节点")
+	}
+}
+
+// TestMarkAliveRejectsTakenVip 已属于其他对等节点的虚拟IP不能被重新绑定
+func TestMarkAliveRejectsTakenVip(t *testing.T) {
+	cm := newTestConnectionManager()
+	b, c := cm.AddPeer("b"), cm.AddPeer("c")
+	if _, err := cm.MarkAlive(b, "10.10.10.3", "", nil); err != nil {
+		t.Fatalf("MarkAlive: %v", err)
+	}
+	if _, err := cm.MarkAlive(c, "10.10.10.3", "", nil); err == nil {
+		t.Fatal("其他对等节点的虚拟IP被接受")
+	}
+	if got := cm.PeerByVip("10.10.10.3"); got != b {
+		t.Fatal("虚拟IP索引被改写")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/venshao/natun/gin"
+	"github.com/venshao/natun/glog"
+)
+
+// 本机控制套接字：在Unix域套接字上提供与Web控制台相同的 /api 接口，以及只在本机开放的管理接口，
+// 访问权限由套接字文件的属主、属组和权限控制，命令行工具和脚本无需开放网络端口即可操作客户端
+var (
+	controlListener net.Listener
+	controlMu       sync.Mutex
+)
+
+// LogLevelRequest 修改日志级别请求结构体
+type LogLevelRequest struct {
+	Level string `json:"level"`
+}
+
+// startControlServer 在配置的路径上监听控制套接字，路径为空时不启用
+func startControlServer() {
+	cfg := GetConfig()
+	path := cfg.ControlSocket
+	if path == "" {
+		return
+	}
+	// 上次异常退出会残留套接字文件，能连上说明已有客户端在运行
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			glog.Errorf("[CONTROL]控制套接字 %s 已被其他客户端使用，不启用本机控制接口", path)
+			return
+		}
+		os.Remove(path)
+	}
+	listener, err := listenControlSocket(path, cfg.ControlGroup)
+	if err != nil {
+		glog.Errorf("[CONTROL]监听控制套接字 %s 失败：%v", path, err)
+		return
+	}
+	controlMu.Lock()
+	controlListener = listener
+	controlMu.Unlock()
+	glog.Infof("[CONTROL]本机控制接口：%s", path)
+
+	r := gin.New()
+	api := r.Group("/api")
+	registerApiRoutes(api)
+	api.POST("/shutdown", shutdownHandler)
+	api.POST("/logLevel", logLevelHandler)
+	if err := r.RunListener(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+		glog.Errorf("[CONTROL]控制接口退出：%v", err)
+	}
+}
+
+// closeControlServer 关闭控制套接字，监听器关闭时删除套接字文件
+func closeControlServer() {
+	controlMu.Lock()
+	defer controlMu.Unlock()
+	if controlListener != nil {
+		controlListener.Close()
+		controlListener = nil
+	}
+}
+
+// 退出客户端
+func shutdownHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"code": 0, "message": "正在退出"})
+	go shutdown()
+}
+
+// 修改日志级别，不写入配置文件，重启后恢复为配置的级别
+func logLevelHandler(c *gin.Context) {
+	var req LogLevelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "message": "无效的请求参数"})
+		return
+	}
+	level := strings.ToUpper(req.Level)
+	switch level {
+	case "DEBUG", "INFO", "WARN", "ERROR":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "message": "日志级别只能为 DEBUG、INFO、WARN 或 ERROR"})
+		return
+	}
+	glog.SetLevelString(level)
+	glog.Infof("[CONTROL]日志级别已修改为 %s", level)
+	c.JSON(http.StatusOK, gin.H{"code": 0, "message": "日志级别已修改为 " + level})
+}
@@ -0,0 +1,43 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// 控制套接字的默认路径，Linux上 /var/run 指向 /run
+const defaultControlSocket = "/var/run/natun.sock"
+
+// listenControlSocket 创建只有属主（root）可以访问的控制套接字，指定属组时属组成员也可以访问
+// 创建期间收紧umask，避免套接字在修改权限之前被其他用户连接
+func listenControlSocket(path string, group string) (net.Listener, error) {
+	oldMask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, err
+	}
+	if group == "" {
+		return listener, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err == nil {
+		var gid int
+		if gid, err = strconv.Atoi(g.Gid); err == nil {
+			if err = os.Chown(path, -1, gid); err == nil {
+				err = os.Chmod(path, 0660)
+			}
+		}
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"net"
+
+	"github.com/venshao/natun/glog"
+)
+
+// Windows上默认不启用控制套接字，配置路径后访问权限取决于所在目录的ACL
+const defaultControlSocket = ""
+
+// listenControlSocket Windows不支持按属组设置套接字文件的权限，忽略 control_group
+func listenControlSocket(path string, group string) (net.Listener, error) {
+	if group != "" {
+		glog.Warningf("[CONTROL]Windows不支持 control_group，控制套接字的访问权限取决于所在目录的ACL")
+	}
+	return net.Listen("unix", path)
+}
@@ -1,13 +1,152 @@
 package main
 
 import (
-	"crypto/md5"
-	"encoding/hex"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
 )
 
-// HashMD5 计算字符串的 MD5 哈希值，返回 32 位十六进制字符串
-func HashMD5(s string) string {
-	h := md5.New()
-	h.Write([]byte(s))
-	return hex.EncodeToString(h.Sum(nil))
+// 隧道数据帧的附加认证数据：魔数 + 帧类型，保证帧类型不可被篡改
+var tunnelMagic = []byte{0x12, 0x34, 0x56, 0x78}
+
+// 加密后每个帧额外携带的字节数：8字节计数器 + 16字节GCM认证标签
+const sealOverhead = 8 + 16
+
+// 解密失败（篡改、重放、密钥不匹配）的累计次数
+var decryptFailCount uint64
+
+// SessionCipher 隧道会话加密器
+// 使用 AES-256-GCM，收发方向各自独立的密钥，nonce 由递增计数器构成并随帧发送
+type SessionCipher struct {
+	sendAead    cipher.AEAD
+	recvAead    cipher.AEAD
+	sendCounter uint64
+	replay      replayWindow
+}
+
+// NewSessionCipher 根据会话共享密钥派生双向密钥
+// secret 为双方共同持有的会话密钥材料，salt 为本次会话的随机盐
+// 方向由双方客户端ID的字典序决定，保证两端选出的收发密钥互相对应
+func NewSessionCipher(secret []byte, salt []byte, localId string, remoteId string) (*SessionCipher, error) {
+	loToHi := deriveKey(secret, salt, "natun tunnel lo->hi")
+	hiToLo := deriveKey(secret, salt, "natun tunnel hi->lo")
+	sendKey, recvKey := loToHi, hiToLo
+	if localId > remoteId {
+		sendKey, recvKey = hiToLo, loToHi
+	}
+	sendAead, err := newGCM(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recvAead, err := newGCM(recvKey)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionCipher{sendAead: sendAead, recvAead: recvAead}, nil
+}
+
+// deriveKey HKDF-SHA256 派生32字节密钥（单块输出）
+func deriveKey(secret []byte, salt []byte, info string) []byte {
+	extractor := hmac.New(sha256.New, salt)
+	extractor.Write(secret)
+	prk := extractor.Sum(nil)
+	expander := hmac.New(sha256.New, prk)
+	expander.Write([]byte(info))
+	expander.Write([]byte{0x01})
+	return expander.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal 加密一个TUN数据包，返回 [计数器8B] + [密文+认证标签]
+func (s *SessionCipher) Seal(mode byte, plain []byte) []byte {
+	counter := atomic.AddUint64(&s.sendCounter, 1)
+	out := make([]byte, 8, 8+len(plain)+s.sendAead.Overhead())
+	binary.BigEndian.PutUint64(out, counter)
+	return s.sendAead.Seal(out, buildNonce(counter), plain, frameAad(mode))
+}
+
+// Open 校验并解密一个帧，拒绝认证失败和重放的数据
+func (s *SessionCipher) Open(mode byte, sealed []byte) ([]byte, error) {
+	if len(sealed) < sealOverhead {
+		return nil, fmt.Errorf("密文长度过短: %d", len(sealed))
+	}
+	counter := binary.BigEndian.Uint64(sealed[:8])
+	if !s.replay.check(counter) {
+		return nil, fmt.Errorf("重放或过期的数据帧: counter=%d", counter)
+	}
+	plain, err := s.recvAead.Open(nil, buildNonce(counter), sealed[8:], frameAad(mode))
+	if err != nil {
+		return nil, err
+	}
+	s.replay.accept(counter)
+	return plain, nil
+}
+
+func buildNonce(counter uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+func frameAad(mode byte) []byte {
+	aad := make([]byte, 0, 5)
+	aad = append(aad, tunnelMagic...)
+	return append(aad, mode)
+}
+
+// replayWindow 64帧宽度的滑动窗口，允许UDP乱序但拒绝重复的计数器
+type replayWindow struct {
+	mu     sync.Mutex
+	latest uint64
+	bitmap uint64
+}
+
+func (w *replayWindow) check(counter uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if counter == 0 {
+		return false
+	}
+	if counter > w.latest {
+		return true
+	}
+	diff := w.latest - counter
+	if diff >= 64 {
+		return false
+	}
+	return w.bitmap&(1<<diff) == 0
+}
+
+func (w *replayWindow) accept(counter uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if counter > w.latest {
+		shift := counter - w.latest
+		if shift >= 64 {
+			w.bitmap = 0
+		} else {
+			w.bitmap <<= shift
+		}
+		w.bitmap |= 1
+		w.latest = counter
+		return
+	}
+	w.bitmap |= 1 << (w.latest - counter)
+}
+
+// countDecryptFail 记录一次解密失败并返回累计次数
+func countDecryptFail() uint64 {
+	return atomic.AddUint64(&decryptFailCount, 1)
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/venshao/natun/gin"
+)
+
+// 事件流：连接状态变化、延迟和流量以Server-Sent Events推送给Web控制台，替代轮询 /api/peerStatus
+const (
+	EventSnapshot = "snapshot" // 订阅时推送一次完整状态，数据与 /api/peerStatus 相同
+	EventState    = "state"    // 对等节点的连接状态变化
+	EventLatency  = "latency"  // 测得的往返延迟
+	EventTraffic  = "traffic"  // 对等节点的累计流量和速率，有订阅者时每秒推送一次
+)
+
+// 对等节点的连接状态
+const (
+	StateConnecting   = "connecting"
+	StatePunching     = "punching"
+	StateDirect       = "direct"
+	StateRelay        = "relay"
+	StateFailed       = "failed"
+	StateDisconnected = "disconnected"
+)
+
+const (
+	eventBufferSize       = 64
+	trafficEventInterval  = time.Second
+	eventKeepaliveTimeout = 15 * time.Second // 超过该时间没有事件时发送注释行，避免代理断开空闲连接
+)
+
+// Event 推送给订阅者的事件
+type Event struct {
+	Name string
+	Data interface{}
+}
+
+// StateEvent 对等节点的连接状态变化
+type StateEvent struct {
+	PeerId string `json:"peerId"`
+	State  string `json:"state"`
+	Reason string `json:"reason,omitempty"`
+	Time   int64  `json:"time"`
+}
+
+// LatencyEvent 一次往返延迟测量结果
+type LatencyEvent struct {
+	PeerId  string `json:"peerId"`
+	Latency int    `json:"latency"`
+	Time    int64  `json:"time"`
+}
+
+// TrafficEvent 对等节点的流量统计快照
+type TrafficEvent struct {
+	PeerId string `json:"peerId"`
+	TrafficSnapshot
+	Time int64 `json:"time"`
+}
+
+// EventHub 向事件流的订阅者广播事件，订阅者处理不及时时丢弃事件，不阻塞发布方
+type EventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+	stopTraffic chan struct{} // 停止流量采样，没有订阅者时为nil
+}
+
+var eventHub = &EventHub{subscribers: make(map[chan Event]struct{})}
+
+// Subscribe 订阅事件，第一个订阅者开始流量采样
+func (h *EventHub) Subscribe() chan Event {
+	ch := make(chan Event, eventBufferSize)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subscribers[ch] = struct{}{}
+	if h.stopTraffic == nil {
+		h.stopTraffic = make(chan struct{})
+		go h.sampleTraffic(h.stopTraffic)
+	}
+	return ch
+}
+
+// Unsubscribe 取消订阅，没有订阅者时停止流量采样
+func (h *EventHub) Unsubscribe(ch chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, ch)
+	if len(h.subscribers) == 0 && h.stopTraffic != nil {
+		close(h.stopTraffic)
+		h.stopTraffic = nil
+	}
+}
+
+// Publish 向全部订阅者发送事件
+func (h *EventHub) Publish(name string, data interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- Event{Name: name, Data: data}:
+		default:
+		}
+	}
+}
+
+// sampleTraffic 每秒推送流量统计有变化的对等节点，速率降为0时也推送一次
+func (h *EventHub) sampleTraffic(stop chan struct{}) {
+	type sample struct{ tx, rx, txRate, rxRate uint64 }
+	last := make(map[string]sample)
+	ticker := time.NewTicker(trafficEventInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		current := make(map[string]sample)
+		for _, p := range GetConnectionManager().GetPeers() {
+			snapshot := p.stats.Snapshot()
+			s := sample{snapshot.TxBytes, snapshot.RxBytes, snapshot.TxRate, snapshot.RxRate}
+			current[p.clientId] = s
+			if prev, seen := last[p.clientId]; seen && prev == s {
+				continue
+			}
+			h.Publish(EventTraffic, TrafficEvent{PeerId: p.clientId, TrafficSnapshot: snapshot, Time: time.Now().UnixMilli()})
+		}
+		last = current
+	}
+}
+
+// publishPeerState 推送对等节点的连接状态变化
+func publishPeerState(peerId string, state string, reason string) {
+	eventHub.Publish(EventState, StateEvent{PeerId: peerId, State: state, Reason: reason, Time: time.Now().UnixMilli()})
+}
+
+// modeState 连接模式对应的事件状态
+func modeState(mode ConnectionMode) string {
+	switch mode {
+	case ModeDirect:
+		return StateDirect
+	case ModeRelay:
+		return StateRelay
+	default:
+		return StateDisconnected
+	}
+}
+
+// 以Server-Sent Events推送事件，连接建立时先推送一次完整状态
+func eventsHandler(c *gin.Context) {
+	setNoCacheHeaders(c)
+	c.W.Header().Set("Content-Type", "text/event-stream")
+	c.W.Header().Set("Connection", "keep-alive")
+	// 关闭反向代理（如nginx）的响应缓冲
+	c.W.Header().Set("X-Accel-Buffering", "no")
+	c.W.WriteHeader(http.StatusOK)
+
+	ch := eventHub.Subscribe()
+	defer eventHub.Unsubscribe(ch)
+	c.SSEvent(EventSnapshot, buildPeerStatus())
+	c.Flush()
+
+	keepalive := time.NewTimer(eventKeepaliveTimeout)
+	defer keepalive.Stop()
+	done := c.R.Context().Done()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-done:
+			return false
+		case event := <-ch:
+			if err := c.SSEvent(event.Name, event.Data); err != nil {
+				return false
+			}
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return false
+			}
+		}
+		keepalive.Reset(eventKeepaliveTimeout)
+		return true
+	})
+}
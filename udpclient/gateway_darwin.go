@@ -0,0 +1,29 @@
+//go:build darwin
+// +build darwin
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// defaultGateway 从 route 命令的输出中读取IPv4默认路由的网关
+func defaultGateway() (net.IP, error) {
+	output, err := exec.Command("route", "-n", "get", "default").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, output)
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if !found || key != "gateway" {
+			continue
+		}
+		if ip := net.ParseIP(strings.TrimSpace(value)).To4(); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("没有IPv4默认路由")
+}
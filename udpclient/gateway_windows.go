@@ -0,0 +1,30 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// defaultGateway 从 route print 的输出中读取IPv4默认路由的网关
+// 表头随系统语言变化，只按 “0.0.0.0 0.0.0.0 网关 接口 跃点数” 的行格式匹配
+func defaultGateway() (net.IP, error) {
+	output, err := exec.Command("route", "print", "-4", "0.0.0.0").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, output)
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[0] != "0.0.0.0" || fields[1] != "0.0.0.0" {
+			continue
+		}
+		if ip := net.ParseIP(fields[2]).To4(); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("没有IPv4默认路由")
+}
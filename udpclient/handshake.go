@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/venshao/natun/gjson"
+	"github.com/venshao/natun/glog"
+)
+
+// 本机长期身份密钥（X25519），由配置文件中的 private_key 加载
+var (
+	staticKey     *ecdh.PrivateKey
+	staticKeyOnce sync.Once
+)
+
+// getStaticKey 获取本机长期身份密钥
+func getStaticKey() *ecdh.PrivateKey {
+	staticKeyOnce.Do(func() {
+		raw, err := base64.StdEncoding.DecodeString(GetConfig().PrivateKey)
+		if err == nil {
+			staticKey, err = ecdh.X25519().NewPrivateKey(raw)
+		}
+		if err != nil {
+			glog.Fatalf("[CRYPTO]加载身份密钥失败: %v", err)
+			panic(err)
+		}
+	})
+	return staticKey
+}
+
+// getPublicKey 获取本机身份公钥（base64）
+func getPublicKey() string {
+	return base64.StdEncoding.EncodeToString(getStaticKey().PublicKey().Bytes())
+}
+
+// getSigningKey 获取向注册中心签名消息使用的 Ed25519 私钥，由身份私钥派生
+func getSigningKey() ed25519.PrivateKey {
+	seed := deriveKey(getStaticKey().Bytes(), nil, "natun registry signing")
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+// getSigningPublicKey 获取签名公钥（base64），注册中心以此登记本机客户端ID
+func getSigningPublicKey() string {
+	return base64.StdEncoding.EncodeToString(getSigningKey().Public().(ed25519.PublicKey))
+}
+
+// generatePrivateKey 生成新的身份私钥（base64）
+func generatePrivateKey() string {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(key.Bytes())
+}
+
+// Handshake 与对等节点之间的一次密钥交换
+// 双方各自持有长期身份密钥和本次连接的临时密钥，通过四次 X25519 计算共享密钥，
+// 并以 PAKE 得到的密钥对握手消息做 MAC，证明对方知道连接密码
+// MAC 同时覆盖发送方声明的虚拟IP和递增的序号，重放的握手消息无法冒充新的心跳
+type Handshake struct {
+	peerId    string
+	psk       []byte
+	salt      []byte
+	ephemeral *ecdh.PrivateKey
+
+	mu              sync.Mutex
+	sendSeq         uint64 // 本机发出的最后一个序号
+	recvSeq         uint64 // 对方当前临时密钥下已接受的最大序号
+	remoteEphemeral []byte
+	remoteStatic    string
+}
+
+// NewHandshake 创建握手状态，psk 为与对方 PAKE 协商出的密钥，salt 为本次会话的随机盐
+func NewHandshake(peerId string, psk []byte, salt []byte) (*Handshake, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Handshake{
+		peerId:    peerId,
+		psk:       psk,
+		salt:      salt,
+		ephemeral: ephemeral,
+	}, nil
+}
+
+// Fields 构建随握手消息发送的字段，vip 和 vip6 为同一消息中声明的本机虚拟IP
+// 序号以字符串发送，注册中心转交中转握手时只复制字符串字段
+func (h *Handshake) Fields(vip string, vip6 string) map[string]interface{} {
+	spk := getStaticKey().PublicKey().Bytes()
+	epk := h.ephemeral.PublicKey().Bytes()
+	h.mu.Lock()
+	h.sendSeq++
+	seq := h.sendSeq
+	h.mu.Unlock()
+	return map[string]interface{}{
+		"spk": base64.StdEncoding.EncodeToString(spk),
+		"epk": base64.StdEncoding.EncodeToString(epk),
+		"seq": strconv.FormatUint(seq, 10),
+		"mac": base64.StdEncoding.EncodeToString(h.mac(getClientId(), spk, epk, vip, vip6, seq)),
+	}
+}
+
+// Accept 校验对方的握手消息，MAC 覆盖消息中的 vip 和 vip6，校验通过后二者可信
+// 第一次收到（或对方更换了临时密钥）时返回新派生的会话加密器，之后返回 nil；
+// fresh 表示序号大于已接受的序号，序号不大于已接受序号的是重复或重放的消息
+func (h *Handshake) Accept(remoteId string, json *gjson.Json) (sessionCipher *SessionCipher, fresh bool, err error) {
+	if remoteId != h.peerId {
+		return nil, false, fmt.Errorf("握手来自非预期的节点: %s", remoteId)
+	}
+	spk, err1 := base64.StdEncoding.DecodeString(json.GetString("spk"))
+	epk, err2 := base64.StdEncoding.DecodeString(json.GetString("epk"))
+	mac, err3 := base64.StdEncoding.DecodeString(json.GetString("mac"))
+	seq, err4 := strconv.ParseUint(json.GetString("seq"), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || len(spk) == 0 || len(epk) == 0 {
+		return nil, false, fmt.Errorf("握手字段缺失或格式错误")
+	}
+	if !hmac.Equal(mac, h.mac(remoteId, spk, epk, json.GetString("vip"), json.GetString("vip6"), seq)) {
+		return nil, false, fmt.Errorf("握手MAC校验失败，对方不知道连接密码或虚拟IP被篡改")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if bytes.Equal(epk, h.remoteEphemeral) {
+		if seq <= h.recvSeq {
+			return nil, false, nil
+		}
+		h.recvSeq = seq
+		return nil, true, nil
+	}
+	remoteStatic, err := ecdh.X25519().NewPublicKey(spk)
+	if err != nil {
+		return nil, false, err
+	}
+	remoteEphemeral, err := ecdh.X25519().NewPublicKey(epk)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := pinPeerKey(remoteId, json.GetString("spk")); err != nil {
+		return nil, false, err
+	}
+
+	secret, err := h.sharedSecret(remoteId, remoteStatic, remoteEphemeral)
+	if err != nil {
+		return nil, false, err
+	}
+	sessionCipher, err = NewSessionCipher(secret, deriveKey(h.psk, h.salt, "natun handshake psk"), getClientId(), remoteId)
+	if err != nil {
+		return nil, false, err
+	}
+	h.remoteEphemeral = epk
+	h.recvSeq = seq
+	h.remoteStatic = json.GetString("spk")
+	glog.Infof("[CRYPTO]与对等节点 %s 完成密钥交换，对方身份公钥：%s", remoteId, h.remoteStatic)
+	return sessionCipher, true, nil
+}
+
+// RemoteStatic 返回已完成握手的对方身份公钥
+func (h *Handshake) RemoteStatic() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.remoteStatic
+}
+
+// sharedSecret 计算 ee、es、se、ss 四个 DH 结果
+// es/se 按客户端ID字典序排列，保证双方拼接出相同的密钥材料
+func (h *Handshake) sharedSecret(remoteId string, remoteStatic, remoteEphemeral *ecdh.PublicKey) ([]byte, error) {
+	ee, err := h.ephemeral.ECDH(remoteEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	localStaticRemoteEphemeral, err := getStaticKey().ECDH(remoteEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	localEphemeralRemoteStatic, err := h.ephemeral.ECDH(remoteStatic)
+	if err != nil {
+		return nil, err
+	}
+	ss, err := getStaticKey().ECDH(remoteStatic)
+	if err != nil {
+		return nil, err
+	}
+	first, second := localStaticRemoteEphemeral, localEphemeralRemoteStatic
+	if getClientId() > remoteId {
+		first, second = second, first
+	}
+	secret := make([]byte, 0, 4*32)
+	secret = append(secret, ee...)
+	secret = append(secret, first...)
+	secret = append(secret, second...)
+	return append(secret, ss...), nil
+}
+
+// mac 使用 PAKE 密钥派生的密钥对 [发送方ID + 身份公钥 + 临时公钥 + 虚拟IP + IPv6虚拟地址 + 序号] 计算 MAC
+// 变长字段带长度前缀，避免不同字段组合拼接出相同的输入
+func (h *Handshake) mac(senderId string, spk []byte, epk []byte, vip string, vip6 string, seq uint64) []byte {
+	m := hmac.New(sha256.New, deriveKey(h.psk, h.salt, "natun handshake auth"))
+	for _, field := range [][]byte{[]byte(senderId), spk, epk, []byte(vip), []byte(vip6)} {
+		m.Write(binary.BigEndian.AppendUint16(nil, uint16(len(field))))
+		m.Write(field)
+	}
+	m.Write(binary.BigEndian.AppendUint64(nil, seq))
+	return m.Sum(nil)
+}
+
+// pinPeerKey 首次连接时记录对方身份公钥，之后拒绝身份公钥发生变化的同ID节点
+func pinPeerKey(peerId string, spk string) error {
+	cfg := GetConfig()
+	if known, exists := cfg.KnownPeers[peerId]; exists {
+		if known != spk {
+			return fmt.Errorf("节点 %s 的身份公钥与记录不符，如确认对方已重装，请从配置文件 known_peers 中删除该记录", peerId)
+		}
+		return nil
+	}
+	if cfg.KnownPeers == nil {
+		cfg.KnownPeers = make(map[string]string)
+	}
+	cfg.KnownPeers[peerId] = spk
+	return SaveConfig()
+}
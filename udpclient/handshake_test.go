@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/venshao/natun/gjson"
+)
+
+// useTestConfig 使用临时配置文件，握手固定对方身份公钥时会回写配置
+func useTestConfig(t *testing.T) {
+	t.Helper()
+	oldConfig, oldFile := config, configFile
+	config = createDefaultConfig()
+	configFile = filepath.Join(t.TempDir(), "config.json")
+	t.Cleanup(func() {
+		config, configFile = oldConfig, oldFile
+	})
+}
+
+// newTestHandshakes 创建使用相同 PAKE 密钥的发送方和接收方握手状态
+// 测试进程只有一个身份，双方的客户端ID和身份密钥相同
+func newTestHandshakes(t *testing.T) (*Handshake, *Handshake) {
+	t.Helper()
+	psk, salt := []byte("pake key"), []byte("salt")
+	sender, err := NewHandshake(getClientId(), psk, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := NewHandshake(getClientId(), psk, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender, receiver
+}
+
+func beatMessage(hs *Handshake, vip string, vip6 string) map[string]interface{} {
+	data := map[string]interface{}{"vip": vip, "vip6": vip6}
+	for k, v := range hs.Fields(vip, vip6) {
+		data[k] = v
+	}
+	return data
+}
+
+// TestHandshakeMacCoversVip 篡改握手消息中的虚拟IP后MAC校验失败
+func TestHandshakeMacCoversVip(t *testing.T) {
+	useTestConfig(t)
+	sender, receiver := newTestHandshakes(t)
+
+	for _, field := range []string{"vip", "vip6", "seq"} {
+		msg := beatMessage(sender, "10.10.10.3", "fd12:3456:789a::a0a:a03")
+		msg[field] = "1"
+		if _, _, err := receiver.Accept(getClientId(), gjson.New(msg)); err == nil {
+			t.Fatalf("篡改 %s 后握手仍被接受", field)
+		}
+	}
+	sessionCipher, fresh, err := receiver.Accept(getClientId(), gjson.New(beatMessage(sender, "10.10.10.3", "")))
+	if err != nil || sessionCipher == nil || !fresh {
+		t.Fatalf("Accept = %v %v %v, want cipher true nil", sessionCipher, fresh, err)
+	}
+}
+
+// TestHandshakeRejectsReplayedSeq 同一临时密钥下序号不大于已接受序号的消息不是新消息
+func TestHandshakeRejectsReplayedSeq(t *testing.T) {
+	useTestConfig(t)
+	sender, receiver := newTestHandshakes(t)
+
+	first := gjson.New(beatMessage(sender, "10.10.10.3", ""))
+	second := gjson.New(beatMessage(sender, "10.10.10.3", ""))
+	if _, fresh, err := receiver.Accept(getClientId(), second); err != nil || !fresh {
+		t.Fatalf("Accept = %v %v, want true nil", fresh, err)
+	}
+	for _, replayed := range []*gjson.Json{first, second} {
+		sessionCipher, fresh, err := receiver.Accept(getClientId(), replayed)
+		if err != nil || fresh || sessionCipher != nil {
+			t.Fatalf("重放的消息 Accept = %v %v %v, want nil false nil", sessionCipher, fresh, err)
+		}
+	}
+	if _, fresh, err := receiver.Accept(getClientId(), gjson.New(beatMessage(sender, "10.10.10.3", ""))); err != nil || !fresh {
+		t.Fatalf("新序号的消息 Accept = %v %v, want true nil", fresh, err)
+	}
+}
+
+// TestReplayedBeatOnlyFromBoundAddr 重放的心跳只接受来自已绑定地址的，中转通知不受限制
+func TestReplayedBeatOnlyFromBoundAddr(t *testing.T) {
+	useTestConfig(t)
+	sender, receiver := newTestHandshakes(t)
+	cm := newTestConnectionManager()
+	p := cm.AddPeer(getClientId())
+	p.SetHandshake(receiver)
+	bound := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 4000}
+	other := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 9), Port: 5000}
+
+	beat := gjson.New(beatMessage(sender, "10.10.10.3", ""))
+	if !acceptPeerHandshake(p, beat, bound) {
+		t.Fatal("首次心跳被拒绝")
+	}
+	if _, err := cm.MarkAlive(p, "10.10.10.3", "", bound); err != nil {
+		t.Fatalf("MarkAlive: %v", err)
+	}
+	if acceptPeerHandshake(p, beat, other) {
+		t.Fatal("来自其他地址的重放心跳被接受")
+	}
+	if !acceptPeerHandshake(p, beat, bound) {
+		t.Fatal("来自已绑定地址的重复心跳被拒绝")
+	}
+	if !acceptPeerHandshake(p, beat, nil) {
+		t.Fatal("注册中心转交的重复握手被拒绝")
+	}
+	if !acceptPeerHandshake(p, gjson.New(beatMessage(sender, "10.10.10.3", "")), other) {
+		t.Fatal("来自新地址的新心跳被拒绝")
+	}
+}
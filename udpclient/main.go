@@ -2,37 +2,23 @@ package main
 
 import (
 	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"math/rand"
 	"net"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
+	"syscall"
 	"time"
-	"unsafe"
 
 	"github.com/venshao/natun/gjson"
 	"github.com/venshao/natun/glog"
 )
 
-type Peer struct {
-	clientId                    string
-	peerAddr                    *net.UDPAddr
-	peerVirtualIp               string
-	peerAlive                   bool
-	latency                     int
-	cancelBeatAndTunReadRoutine *context.CancelFunc
-}
-
-var peer *Peer = &Peer{
-	clientId:                    "",
-	peerAddr:                    nil,
-	peerAlive:                   false,
-	peerVirtualIp:               "",
-	latency:                     -1,
-	cancelBeatAndTunReadRoutine: nil,
-}
-
 // 从配置中获取客户端ID和密码
 func getClientId() string {
 	return GetConfig().ClientID
@@ -57,9 +43,12 @@ var myPubNetPort int = 0
 // TUN设备
 var tun NetDevice = nil
 
-// 第一次收到对方请求需要加锁避免重复开启心跳协程
+// TUN设备由所有对等节点共用，创建和关闭需要加锁避免重复开启读取协程
 var mu sync.Mutex
 
+// 取消TUN设备数据读取的协程
+var cancelTunReadRoutine *context.CancelFunc
+
 // 通用JSON发送方法（使用gjson序列化）
 func call(conn *net.UDPConn, addr *net.UDPAddr, path string, data interface{}) error {
 	// 序列化数据
@@ -92,16 +81,17 @@ func call(conn *net.UDPConn, addr *net.UDPAddr, path string, data interface{}) e
 }
 
 // 向对等节点发送心跳 防止连接断开
-func beatPeer(conn *net.UDPConn, addr *net.UDPAddr) {
-	err := call(conn, addr, "beat", map[string]interface{}{
+func beatPeer(conn *net.UDPConn, p *Peer, addr *net.UDPAddr) {
+	err := call(conn, addr, "beat", withHandshake(p, map[string]interface{}{
 		// usePort 代表向对等节点打洞使用的目的端口，目的是为了在打洞成功后知道是用的哪个目的端口打洞成功，方便后续基于此端口进行通讯
 		"usePort": addr.Port,
 		"vip":     getTunIP(),
+		"vip6":    getTunIP6(),
 		"c":       rand.Intn(100000),
 		"t":       -1, // 不再在心跳中包含时间戳
 		"a":       rand.Intn(100000),
 		"id":      getClientId(),
-	})
+	}))
 	if err != nil {
 		glog.Errorf("[INNER]向对等节点发送心跳失败：%v", err)
 	} else {
@@ -109,10 +99,114 @@ func beatPeer(conn *net.UDPConn, addr *net.UDPAddr) {
 	}
 }
 
+// withHandshake 在消息中附带本机与该对等节点的握手字段（身份公钥、临时公钥、序号、MAC）
+// MAC 覆盖消息中的 vip 和 vip6，二者必须在调用前放入 data
+func withHandshake(p *Peer, data map[string]interface{}) map[string]interface{} {
+	hs := p.GetHandshake()
+	if hs == nil {
+		return data
+	}
+	vip, _ := data["vip"].(string)
+	vip6, _ := data["vip6"].(string)
+	for k, v := range hs.Fields(vip, vip6) {
+		data[k] = v
+	}
+	return data
+}
+
+// acceptPeerHandshake 校验对等节点的握手消息，首次成功时安装会话加密器
+// addr 为直连心跳的来源地址，重复或重放的心跳只接受来自已绑定地址的，避免被他人重放后改绑地址；
+// 中转通知由注册中心转交（addr 为 nil），重复的握手字段是对方之前登记的，照常接受
+func acceptPeerHandshake(p *Peer, json *gjson.Json, addr *net.UDPAddr) bool {
+	hs := p.GetHandshake()
+	if hs == nil {
+		glog.Warningf("[CRYPTO]尚未完成与 %s 的密码认证，忽略其握手消息", p.clientId)
+		return false
+	}
+	sessionCipher, fresh, err := hs.Accept(p.clientId, json)
+	if err != nil {
+		glog.Warningf("[CRYPTO]与 %s 的握手校验失败：%v", p.clientId, err)
+		return false
+	}
+	if !fresh && addr != nil {
+		if peerAddr := p.GetAddr(); peerAddr == nil || peerAddr.String() != addr.String() {
+			glog.Warningf("[CRYPTO]丢弃来自 %s 的重复心跳，对等节点 %s 未绑定该地址", addr.String(), p.clientId)
+			return false
+		}
+	}
+	if sessionCipher != nil {
+		p.SetCipher(sessionCipher)
+		confirmIncomingAttempt(p.clientId)
+	}
+	return true
+}
+
 func pongHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.Json) {
 	glog.Debug("[INNER]收到注册中心的pong")
 	myPubNetIp = json.GetString("clientIp")
 	myPubNetPort = json.GetInt("clientPort")
+	netWatcher.OnPong(conn, net.JoinHostPort(myPubNetIp, strconv.Itoa(myPubNetPort)))
+	natDetector.OnPong(conn, json.GetInt("probePort"))
+	if vip := json.GetString("vip"); vip != "" {
+		applyAssignedTunIP(vip, json.GetString("subnet"), json.GetString("subnet6"), json.GetBool("vipConflict"))
+	}
+	reportVipError(json.GetString("vipError"))
+}
+
+// 最近一次注册中心拒绝分配虚拟IP的原因，同一原因只记录一次日志
+var lastVipError string
+
+// reportVipError 记录注册中心拒绝分配虚拟IP的原因，如本机配置的网段超出服务器允许的大小
+func reportVipError(message string) {
+	if message == lastVipError {
+		return
+	}
+	lastVipError = message
+	if message != "" {
+		glog.Errorf("[IPAM]注册中心拒绝分配虚拟IP：%s，请检查配置的 subnet", message)
+	}
+}
+
+// applyAssignedTunIP 应用注册中心分配的虚拟IP和网段，CreateTun 创建TUN设备时使用该地址
+// 同一网络的客户端必须使用相同的网段，本机配置与注册中心地址池不一致时以注册中心为准
+// 本机未启用IPv6（subnet6 配置为空）时不采用注册中心的IPv6虚拟网段
+func applyAssignedTunIP(vip string, subnet string, subnet6 string, conflict bool) {
+	cfg := GetConfig()
+	subnetChanged := false
+	if subnet != "" && subnet != cfg.Subnet {
+		if _, err := parseSubnet(subnet); err != nil {
+			glog.Errorf("[IPAM]注册中心下发的%v，忽略", err)
+			return
+		}
+		glog.Warningf("[IPAM]网络 %s 的虚拟网段为 %s，与本机配置的 %s 不一致，以注册中心为准", cfg.Network, subnet, cfg.Subnet)
+		cfg.Subnet = subnet
+		subnetChanged = true
+	}
+	if subnet6 != "" && cfg.Subnet6 != "" && subnet6 != cfg.Subnet6 {
+		if _, err := parseSubnet6(subnet6); err != nil {
+			glog.Errorf("[IPAM]注册中心下发的%v，忽略", err)
+		} else {
+			glog.Warningf("[IPAM]网络 %s 的IPv6虚拟网段为 %s，与本机配置的 %s 不一致，以注册中心为准", cfg.Network, subnet6, cfg.Subnet6)
+			cfg.Subnet6 = subnet6
+			subnetChanged = true
+		}
+	}
+	if cfg.TunIP != vip {
+		if conflict {
+			glog.Warningf("[IPAM]本机虚拟IP %s 已被其他客户端占用，注册中心重新分配为 %s", cfg.TunIP, vip)
+		} else {
+			glog.Infof("[IPAM]注册中心分配的虚拟IP为 %s", vip)
+		}
+		cfg.TunIP = vip
+	} else if !subnetChanged {
+		return
+	}
+	if err := SaveConfig(); err != nil {
+		glog.Errorf("[IPAM]保存虚拟IP失败：%v", err)
+	}
+	if tun != nil {
+		glog.Warning("[IPAM]TUN设备仍在使用原虚拟IP和网段，断开全部连接后重新连接生效")
+	}
 }
 
 func beatHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.Json) {
@@ -122,94 +216,208 @@ func beatHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.
 		glog.Debug("[INNER]收到自己的打洞报文,丢弃!!!")
 		return
 	}
-	usePort := json.GetInt("usePort")
-	peer.peerAlive = true
-
-	// 设置直连模式
 	cm := GetConnectionManager()
-	cm.SetMode(ModeDirect)
-	cm.SetConnecting(false, "连接成功")
+	p := cm.GetPeer(id)
+	if p == nil {
+		glog.Warningf("[INNER]收到未建立连接的节点 %s 的心跳，忽略", id)
+		return
+	}
+	// 心跳同时承载密钥交换，校验失败说明对方不知道连接密码或身份不符
+	if !acceptPeerHandshake(p, json, addr) {
+		return
+	}
+	usePort := json.GetInt("usePort")
+	first, err := cm.MarkAlive(p, json.GetString("vip"), json.GetString("vip6"), addr)
+	if err != nil {
+		rejectVipConflict(p, err)
+		return
+	}
+	p.TouchDirect()
+	// 之后经收到心跳的套接字向对方发送，生日攻击打洞时打通的可能是额外打开的套接字
+	if peerAddr := p.GetAddr(); peerAddr != nil && peerAddr.String() == addr.String() {
+		p.SetConn(conn)
+	}
 
-	// 启动直连模式延迟测试（防止重复启动）
-	if peer.cancelBeatAndTunReadRoutine == nil {
-		go startDirectLatencyTest(conn)
+	// 设置直连模式，中转模式下收到对方的心跳说明重新打洞成功，直接切换为直连，TUN读取协程和会话密钥保持不变
+	if p.IsRelayMode() {
+		p.SetMode(ModeDirect, "重新打洞成功，从中转升级为直连")
+	} else {
+		p.SetMode(ModeDirect, "打洞成功")
 	}
 
 	glog.Debugf("[INNER]收到对等节点%s的心跳,猜测到的我方port=%d", addr.String(), usePort)
 	responseBeatAck(conn, addr, json)
-	// 第一次收到对方请求
-	if peer.peerAddr == nil {
-		mu.Lock()
-		defer mu.Unlock()
-		if peer.peerAddr == nil {
-			atomic.StorePointer(
-				(*unsafe.Pointer)(unsafe.Pointer(&peer.peerAddr)),
-				unsafe.Pointer(addr),
-			)
-			peer.peerVirtualIp = json.GetString("vip")
-			glog.Debugf("[INNER]peerVirtualIp is %s", peer.peerVirtualIp)
-			ctx, cancel := context.WithCancel(context.Background())
-			peer.cancelBeatAndTunReadRoutine = &cancel
-			// 仅第一次收到心跳时才启动协程进行定时心跳
-			go func(ctx context.Context) {
-				lastBeatTime := time.Now().Unix()
-				for {
-					select {
-					case <-ctx.Done():
-						glog.Debugf("[INNER]向对等节点发心跳的协程退出")
-						return
-					default:
-						if time.Now().Unix()-lastBeatTime < 5 {
-							time.Sleep(time.Millisecond * 1)
-							continue
-						}
-						lastBeatTime = time.Now().Unix()
-						if peer.peerAddr != nil {
-							beatPeer(conn, peer.peerAddr)
-						}
+	// 第一次收到对方心跳，启动TUN设备和向该节点定时发心跳的协程
+	if first {
+		cm.SetConnecting(false, "连接成功")
+		glog.Debugf("[INNER]对等节点 %s 的虚拟IP为 %s", id, p.GetVirtualIp())
+		startTunRoutine()
+		startPeerRoutine(p)
+	}
+}
+
+func NewTunDevice() {
+	if tun == nil {
+		tun = CreateTun()
+	}
+}
+
+// startTunRoutine 创建TUN设备并启动读取协程，TUN设备由所有对等节点共用，只启动一次
+func startTunRoutine() {
+	mu.Lock()
+	defer mu.Unlock()
+	if cancelTunReadRoutine != nil {
+		return
+	}
+	NewTunDevice()
+	device := tun
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelTunReadRoutine = &cancel
+	// 启动隧道处理, 从TUN读取并按目的虚拟IP发送到对应对等节点的隧道中
+	go func(ctx context.Context) {
+		packet := make([]byte, 65536)
+		for {
+			select {
+			case <-ctx.Done():
+				glog.Debugf("[TUN]TUN读取协程退出")
+				return
+			default:
+				n, err := device.Read(packet)
+				if err != nil {
+					errStr := fmt.Sprintf("%v", err)
+					if strings.Contains(errStr, "No more data is available") {
+						time.Sleep(time.Nanosecond * 1)
+					} else {
+						glog.Errorf("[TUN]从TUN设备读取失败：%v", err)
 					}
+					continue
 				}
-			}(ctx)
-			NewTunDevice()
-			// 启动隧道处理, 从TUN读取并发送到隧道中
-			go func(ctx context.Context) {
-				packet := make([]byte, 65536)
-				for {
-					select {
-					case <-ctx.Done():
-						glog.Debugf("[TUN]TUN读取协程退出")
-						return
-					default:
-						n, err := tun.Read(packet)
-						if err != nil {
-							errStr := fmt.Sprintf("%v", err)
-							if strings.Contains(errStr, "No more data is available") {
-								time.Sleep(time.Nanosecond * 1)
-							} else {
-								glog.Errorf("[TUN]从TUN设备读取失败：%v", err)
-							}
-							continue
-						}
-
-						// 解析IP包并输出调试信息
-						if n >= 20 {
-							parseAndLogIPPacket(packet[:n], "TUN_READ")
-						} else {
-							glog.Debugf("[TUN_READ]从TUN设备读出数据%d字节", n)
-						}
-
-						sendToTunnel(conn, packet, n)
-					}
+
+				// 解析IP包并输出调试信息
+				if n >= 20 {
+					parseAndLogIPPacket(packet[:n], "TUN_READ")
+				} else {
+					glog.Debugf("[TUN_READ]从TUN设备读出数据%d字节", n)
 				}
-			}(ctx)
+
+				sendToTunnel(natConnection.listen, packet, n)
+			}
 		}
+	}(ctx)
+	glog.Infof("[TUN]已初始化TUN设备并启动数据读取协程")
+}
+
+// stopTunRoutineIfIdle 没有任何对等节点时关闭TUN设备及其读取协程
+func stopTunRoutineIfIdle() {
+	mu.Lock()
+	defer mu.Unlock()
+	if len(GetConnectionManager().GetPeers()) > 0 {
+		return
+	}
+	if cancelTunReadRoutine != nil {
+		(*cancelTunReadRoutine)()
+		cancelTunReadRoutine = nil
+		glog.Debug("[TUN]已关闭TUN设备读取协程")
+	}
+	if tun != nil {
+		err := tun.Close()
+		if err != nil {
+			glog.Errorf("[TUN]关闭TUN设备失败：%v", err)
+		}
+		tun = nil
+		glog.Debug("[TUN]已关闭TUN设备")
 	}
 }
 
-func NewTunDevice() {
-	if tun == nil {
-		tun = CreateTun()
+// startPeerRoutine 启动向对等节点定时发心跳和测试往返延迟的协程
+// 直连模式下每5秒发送一次心跳防止NAT映射失效，每15秒按当前模式测试一次延迟
+func startPeerRoutine(p *Peer) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.mu.Lock()
+	if p.cancelRoutine != nil {
+		p.mu.Unlock()
+		cancel()
+		return
 	}
+	p.cancelRoutine = &cancel
+	p.mu.Unlock()
+
+	go func(ctx context.Context) {
+		beatTicker := time.NewTicker(5 * time.Second)
+		defer beatTicker.Stop()
+		// 连通2秒后发送第一个延迟测试包
+		latencyTimer := time.NewTimer(2 * time.Second)
+		defer latencyTimer.Stop()
+		// 中转模式下定期请求注册中心让双方重新打洞，网络变化后可能出现直连路径
+		var repunchC <-chan time.Time
+		if interval := GetConfig().PunchHole.RepunchInterval; interval > 0 {
+			repunchTicker := time.NewTicker(time.Duration(interval) * time.Second)
+			defer repunchTicker.Stop()
+			repunchC = repunchTicker.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				glog.Debugf("[INNER]向对等节点 %s 发心跳的协程退出", p.clientId)
+				return
+			case <-beatTicker.C:
+				if !p.IsDirectMode() {
+					break
+				}
+				// 直连路径失效（如NAT映射过期、网络切换）后对方的心跳和心跳Ack都收不到了
+				if timeout := time.Duration(GetConfig().PunchHole.DirectTimeout) * time.Second; p.DirectIdle() > timeout {
+					fallbackToRelay(p, fmt.Sprintf("直连超过%d秒未收到对方报文", int(timeout/time.Second)))
+					break
+				}
+				if addr := p.GetAddr(); addr != nil {
+					beatPeer(p.GetConn(), p, addr)
+				}
+			case <-latencyTimer.C:
+				latencyTimer.Reset(15 * time.Second)
+				switch p.GetMode() {
+				case ModeDirect:
+					sendDirectLatencyTest(p.GetConn(), p)
+				case ModeRelay:
+					sendRelayLatencyTest(natConnection.listen, p)
+				}
+			case <-repunchC:
+				if p.IsRelayMode() {
+					glog.Debugf("[NAT]与 %s 处于中转模式，请求注册中心重新打洞", p.clientId)
+					callServer(natConnection.listen, "repunch", map[string]interface{}{
+						"targetId": p.clientId,
+					})
+				}
+			}
+		}
+	}(ctx)
+}
+
+// closePeer 断开与对等节点的连接并将其移出对等节点表
+func closePeer(p *Peer) {
+	p.SetMode(ModeDisconnected, "连接已断开")
+	publishPeerState(p.clientId, StateDisconnected, "")
+	p.mu.Lock()
+	cancel := p.cancelRoutine
+	p.cancelRoutine = nil
+	p.peerAlive = false
+	p.latency = -1
+	p.pake = nil
+	p.handshake = nil
+	p.cipher = nil
+	conn := p.conn
+	p.conn = nil
+	p.mu.Unlock()
+	if cancel != nil {
+		// 取消向对等节点发心跳的协程
+		(*cancel)()
+	}
+	if conn != nil {
+		// 关闭打洞时为该节点额外打开的套接字
+		conn.Close()
+	}
+	GetConnectionManager().RemovePeer(p)
+	glog.Infof("[INNER]已断开与对等节点 %s 的连接", p.clientId)
+	stopTunRoutineIfIdle()
 }
 
 func responseBeatAck(conn *net.UDPConn, addr *net.UDPAddr, json *gjson.Json) {
@@ -226,282 +434,350 @@ func responseBeatAck(conn *net.UDPConn, addr *net.UDPAddr, json *gjson.Json) {
 
 // beatAckHandler 处理对等节点发来的心跳ack，目的是计算往返延迟
 func beatAckHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.Json) {
-	t := json.GetInt64("t")
-	peer.latency = int(time.Now().UnixMilli() - t)
-	glog.Debugf("[INNER]收到心跳Ack,计算往返延迟=%dms", peer.latency)
+	p := GetConnectionManager().PeerByAddr(addr)
+	if p == nil {
+		glog.Warningf("[INNER]收到未知地址 %s 的心跳Ack，忽略", addr.String())
+		return
+	}
+	p.TouchDirect()
+	latency := int(time.Now().UnixMilli() - json.GetInt64("t"))
+	p.SetLatency(latency)
+	glog.Debugf("[INNER]收到 %s 的心跳Ack,计算往返延迟=%dms", p.clientId, latency)
 }
 
 // relayEnabledHandler 处理服务器中转模式开启成功的通知
 func relayEnabledHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.Json) {
-	// 检查是否为中转模式
-	cm := GetConnectionManager()
-	if !cm.IsRelayMode() {
-		glog.Warning("[INNER]收到中转模式开启通知但当前不是中转模式，忽略")
-		return
-	}
-
 	peerId := json.GetString("peerId")
 	if peerId == "" {
 		glog.Warning("[INNER]收到中转模式开启通知但peerId为空")
 		return
 	}
 
-	// 获取对等节点的虚拟IP
-	peerVip := json.GetString("vip")
-	if peerVip != "" {
-		peer.peerVirtualIp = peerVip
-		glog.Debugf("[INNER]中转模式：设置对等节点虚拟IP为 %s", peerVip)
+	// 检查与该节点是否为中转模式
+	cm := GetConnectionManager()
+	p := cm.GetPeer(peerId)
+	if p == nil || !p.IsRelayMode() {
+		glog.Warningf("[INNER]收到中转模式开启通知但与 %s 不是中转模式，忽略", peerId)
+		return
+	}
+	// 中转模式下没有直连心跳，握手消息由服务器随通知一并转交
+	if !acceptPeerHandshake(p, json, nil) {
+		return
 	}
 
+	// 获取对等节点的虚拟IP，并设置对等节点存活状态；注册中心转交的是对方的租约地址
+	peerVip := json.GetString("vip")
+	p.SetLeasedVip(peerVip)
+	first, err := cm.MarkAlive(p, peerVip, json.GetString("vip6"), nil)
+	if err != nil {
+		rejectVipConflict(p, err)
+		return
+	}
 	glog.Infof("[INNER]中转模式已开启，对等节点：%s，虚拟IP：%s", peerId, peerVip)
 
-	// 设置对等节点存活状态
-	peer.peerAlive = true
-
-	// 设置连接成功状态
-	cm.SetConnecting(false, "连接成功")
-
-	// 启动中转模式延迟测试（防止重复启动）
-	if peer.cancelBeatAndTunReadRoutine == nil {
-		go startRelayLatencyTest(conn)
-	}
-
-	// 第一次收到中转模式开启通知，初始化TUN设备和数据读取
-	if peer.cancelBeatAndTunReadRoutine == nil {
-		mu.Lock()
-		defer mu.Unlock()
-		if peer.cancelBeatAndTunReadRoutine == nil {
-			ctx, cancel := context.WithCancel(context.Background())
-			peer.cancelBeatAndTunReadRoutine = &cancel
-
-			// 初始化TUN设备
-			NewTunDevice()
-
-			// 启动隧道处理, 从TUN读取并发送到隧道中
-			go func(ctx context.Context) {
-				packet := make([]byte, 65536)
-				for {
-					select {
-					case <-ctx.Done():
-						glog.Debugf("[TUN]TUN读取协程退出")
-						return
-					default:
-						n, err := tun.Read(packet)
-						if err != nil {
-							errStr := fmt.Sprintf("%v", err)
-							if strings.Contains(errStr, "No more data is available") {
-								time.Sleep(time.Nanosecond * 1)
-							} else {
-								glog.Errorf("[TUN]从TUN设备读取失败：%v", err)
-							}
-							continue
-						}
-
-						// 解析IP包并输出调试信息
-						if n >= 20 {
-							parseAndLogIPPacket(packet[:n], "TUN_READ")
-						} else {
-							glog.Debugf("[TUN_READ]从TUN设备读出数据%d字节", n)
-						}
-
-						sendToTunnel(conn, packet, n)
-					}
-				}
-			}(ctx)
-
-			glog.Infof("[INNER]中转模式：已初始化TUN设备并启动数据读取协程")
-		}
+	// 第一次收到中转模式开启通知，初始化TUN设备和延迟测试
+	if first {
+		cm.SetConnecting(false, "连接成功")
+		startTunRoutine()
+		startPeerRoutine(p)
 	}
 }
 
 // requestConnectPeer 向对等节点发起连接
-func requestConnectPeer(targetClientId string, password string) {
-	// 先执行changePort
-	natConnection.changePort(getRandPort())
-	time.Sleep(time.Millisecond * 100)
+func requestConnectPeer(targetClientId string, password string) error {
+	cm := GetConnectionManager()
+	if existing := cm.GetPeer(targetClientId); existing != nil {
+		if existing.IsAlive() {
+			return fmt.Errorf("已与 %s 建立连接", targetClientId)
+		}
+		// 上一次尚未完成的连接作废
+		closePeer(existing)
+	}
+	// 生成本次会话的随机盐，并以对方密码发起PAKE，密码及其哈希都不会发送出去
+	salt := make([]byte, 16)
+	if _, err := cryptorand.Read(salt); err != nil {
+		glog.Errorf("[CRYPTO]生成会话盐失败：%v", err)
+		return err
+	}
+	pake, err := NewPake(true, getClientId(), targetClientId, password, salt)
+	if err != nil {
+		glog.Errorf("[CRYPTO]创建PAKE状态失败：%v", err)
+		return err
+	}
+	p := cm.AddPeer(targetClientId)
+	if p == nil {
+		return fmt.Errorf("正在与 %s 建立连接", targetClientId)
+	}
+	p.SetPake(pake)
+	// 先执行changePort，已有连通的对等节点时保持当前端口，否则已有的直连会全部失效
+	if cm.AlivePeerCount() == 0 {
+		natConnection.changePort(getRandPort())
+		time.Sleep(time.Millisecond * 100)
+	}
 	// 让服务器通知对方也执行changePort
-	err := call(natConnection.listen, serverAddr, "notifyChangePort", map[string]interface{}{
+	err = callServer(natConnection.listen, "notifyChangePort", map[string]interface{}{
 		"srcId":    getClientId(),
 		"targetId": targetClientId,
-		"tp":       HashMD5(password),
+		"s":        hex.EncodeToString(salt),
+		"pa":       pake.Message(),
 	})
 	if err != nil {
 		glog.Errorf("[INNER]向服务器发送changePort失败：%v", err)
-		return
+		closePeer(p)
+		return err
 	}
+	cm.SetCredential(targetClientId, password)
 	glog.Debug("[INNER]已向服务器申请通知对等节点更换端口")
+	return nil
+}
+
+// 注册中心通知断开的原因为对方主动断开，其余原因（下线 offline、公网地址改变 addrChanged）会自动重连
+const disconnectClosed = "closed"
+
+// requestDisconnectPeer 主动断开与对等节点的连接，由注册中心通知对方断开并清除中转会话
+func requestDisconnectPeer(targetClientId string) error {
+	cm := GetConnectionManager()
+	p := cm.GetPeer(targetClientId)
+	if p == nil {
+		return fmt.Errorf("未与 %s 建立连接", targetClientId)
+	}
+	// 注册中心不可达时对方会在心跳超时后自行断开，本机照常断开
+	if err := callServer(natConnection.listen, "disconnect", map[string]interface{}{
+		"targetId": targetClientId,
+	}); err != nil {
+		glog.Warningf("[INNER]通知注册中心断开与 %s 的连接失败：%v", targetClientId, err)
+	}
+	closePeer(p)
+	if cm.AlivePeerCount() == 0 {
+		cm.SetConnecting(false, "连接已断开")
+	}
+	return nil
+}
+
+// rejectVipConflict 对等节点声明的虚拟IP已属于其他对等节点，断开与其的连接且不自动重连，
+// 避免对等节点冒用他人的虚拟IP截取本机发往该地址的数据
+func rejectVipConflict(p *Peer, err error) {
+	glog.Errorf("[CONNECTION]对等节点 %s 声明的虚拟IP冲突：%v，断开连接", p.clientId, err)
+	publishPeerState(p.clientId, StateFailed, "虚拟IP冲突")
+	reconnector.Cancel(p.clientId)
+	requestDisconnectPeer(p.clientId)
+}
+
+// requestReconnectPeer 断开与对等节点的连接，并使用最近一次主动连接时的密码重新连接
+func requestReconnectPeer(targetClientId string) error {
+	cm := GetConnectionManager()
+	password, ok := cm.GetCredential(targetClientId)
+	if !ok {
+		return fmt.Errorf("本机没有主动连接过 %s，请输入密码连接", targetClientId)
+	}
+	if cm.GetPeer(targetClientId) != nil {
+		requestDisconnectPeer(targetClientId)
+	}
+	return requestConnectPeer(targetClientId, password)
 }
 
 func changePortHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.Json) {
-	// 如果当前已经有对等节点，则拒绝
-	if peer.peerAlive {
-		glog.Warningf("[INNER]拒绝changePort请求，当前已有对等节点")
+	srcId := json.GetString("srcId")
+	salt, err := hex.DecodeString(json.GetString("s"))
+	if srcId == "" || len(salt) == 0 || err != nil {
+		glog.Warningf("[CRYPTO]changePort请求缺少会话参数，拒绝连接")
+		return
+	}
+	// 如果已经与该节点连通，则拒绝
+	cm := GetConnectionManager()
+	if existing := cm.GetPeer(srcId); existing != nil && existing.IsAlive() {
+		glog.Warningf("[INNER]拒绝changePort请求，已与 %s 建立连接", srcId)
+		return
+	}
+	// 失败次数过多的来源直接拒绝，不再给出PAKE回复
+	srcAddr := json.GetString("srcAddr")
+	if !allowIncomingAttempt(srcId, srcAddr) {
+		return
+	}
+	// 以本机密码响应对方的PAKE消息，密码是否一致由双方的确认值和握手MAC验证
+	pake, err := NewPake(false, getClientId(), srcId, getClientPassword(), salt)
+	if err != nil {
+		glog.Errorf("[CRYPTO]创建PAKE状态失败：%v", err)
+		return
+	}
+	result, err := pake.Finish(json.GetString("pa"))
+	if err != nil {
+		glog.Warningf("[CRYPTO]changePort请求的PAKE消息无效，拒绝连接：%v", err)
 		return
 	}
-	password := json.GetString("p")
-	if password != HashMD5(getClientPassword()) {
-		glog.Warningf("[INNER]changePort请求密码错误，拒绝连接")
+	hs, err := NewHandshake(srcId, result.Key, salt)
+	if err != nil {
+		glog.Errorf("[CRYPTO]创建握手状态失败：%v", err)
+		return
+	}
+	if existing := cm.GetPeer(srcId); existing != nil {
+		closePeer(existing)
+	}
+	p := cm.AddPeer(srcId)
+	if p == nil {
 		return
 	}
-	natConnection.changePort(getRandPort())
-	time.Sleep(time.Millisecond * 100)
-	err := call(natConnection.listen, serverAddr, "portChanged", map[string]interface{}{
+	p.SetHandshake(hs)
+	beginIncomingAttempt(srcId, srcAddr)
+	if cm.AlivePeerCount() == 0 {
+		natConnection.changePort(getRandPort())
+		time.Sleep(time.Millisecond * 100)
+	}
+	err = callServer(natConnection.listen, "portChanged", map[string]interface{}{
 		"clientId": getClientId(),
+		"srcId":    srcId,
+		"pb":       pake.Message(),
+		"cb":       result.Confirmation(),
 	})
 	if err != nil {
 		glog.Errorf("[INNER]向服务器发送端口已变更的回调失败：%v", err)
 	}
 }
 
+// connectRejectedHandler 注册中心因尝试过于频繁拒绝了本机发起的连接
+func connectRejectedHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.Json) {
+	retryAfter := json.GetInt("retryAfter")
+	glog.Warningf("[AUTH]注册中心拒绝连接请求：%s，%d秒后可重试", json.GetString("reason"), retryAfter)
+	if p := GetConnectionManager().GetPeer(json.GetString("targetId")); p != nil && !p.IsAlive() {
+		closePeer(p)
+	}
+	GetConnectionManager().SetConnectFailed(true, fmt.Sprintf("连接失败：尝试过于频繁，请%d秒后重试", retryAfter))
+	publishPeerState(json.GetString("targetId"), StateFailed, "尝试过于频繁")
+}
+
 /**
  * 这个方法由注册中心调用，需要连接的双方会同时执行此方法向对方发起连接
  */
 func connectPeerHandler(conn *net.UDPConn, _ *net.UDPAddr, _ string, json *gjson.Json) {
-	// 解析基础端口信息
-	basePort := json.GetInt("port")
-	peer.clientId = json.GetString("clientId")
-	ip := net.IPv4(
-		byte(json.GetInt8("ip0")),
-		byte(json.GetInt8("ip1")),
-		byte(json.GetInt8("ip2")),
-		byte(json.GetInt8("ip3")),
-	)
-	if ip.String() == "0.0.0.0" {
-		glog.Errorf("[INNER]收到注册中心命令：连接对等节点，但对等IP为0.0.0.0，放弃")
+	peerId := json.GetString("clientId")
+	cm := GetConnectionManager()
+	p := cm.GetPeer(peerId)
+	if p == nil {
+		glog.Warningf("[INNER]收到注册中心命令：连接对等节点 %s，但本机没有对应的连接请求，忽略", peerId)
+		return
+	}
+	target, ok := parsePunchTarget(p, json)
+	if !ok {
+		glog.Errorf("[INNER]收到注册中心命令：连接对等节点，但对等IP %s 无效，放弃", json.GetString("ip"))
 		return
 	}
+	p.SetLeasedVip(json.GetString("vip"))
 
-	// 设置对等节点信息
-	peerAddr := &net.UDPAddr{IP: ip, Port: basePort}
-	GetConnectionManager().SetPeerInfo(peer.clientId, peerAddr)
+	// 发起方在此完成PAKE：校验对方确认值，失败说明输入的连接密码错误
+	if pake := p.GetPake(); pake != nil {
+		result, err := pake.Finish(json.GetString("pb"))
+		if err != nil || !result.Verify(json.GetString("cb")) {
+			glog.Warningf("[CRYPTO]与 %s 的密码认证失败，放弃连接", peerId)
+			publishPeerState(peerId, StateFailed, "密码错误")
+			closePeer(p)
+			cm.SetConnectFailed(true, "连接失败：密码错误")
+			return
+		}
+		hs, err := NewHandshake(peerId, result.Key, pake.Salt())
+		if err != nil {
+			glog.Errorf("[CRYPTO]创建握手状态失败：%v", err)
+			return
+		}
+		p.SetHandshake(hs)
+	}
 
 	// 设置连接状态
-	cm := GetConnectionManager()
 	cm.SetConnecting(true, "端口探测中...")
 
-	// 从配置文件读取并发控制参数
-	cfg := GetConfig()
-	maxConcurrency := cfg.PunchHole.MaxConcurrency
-	portRange := cfg.PunchHole.PortRange
-	basePortOffset := cfg.PunchHole.BasePortOffset
-
-	// 创建带缓冲的channel控制并发
-	sem := make(chan struct{}, maxConcurrency)
-	done := make(chan struct{})
-
-	// 计算有效端口范围
-	startPort := basePort + basePortOffset
-	if startPort < 1 {
-		startPort = 1
-	}
-
-	endPort := startPort + portRange
-	if endPort > 65535 {
-		endPort = 65535
-	}
+	strategy := selectPunchStrategy(target)
+	publishPeerState(peerId, StatePunching, strategy)
 
-	// 启动端口扫描协程
+	// 启动打洞协程
 	go func() {
-		ports := make([]int, endPort-startPort)
-		for i := startPort; i < endPort; i++ {
-			ports[i-startPort] = i
-		}
-		// 不断尝试预测端口
-		for tryCount := 0; tryCount < 3 && !peer.peerAlive; tryCount++ {
-			rand.Shuffle(len(ports), func(i, j int) {
-				ports[i], ports[j] = ports[j], ports[i]
-			})
-			for _, port := range ports {
-				// 不要向自己打洞
-				if myPubNetPort == port && ip.String() == myPubNetIp {
-					continue
-				}
-				select {
-				case <-done:
-					return
-				case sem <- struct{}{}:
-					go func(p int) {
-						defer func() { <-sem }()
-
-						targetAddr := &net.UDPAddr{
-							IP:   ip,
-							Port: p,
-						}
-
-						// 发送探测包
-						beatPeer(conn, targetAddr)
-
-						// 随机间隔避免洪水攻击
-						time.Sleep(time.Duration(10+rand.Intn(50)) * time.Millisecond)
-					}(port)
-				}
+		if len(target.candidates) > 0 {
+			cm.SetConnecting(true, "候选地址直连中...")
+			if punchCandidates(conn, target) {
+				return
 			}
-			time.Sleep(time.Second * 1)
+			cm.SetConnecting(true, "端口探测中...")
 		}
-		close(done)
-		glog.Debug("[INNER]>>>>>>>>>>>>>>>端口探测结束")
+		glog.Infof("[NAT]与 %s 打洞使用 %s 策略，对方NAT类型=%s，端口步长=%d", peerId, strategy, target.natType, target.portDelta)
+		punchStrategies[strategy].Punch(conn, target)
+		glog.Debugf("[INNER]>>>>>>>>>>>>>>>与 %s 的端口探测结束", peerId)
 
 		// 检查打洞是否成功，如果失败则切换到中转模式
 		cfg := GetConfig()
 		if cfg.PunchHole.EnableRelay && cfg.PunchHole.RelayFallback {
 			// 等待打洞超时时间，期间保持连接状态
-			cm := GetConnectionManager()
 			cm.SetConnecting(true, "等待打洞结果...")
 
 			time.Sleep(time.Duration(cfg.PunchHole.PunchTimeout) * time.Second)
 
 			// 检查是否仍然没有直连成功
-			if !peer.peerAlive {
-				glog.Warningf("[INNER]打洞超时（%d秒），切换到中转模式", cfg.PunchHole.PunchTimeout)
-				cm.SetMode(ModeRelay)
-
-				// 通知服务器启用中转模式，同时交换虚拟IP
-				err := call(conn, serverAddr, "enableRelay", map[string]interface{}{
-					"srcId":    getClientId(),
-					"targetId": peer.clientId,
-					"vip":      getTunIP(), // 发送自己的虚拟IP
-				})
-				if err != nil {
-					glog.Errorf("[INNER]通知服务器启用中转模式失败：%v", err)
+			if !p.IsAlive() && target.active() {
+				glog.Warningf("[INNER]与 %s 打洞超时（%d秒），切换到中转模式", peerId, cfg.PunchHole.PunchTimeout)
+				p.SetMode(ModeRelay, fmt.Sprintf("打洞超时（%d秒）", cfg.PunchHole.PunchTimeout))
+				if err := enableRelay(conn, p); err != nil {
 					// 如果中转模式也失败，设置连接失败状态
 					cm.SetConnectFailed(true, "连接失败：无法建立直连或中转连接")
-				} else {
-					glog.Infof("[INNER]已通知服务器启用中转模式")
+					publishPeerState(peerId, StateFailed, "无法建立直连或中转连接")
 				}
 			}
 		}
 	}()
 }
 
-func disconnectPeerHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.Json) {
-	glog.Debugf("[INNER]收到注册中心命令：断开对等节点")
-	peer.peerAlive = false
+// enableRelay 通知服务器启用与对等节点的中转模式，同时交换虚拟IP
+func enableRelay(conn *net.UDPConn, p *Peer) error {
+	err := callServer(conn, "enableRelay", withHandshake(p, map[string]interface{}{
+		"srcId":    getClientId(),
+		"targetId": p.clientId,
+		"vip":      getTunIP(), // 发送自己的虚拟IP
+		"vip6":     getTunIP6(),
+	}))
+	if err != nil {
+		glog.Errorf("[INNER]通知服务器启用中转模式失败：%v", err)
+		return err
+	}
+	glog.Infof("[INNER]已通知服务器启用中转模式")
+	return nil
+}
 
-	// 设置断开模式
+// fallbackToRelay 直连路径失效后将会话迁移到中转，会话密钥、虚拟IP和TUN设备保持不变，
+// 之后按 repunch_interval 重新打洞，打通后再切换回直连；未启用中转时断开连接
+func fallbackToRelay(p *Peer, reason string) {
 	cm := GetConnectionManager()
-	cm.SetMode(ModeDisconnected)
-	cm.SetConnecting(false, "连接已断开")
-	if peer.cancelBeatAndTunReadRoutine != nil {
-		// 取消向对等节点发心跳的协程和TUN设备数据读取的协程
-		(*peer.cancelBeatAndTunReadRoutine)()
-		peer.cancelBeatAndTunReadRoutine = nil
-		glog.Debug("[TUN]已关闭对等节点心跳协程和TUN设备读取协程")
-	}
-	// 关闭TUN设备
-	if tun != nil {
-		err := tun.Close()
-		if err != nil {
-			glog.Errorf("[TUN]关闭TUN设备失败：%v", err)
+	if conn := cm.ClearDirectPath(p); conn != nil {
+		conn.Close()
+	}
+	if !GetConfig().PunchHole.EnableRelay {
+		glog.Warningf("[INNER]与 %s 的直连路径失效（%s），未启用中转，断开连接", p.clientId, reason)
+		closePeer(p)
+		if cm.AlivePeerCount() == 0 {
+			cm.SetConnecting(false, "连接已断开")
 		}
-		tun = nil
-		glog.Debug("[TUN]已关闭TUN设备")
+		return
+	}
+	glog.Warningf("[INNER]与 %s 的直连路径失效（%s），切换到中转模式", p.clientId, reason)
+	p.SetMode(ModeRelay, reason)
+	enableRelay(natConnection.listen, p)
+}
+
+// disconnectPeerHandler 注册中心通知对等节点已下线、更换了地址或主动断开
+func disconnectPeerHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.Json) {
+	peerId := json.GetString("peerId")
+	reason := json.GetString("reason")
+	glog.Debugf("[INNER]收到注册中心命令：断开对等节点 %s，原因：%s", peerId, reason)
+	cm := GetConnectionManager()
+	for _, p := range cm.GetPeers() {
+		// 未指明对等节点时断开全部连接
+		if peerId == "" || p.clientId == peerId {
+			alive := p.IsAlive()
+			closePeer(p)
+			// 对方下线或更换地址时自动重连，对方主动断开时不重连
+			if alive && reason != disconnectClosed {
+				reconnector.Schedule(p.clientId)
+			}
+		}
+	}
+	if cm.AlivePeerCount() == 0 {
+		cm.SetConnecting(false, "连接已断开")
 	}
-	peer.clientId = ""
-	peer.peerAddr = nil
-	peer.peerAlive = false
-	peer.peerVirtualIp = ""
-	peer.latency = -1
-	peer.cancelBeatAndTunReadRoutine = nil
 }
 
 func getRandPort() int {
@@ -528,8 +804,14 @@ func initClient() {
 	natConnection.RegisterResponseHandler("changePort", changePortHandler)
 	// 接收注册中心发送的连接对等节点的命令
 	natConnection.RegisterResponseHandler("connectPeer", connectPeerHandler)
+	// 接收注册中心因尝试过于频繁拒绝连接的通知
+	natConnection.RegisterResponseHandler("connectRejected", connectRejectedHandler)
+	// 接收注册中心返回的NAT探测结果
+	natConnection.RegisterResponseHandler("natProbeResult", natProbeResultHandler)
 	// 接收注册中心发送的断开对等节点的命令
 	natConnection.RegisterResponseHandler("disconnectPeer", disconnectPeerHandler)
+	// 接收注册中心发送的中转模式下重新打洞的命令
+	natConnection.RegisterResponseHandler("repunch", repunchHandler)
 
 	// 接收对等节点的心跳
 	natConnection.RegisterResponseHandler("beat", beatHandler)
@@ -545,176 +827,133 @@ func initClient() {
 	natConnection.RegisterResponseHandler("relayLatencyReply", relayLatencyReplyHandler)
 
 	natConnection.StartClient(clientPort)
+	// 每秒计算各对等节点的收发速率
+	startTrafficSampler()
+	// 监视网络变化，公网地址改变后自动恢复会话
+	netWatcher.Start()
 }
 
 func main() {
+	// 带子命令时作为命令行工具运行，用于没有浏览器的服务器和容器
+	if len(os.Args) > 1 {
+		os.Exit(runCli(os.Args[1:]))
+	}
 	if !IsAdmin() {
 		glog.Warning("请以管理员/root身份运行...")
 		fmt.Scanln()
 		return
 	}
+	runClient(true)
+}
+
+// runClient 启动客户端和Web控制台，openUI 为false时不打开浏览器
+func runClient(openUI bool) {
 	cfg := GetConfig()
 	glog.SetLevelString(cfg.LogLevel)
 	initClient()
-	startWebServer()
+	go waitForShutdown()
+	go startControlServer()
+	startWebServer(openUI)
 }
 
-// startDirectLatencyTest 启动直连模式延迟测试
-func startDirectLatencyTest(conn *net.UDPConn) {
-	// 异步等待2秒后发送第一个测试包
-	go func() {
-		time.Sleep(2 * time.Second)
-
-		// 检查是否仍然在直连模式
-		cm := GetConnectionManager()
-		if !cm.IsDirectMode() {
-			glog.Debug("[INNER]直连模式已结束，停止延迟测试")
-			return
-		}
-
-		// 发送第一个测试包
-		sendDirectLatencyTest(conn)
-	}()
-
-	// 每15秒发送一次延迟测试包
-	ticker := time.NewTicker(15 * time.Second)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		// 检查是否仍然在直连模式
-		cm := GetConnectionManager()
-		if !cm.IsDirectMode() {
-			glog.Debug("[INNER]直连模式已结束，停止延迟测试")
-			return
-		}
+// waitForShutdown 收到退出信号时清理后退出
+func waitForShutdown() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	glog.Infof("[INNER]收到退出信号，正在退出")
+	shutdown()
+}
 
-		// 发送延迟测试包
-		sendDirectLatencyTest(conn)
-	}
+// shutdown 删除路由器上的端口映射和控制套接字后退出
+func shutdown() {
+	portMapping.Stop()
+	closeControlServer()
+	os.Exit(0)
 }
 
 // sendDirectLatencyTest 发送直连模式延迟测试包
-func sendDirectLatencyTest(conn *net.UDPConn) {
+func sendDirectLatencyTest(conn *net.UDPConn, p *Peer) {
 	// 获取对等节点信息
-	peerClientId, peerAddr := GetConnectionManager().GetPeerInfo()
-	if peerClientId == "" || peerAddr == nil {
-		glog.Warning("[INNER]直连模式延迟测试：无法获取对等节点信息")
+	peerAddr := p.GetAddr()
+	if peerAddr == nil {
+		glog.Warningf("[INNER]直连模式延迟测试：无法获取对等节点 %s 的地址", p.clientId)
 		return
 	}
 
 	// 发送延迟测试包
 	timestamp := time.Now().UnixMilli()
-	err := call(conn, peerAddr, "beat", map[string]interface{}{
+	err := call(conn, peerAddr, "beat", withHandshake(p, map[string]interface{}{
 		"usePort": peerAddr.Port,
 		"vip":     getTunIP(),
+		"vip6":    getTunIP6(),
 		"c":       rand.Intn(100000),
 		"t":       timestamp, // 带时间戳的延迟测试包
 		"a":       rand.Intn(100000),
 		"id":      getClientId(),
-	})
+	}))
 	if err != nil {
 		glog.Errorf("[INNER]直连模式延迟测试：发送失败：%v", err)
 	} else {
-		glog.Debugf("[INNER]直连模式延迟测试：已发送测试包，时间戳：%d", timestamp)
-	}
-}
-
-// startRelayLatencyTest 启动中转模式延迟测试
-func startRelayLatencyTest(conn *net.UDPConn) {
-	// 异步等待2秒后发送第一个测试包
-	go func() {
-		time.Sleep(2 * time.Second)
-
-		// 检查是否仍然在中转模式
-		cm := GetConnectionManager()
-		if !cm.IsRelayMode() {
-			glog.Debug("[INNER]中转模式已结束，停止延迟测试")
-			return
-		}
-
-		// 发送第一个测试包
-		sendRelayLatencyTest(conn)
-	}()
-
-	// 每15秒发送一次延迟测试包
-	ticker := time.NewTicker(15 * time.Second)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		// 检查是否仍然在中转模式
-		cm := GetConnectionManager()
-		if !cm.IsRelayMode() {
-			glog.Debug("[INNER]中转模式已结束，停止延迟测试")
-			return
-		}
-
-		// 发送延迟测试包
-		sendRelayLatencyTest(conn)
+		glog.Debugf("[INNER]直连模式延迟测试：已向 %s 发送测试包，时间戳：%d", p.clientId, timestamp)
 	}
 }
 
 // sendRelayLatencyTest 发送中转模式延迟测试包
-func sendRelayLatencyTest(conn *net.UDPConn) {
-	// 获取对等节点信息
-	peerClientId, _ := GetConnectionManager().GetPeerInfo()
-	if peerClientId == "" {
-		glog.Warning("[INNER]中转模式延迟测试：无法获取对等节点ID")
-		return
-	}
-
+func sendRelayLatencyTest(conn *net.UDPConn, p *Peer) {
 	// 发送延迟测试包
 	timestamp := time.Now().UnixMilli()
-	err := call(conn, serverAddr, "relayLatencyTest", map[string]interface{}{
-		"targetId":  peerClientId,
+	err := callServer(conn, "relayLatencyTest", map[string]interface{}{
+		"targetId":  p.clientId,
 		"timestamp": timestamp,
 	})
 	if err != nil {
 		glog.Errorf("[INNER]中转模式延迟测试：发送失败：%v", err)
 	} else {
-		glog.Debugf("[INNER]中转模式延迟测试：已发送测试包，时间戳：%d", timestamp)
+		glog.Debugf("[INNER]中转模式延迟测试：已向 %s 发送测试包，时间戳：%d", p.clientId, timestamp)
 	}
 }
 
 // relayLatencyTestHandler 处理中转模式延迟测试
 func relayLatencyTestHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.Json) {
-	// 检查是否为中转模式
-	cm := GetConnectionManager()
-	if !cm.IsRelayMode() {
-		glog.Warning("[INNER]收到中转延迟测试但当前不是中转模式，忽略")
+	// 检查与发送方是否为中转模式
+	srcId := json.GetString("srcId")
+	p := GetConnectionManager().GetPeer(srcId)
+	if p == nil || !p.IsRelayMode() {
+		glog.Warningf("[INNER]收到 %s 的中转延迟测试但与其不是中转模式，忽略", srcId)
 		return
 	}
 
 	timestamp := json.GetInt64("timestamp")
 	if timestamp > 0 {
 		// 立即回复延迟测试包
-		peerClientId, _ := GetConnectionManager().GetPeerInfo()
-		if peerClientId != "" {
-			err := call(conn, serverAddr, "relayLatencyReply", map[string]interface{}{
-				"targetId":  peerClientId,
-				"timestamp": timestamp, // 回复相同的时间戳
-			})
-			if err != nil {
-				glog.Errorf("[INNER]中转模式延迟测试：回复失败：%v", err)
-			} else {
-				glog.Debugf("[INNER]中转模式延迟测试：已回复测试包，时间戳：%d", timestamp)
-			}
+		err := callServer(conn, "relayLatencyReply", map[string]interface{}{
+			"targetId":  srcId,
+			"timestamp": timestamp, // 回复相同的时间戳
+		})
+		if err != nil {
+			glog.Errorf("[INNER]中转模式延迟测试：回复失败：%v", err)
+		} else {
+			glog.Debugf("[INNER]中转模式延迟测试：已回复 %s 的测试包，时间戳：%d", srcId, timestamp)
 		}
 	}
 }
 
 // relayLatencyReplyHandler 处理中转模式延迟测试回复
 func relayLatencyReplyHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.Json) {
-	// 检查是否为中转模式
-	cm := GetConnectionManager()
-	if !cm.IsRelayMode() {
-		glog.Warning("[INNER]收到中转延迟回复但当前不是中转模式，忽略")
+	// 检查与发送方是否为中转模式
+	srcId := json.GetString("srcId")
+	p := GetConnectionManager().GetPeer(srcId)
+	if p == nil || !p.IsRelayMode() {
+		glog.Warningf("[INNER]收到 %s 的中转延迟回复但与其不是中转模式，忽略", srcId)
 		return
 	}
 
 	timestamp := json.GetInt64("timestamp")
 	if timestamp > 0 {
 		// 计算往返延迟
-		peer.latency = int(time.Now().UnixMilli() - timestamp)
-		glog.Debugf("[INNER]中转模式延迟测试：往返延迟=%dms", peer.latency)
+		latency := int(time.Now().UnixMilli() - timestamp)
+		p.SetLatency(latency)
+		glog.Debugf("[INNER]中转模式延迟测试：与 %s 的往返延迟=%dms", srcId, latency)
 	}
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/venshao/natun/gjson"
+	"github.com/venshao/natun/glog"
+)
+
+// NAT类型，沿用常见的 NAT1~NAT4 分类
+const (
+	NatUnknown = "UNKNOWN" // 尚未检测或注册中心不支持探测
+	NatOpen    = "OPEN"    // 没有NAT，公网地址与本机地址一致
+	NatFull    = "NAT1"    // 完全锥形：映射和过滤都与目的地址无关
+	NatAddr    = "NAT2"    // 地址限制锥形：映射与目的地址无关，只接受发送过报文的地址
+	NatPort    = "NAT3"    // 端口限制锥形：映射与目的地址无关，只接受发送过报文的地址和端口
+	NatSym     = "NAT4"    // 对称型：不同目的地址使用不同的映射端口
+)
+
+// 映射和过滤行为，术语见 RFC 4787
+const (
+	BehaviorEndpointIndependent = "endpoint-independent"
+	BehaviorAddressDependent    = "address-dependent"
+	BehaviorPortDependent       = "port-dependent"
+	BehaviorEndpointDependent   = "endpoint-dependent"
+)
+
+// NAT类型检测结果过期后重新检测，检测失败时间隔较短的时间重试
+const (
+	natDetectInterval = 10 * time.Minute
+	natRetryInterval  = time.Minute
+)
+
+// NatInfo NAT类型检测结果
+type NatInfo struct {
+	Type       string `json:"type"`
+	Mapping    string `json:"mapping,omitempty"`   // 映射行为
+	Filtering  string `json:"filtering,omitempty"` // 过滤行为
+	PortDelta  int    `json:"portDelta"`           // 发往不同目的地址时映射端口的差值，仅对称型NAT有意义
+	PublicAddr string `json:"publicAddr,omitempty"`
+	DetectedAt int64  `json:"detectedAt,omitempty"`
+}
+
+// natProbeReply 注册中心返回的映射地址
+type natProbeReply struct {
+	mapped *net.UDPAddr
+}
+
+// NatDetector 通过注册中心的主端口和探测端口检测本机NAT的映射和过滤行为
+type NatDetector struct {
+	mu          sync.Mutex
+	info        NatInfo
+	probePort   int
+	running     bool
+	lastAttempt time.Time
+	pending     map[int64]chan natProbeReply
+}
+
+var natDetector = &NatDetector{
+	info:    NatInfo{Type: NatUnknown},
+	pending: make(map[int64]chan natProbeReply),
+}
+
+// GetNatInfo 获取最近一次的检测结果
+func (d *NatDetector) GetNatInfo() NatInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.info
+}
+
+// OnPong 注册中心在pong中告知探测端口，检测结果不存在或已过期时在后台重新检测
+func (d *NatDetector) OnPong(conn *net.UDPConn, probePort int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if probePort == 0 || d.running {
+		return
+	}
+	d.probePort = probePort
+	if d.info.DetectedAt != 0 && time.Since(time.Unix(d.info.DetectedAt, 0)) < natDetectInterval {
+		return
+	}
+	if time.Since(d.lastAttempt) < natRetryInterval {
+		return
+	}
+	d.lastAttempt = time.Now()
+	d.running = true
+	go d.detect(conn)
+}
+
+// Invalidate 网络变化后之前的检测结果可能已经失效，下一次pong时重新检测
+func (d *NatDetector) Invalidate() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.info.DetectedAt = 0
+	d.lastAttempt = time.Time{}
+}
+
+// detect 依次进行三次探测：
+// 1. 向主端口探测，得到映射地址 m1
+// 2. 向主端口探测但要求从探测端口回复，收到回复说明NAT不按端口过滤
+// 3. 向探测端口探测，得到映射地址 m2，m1 与 m2 相同说明映射与目的地址无关
+// 第2步必须在第3步之前，否则本机已向探测端口发过报文，过滤测试总能通过
+// 主端口和探测端口位于同一IP，因此无法区分完全锥形与地址限制锥形，收到回复时保守地判定为地址限制锥形
+func (d *NatDetector) detect(conn *net.UDPConn) {
+	d.mu.Lock()
+	probeAddr := &net.UDPAddr{IP: serverAddr.IP, Port: d.probePort}
+	d.mu.Unlock()
+	info := NatInfo{Type: NatUnknown}
+	defer func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.running = false
+		if info.Type == NatUnknown {
+			return
+		}
+		info.DetectedAt = time.Now().Unix()
+		if d.info.Type != info.Type {
+			glog.Infof("[NAT]NAT类型检测完成：%s，映射=%s，过滤=%s，端口步长=%d，公网地址=%s",
+				info.Type, info.Mapping, info.Filtering, info.PortDelta, info.PublicAddr)
+		}
+		d.info = info
+	}()
+
+	m1, ok := d.probe(conn, serverAddr, "")
+	if !ok {
+		glog.Warning("[NAT]NAT类型检测失败：注册中心没有回复")
+		return
+	}
+	info.PublicAddr = m1.String()
+	if local, ok := conn.LocalAddr().(*net.UDPAddr); ok && local.Port == m1.Port && isLocalIP(m1.IP) {
+		info.Type = NatOpen
+		info.Mapping = BehaviorEndpointIndependent
+		info.Filtering = BehaviorEndpointIndependent
+		return
+	}
+
+	_, altReceived := d.probe(conn, serverAddr, "alt")
+	info.Filtering = BehaviorPortDependent
+	if altReceived {
+		info.Filtering = BehaviorAddressDependent
+	}
+
+	m2, ok := d.probe(conn, probeAddr, "")
+	if !ok {
+		glog.Warning("[NAT]NAT类型检测失败：探测端口没有回复")
+		return
+	}
+	if m1.IP.Equal(m2.IP) && m1.Port == m2.Port {
+		info.Mapping = BehaviorEndpointIndependent
+		info.Type = NatPort
+		if altReceived {
+			info.Type = NatAddr
+		}
+		return
+	}
+	info.Mapping = BehaviorEndpointDependent
+	info.Type = NatSym
+	info.PortDelta = m2.Port - m1.Port
+}
+
+// probe 向指定地址发送 natProbe 并等待映射地址，最多重试3次
+func (d *NatDetector) probe(conn *net.UDPConn, addr *net.UDPAddr, reply string) (*net.UDPAddr, bool) {
+	seq := int64(rand.Int31())
+	ch := make(chan natProbeReply, 1)
+	d.mu.Lock()
+	d.pending[seq] = ch
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, seq)
+		d.mu.Unlock()
+	}()
+
+	for try := 0; try < 3; try++ {
+		err := callServerAt(conn, addr, "natProbe", map[string]interface{}{
+			"seq":   seq,
+			"reply": reply,
+		})
+		if err != nil {
+			return nil, false
+		}
+		select {
+		case r := <-ch:
+			return r.mapped, true
+		case <-time.After(time.Millisecond * 500):
+		}
+	}
+	return nil, false
+}
+
+// natProbeResultHandler 处理注册中心返回的映射地址
+func natProbeResultHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.Json) {
+	// 探测结果只可能来自注册中心的主端口或探测端口
+	if !addr.IP.Equal(serverAddr.IP) {
+		glog.Warningf("[NAT]忽略来自 %s 的探测结果", addr.String())
+		return
+	}
+	ip := net.ParseIP(json.GetString("mappedIp"))
+	if ip == nil {
+		return
+	}
+	natDetector.mu.Lock()
+	ch := natDetector.pending[json.GetInt64("seq")]
+	natDetector.mu.Unlock()
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- natProbeReply{mapped: &net.UDPAddr{IP: ip, Port: json.GetInt("mappedPort")}}:
+	default:
+	}
+}
+
+// isLocalIP 地址是否为本机网卡上的地址
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
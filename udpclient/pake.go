@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"filippo.io/nistec"
+)
+
+// SPAKE2 (RFC 9382) 使用的 P-256 曲线固定点 M、N，按 RFC 9382 第6节由种子字符串生成
+// 任何一方（包括转发消息的注册中心）都只能在线猜测密码，每次连接只能猜一次
+// 曲线运算使用常数时间实现的 nistec，避免标量（临时私钥和密码派生值）经运算耗时泄露
+var (
+	pakeM = mustDecodePoint("02886e2f97ace46e55ba9dd7242579f2993b64e16ef3dcab95afd497333d8fa12f")
+	pakeN = mustDecodePoint("03d8bbd6c639c62937b04d997f38c3770719c629d7014d49a24b4f98baa1292b49")
+)
+
+// P-256 无穷远点（单位元）的编码
+var pakeIdentity = nistec.NewP256Point().Bytes()
+
+func mustDecodePoint(compressed string) *nistec.P256Point {
+	raw, err := hex.DecodeString(compressed)
+	if err != nil {
+		panic(err)
+	}
+	point, err := nistec.NewP256Point().SetBytes(raw)
+	if err != nil {
+		panic("invalid SPAKE2 constant point")
+	}
+	return point
+}
+
+// Pake 一次 SPAKE2 密码认证密钥交换
+// 发起方（A）持有对方的连接密码，被连接方（B）持有本机密码，密码本身及其哈希都不会离开本机
+type Pake struct {
+	initiator bool
+	idA, idB  string
+	salt      []byte
+	w         []byte // 密码派生的标量，32字节大端序
+	scalar    []byte // 本方临时标量，32字节大端序
+	message   []byte
+}
+
+// NewPake 创建 SPAKE2 状态并计算本方消息
+// localId/remoteId 为双方客户端ID，initiator 表示本方为发起连接的一方
+func NewPake(initiator bool, localId string, remoteId string, password string, salt []byte) (*Pake, error) {
+	scalar, err := randomScalar()
+	if err != nil {
+		return nil, err
+	}
+	w, err := passwordScalar(password, salt)
+	if err != nil {
+		return nil, err
+	}
+	p := &Pake{
+		initiator: initiator,
+		idA:       localId,
+		idB:       remoteId,
+		salt:      salt,
+		w:         w,
+		scalar:    scalar,
+	}
+	blind := pakeM
+	if !initiator {
+		p.idA, p.idB = remoteId, localId
+		blind = pakeN
+	}
+	// 本方消息 = scalar*G + w*(M 或 N)
+	message, err := pakeMessage(p.scalar, p.w, blind)
+	if err != nil {
+		return nil, err
+	}
+	p.message = message
+	return p, nil
+}
+
+// pakeMessage 计算 scalar*G + w*blind 的未压缩编码
+func pakeMessage(scalar []byte, w []byte, blind *nistec.P256Point) ([]byte, error) {
+	public, err := nistec.NewP256Point().ScalarBaseMult(scalar)
+	if err != nil {
+		return nil, err
+	}
+	blinding, err := nistec.NewP256Point().ScalarMult(blind, w)
+	if err != nil {
+		return nil, err
+	}
+	return public.Add(public, blinding).Bytes(), nil
+}
+
+// Message 返回需经注册中心转交给对方的本方消息（base64）
+func (p *Pake) Message() string {
+	return base64.StdEncoding.EncodeToString(p.message)
+}
+
+// Salt 返回本次会话的随机盐
+func (p *Pake) Salt() []byte {
+	return p.salt
+}
+
+// Finish 根据对方消息计算共享密钥和双方的确认值
+// 对方确认值需调用 PakeResult.Verify 校验
+func (p *Pake) Finish(remoteMessage string) (*PakeResult, error) {
+	remote, err := base64.StdEncoding.DecodeString(remoteMessage)
+	if err != nil {
+		return nil, fmt.Errorf("PAKE消息格式错误: %v", err)
+	}
+	blind := pakeN
+	if !p.initiator {
+		blind = pakeM
+	}
+	k, err := pakeSharedPoint(p.scalar, p.w, blind, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	messageA, messageB := p.message, remote
+	if !p.initiator {
+		messageA, messageB = remote, p.message
+	}
+	result := pakeKeySchedule(p.idA, p.idB, messageA, messageB, k, p.w)
+	if !p.initiator {
+		result.local, result.remote = result.remote, result.local
+	}
+	return result, nil
+}
+
+// pakeSharedPoint 去掉对方的盲化后计算共享点: K = scalar * (remote - w*blind)
+// 拒绝不在曲线上的点和单位元，P-256 的余因子为1，曲线上的其他点都在素数阶子群内
+func pakeSharedPoint(scalar []byte, w []byte, blind *nistec.P256Point, remote []byte) ([]byte, error) {
+	remotePoint, err := nistec.NewP256Point().SetBytes(remote)
+	if err != nil || bytes.Equal(remote, pakeIdentity) {
+		return nil, fmt.Errorf("PAKE消息不是有效的曲线点")
+	}
+	blinding, err := nistec.NewP256Point().ScalarMult(blind, w)
+	if err != nil {
+		return nil, err
+	}
+	unblinded := remotePoint.Add(remotePoint, blinding.Negate(blinding))
+	k, err := nistec.NewP256Point().ScalarMult(unblinded, scalar)
+	if err != nil {
+		return nil, err
+	}
+	encoded := k.Bytes()
+	if bytes.Equal(encoded, pakeIdentity) {
+		return nil, fmt.Errorf("PAKE共享点无效")
+	}
+	return encoded, nil
+}
+
+// pakeKeySchedule RFC 9382 第4节的密钥计划（P256-SHA256-HKDF-HMAC，不使用AAD）
+// TT 为各字段带8字节小端序长度前缀的拼接，Ke || Ka = SHA256(TT)，
+// KcA || KcB = HKDF(nil, Ka, "ConfirmationKeys")，双方确认值为 HMAC(KcA/KcB, TT)
+func pakeKeySchedule(idA string, idB string, messageA []byte, messageB []byte, k []byte, w []byte) *PakeResult {
+	transcript := make([]byte, 0, 512)
+	for _, part := range [][]byte{[]byte(idA), []byte(idB), messageA, messageB, k, w} {
+		transcript = binary.LittleEndian.AppendUint64(transcript, uint64(len(part)))
+		transcript = append(transcript, part...)
+	}
+	digest := sha256.Sum256(transcript)
+	ke, ka := digest[:16], digest[16:]
+
+	confirmationKeys := deriveKey(ka, nil, "ConfirmationKeys")
+	confirmA := hmac.New(sha256.New, confirmationKeys[:16])
+	confirmA.Write(transcript)
+	confirmB := hmac.New(sha256.New, confirmationKeys[16:])
+	confirmB.Write(transcript)
+	return &PakeResult{Key: ke, local: confirmA.Sum(nil), remote: confirmB.Sum(nil)}
+}
+
+// PakeResult SPAKE2 的输出
+type PakeResult struct {
+	Key    []byte
+	local  []byte
+	remote []byte
+}
+
+// Confirmation 本方确认值（base64），证明本方知道密码
+func (r *PakeResult) Confirmation() string {
+	return base64.StdEncoding.EncodeToString(r.local)
+}
+
+// Verify 校验对方确认值，失败说明双方密码不一致
+func (r *PakeResult) Verify(confirmation string) bool {
+	remote, err := base64.StdEncoding.DecodeString(confirmation)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(remote, r.remote)
+}
+
+// passwordScalar 将连接密码映射为曲线标量（32字节大端序）
+// 派生值不小于曲线阶时（概率约 2^-32）换用下一个计数器重新派生，避免取模运算的非常数时间实现
+func passwordScalar(password string, salt []byte) ([]byte, error) {
+	for counter := 0; counter < 16; counter++ {
+		info := "natun spake2 password"
+		if counter > 0 {
+			info += fmt.Sprintf(" %d", counter)
+		}
+		digest := deriveKey([]byte(password), salt, info)
+		if key, err := ecdh.P256().NewPrivateKey(digest); err == nil {
+			return key.Bytes(), nil
+		}
+	}
+	return nil, fmt.Errorf("无法由连接密码派生PAKE标量")
+}
+
+// randomScalar 生成 [1, n-1] 内均匀分布的临时标量
+func randomScalar() ([]byte, error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return key.Bytes(), nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+
+	"filippo.io/nistec"
+)
+
+// rfc9382Point 按 RFC 9382 第6节生成 P-256 的固定点：对种子迭代 SHA256，
+// 取第 i 次的结果调整首字节为压缩点格式，第一个能解码为曲线点的即为所求
+func rfc9382Point(t *testing.T, seed string) []byte {
+	t.Helper()
+	h := []byte(seed)
+	for i := 1; i < 1000; i++ {
+		digest := sha256.Sum256(h)
+		h = digest[:]
+		// 压缩点为33字节，需要第 i 和 i+1 次迭代的哈希拼接后截断
+		next := sha256.Sum256(h)
+		candidate := append(append([]byte{}, h...), next[:1]...)
+		candidate[0] = candidate[0]&1 | 2
+		if _, err := nistec.NewP256Point().SetBytes(candidate); err == nil {
+			return candidate
+		}
+	}
+	t.Fatalf("种子 %q 没有生成曲线点", seed)
+	return nil
+}
+
+// TestPakeConstantsFollowRFC9382 M、N 与 RFC 9382 由种子生成的点一致
+func TestPakeConstantsFollowRFC9382(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		point *nistec.P256Point
+	}{{"M", pakeM}, {"N", pakeN}} {
+		want := rfc9382Point(t, "1.2.840.10045.3.1.7 point generation seed ("+c.name+")")
+		if got := c.point.BytesCompressed(); !bytes.Equal(got, want) {
+			t.Fatalf("%s = %x, want %x", c.name, got, want)
+		}
+	}
+}
+
+// testScalar 32字节均为 b 的标量，小于曲线阶
+func testScalar(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+// TestPakeKeySchedule 双方得到相同的共享点，密钥和确认值按 RFC 9382 第4节计算
+func TestPakeKeySchedule(t *testing.T) {
+	x, y, w := testScalar(0x11), testScalar(0x22), testScalar(0x33)
+	pA, err := pakeMessage(x, w, pakeM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pB, err := pakeMessage(y, w, pakeN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kA, err := pakeSharedPoint(x, w, pakeN, pB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kB, err := pakeSharedPoint(y, w, pakeM, pA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(kA, kB) {
+		t.Fatal("双方计算的共享点不同")
+	}
+	// K = x*y*G
+	xG, _ := nistec.NewP256Point().ScalarBaseMult(x)
+	xyG, _ := nistec.NewP256Point().ScalarMult(xG, y)
+	if !bytes.Equal(kA, xyG.Bytes()) {
+		t.Fatal("共享点不等于 x*y*G")
+	}
+
+	var tt []byte
+	for _, part := range [][]byte{[]byte("server"), []byte("client"), pA, pB, kA, w} {
+		tt = binary.LittleEndian.AppendUint64(tt, uint64(len(part)))
+		tt = append(tt, part...)
+	}
+	digest := sha256.Sum256(tt)
+	// HKDF-SHA256：盐为空时以全零密钥提取，输出32字节只需扩展一个分组
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(digest[16:])
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte("ConfirmationKeys\x01"))
+	kc := expand.Sum(nil)
+	macA := hmac.New(sha256.New, kc[:16])
+	macA.Write(tt)
+	macB := hmac.New(sha256.New, kc[16:])
+	macB.Write(tt)
+
+	result := pakeKeySchedule("server", "client", pA, pB, kA, w)
+	if !bytes.Equal(result.Key, digest[:16]) {
+		t.Fatalf("Ke = %x, want %x", result.Key, digest[:16])
+	}
+	if !bytes.Equal(result.local, macA.Sum(nil)) || !bytes.Equal(result.remote, macB.Sum(nil)) {
+		t.Fatal("确认值与 RFC 9382 的计算不一致")
+	}
+}
+
+func runPake(t *testing.T, passwordA string, passwordB string) (*PakeResult, *PakeResult) {
+	t.Helper()
+	salt := []byte("salt")
+	a, err := NewPake(true, "a", "b", passwordA, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewPake(false, "b", "a", passwordB, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultA, err := a.Finish(b.Message())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultB, err := b.Finish(a.Message())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resultA, resultB
+}
+
+// TestPakeAgreesOnKey 密码一致时双方得到相同的密钥并互相通过确认
+func TestPakeAgreesOnKey(t *testing.T) {
+	resultA, resultB := runPake(t, "123456", "123456")
+	if !bytes.Equal(resultA.Key, resultB.Key) {
+		t.Fatal("双方的密钥不同")
+	}
+	if !resultA.Verify(resultB.Confirmation()) || !resultB.Verify(resultA.Confirmation()) {
+		t.Fatal("确认值校验失败")
+	}
+	if resultA.Verify(resultA.Confirmation()) {
+		t.Fatal("本方确认值被当作对方确认值接受")
+	}
+}
+
+// TestPakePasswordMismatch 密码不一致时确认值校验失败
+func TestPakePasswordMismatch(t *testing.T) {
+	resultA, resultB := runPake(t, "123456", "654321")
+	if bytes.Equal(resultA.Key, resultB.Key) {
+		t.Fatal("密码不一致时得到了相同的密钥")
+	}
+	if resultA.Verify(resultB.Confirmation()) || resultB.Verify(resultA.Confirmation()) {
+		t.Fatal("密码不一致时确认值校验通过")
+	}
+}
+
+// TestPakeRejectsInvalidPoints 拒绝单位元、不在曲线上的点和使共享点为单位元的消息
+func TestPakeRejectsInvalidPoints(t *testing.T) {
+	a, err := NewPake(true, "a", "b", "123456", []byte("salt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	offCurve := append([]byte{}, a.message...)
+	offCurve[len(offCurve)-1] ^= 1
+	// 对方消息恰好为 w*N 时去盲化后为单位元
+	wN, err := nistec.NewP256Point().ScalarMult(pakeN, a.w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, message := range map[string][]byte{
+		"单位元":   pakeIdentity,
+		"不在曲线上": offCurve,
+		"截断":    a.message[:33],
+		"w*N":   wN.Bytes(),
+	} {
+		if _, err := a.Finish(base64.StdEncoding.EncodeToString(message)); err == nil {
+			t.Fatalf("%s 的PAKE消息被接受", name)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/venshao/natun/glog"
+)
+
+// PCP 和 NAT-PMP 服务端口
+const pcpPort = 5351
+
+// 请求的映射有效期，过半时续期；没有可用的网关或映射失败时间隔较长的时间重试
+const (
+	portMappingLifetime = 2 * time.Hour
+	portMappingRetry    = 5 * time.Minute
+)
+
+// PortMapper 路由器端口映射协议
+type PortMapper interface {
+	Name() string
+	// AddMapping 请求将外部端口映射到本机UDP端口，返回外部地址和网关实际给出的有效期
+	// 网关可能分配与建议值不同的外部端口，续期时以上次分配的端口作为建议值
+	AddMapping(internalPort int, externalPort int, lifetime time.Duration) (*net.UDPAddr, time.Duration, error)
+	// DeleteMapping 删除映射
+	DeleteMapping(internalPort int, externalPort int) error
+}
+
+// PortMapping 为本机UDP端口在路由器上申请端口映射，映射的外部地址经注册中心告知对等节点
+// 作为额外的直连候选地址：对方直接向该地址发包即可连通，无需端口预测
+type PortMapping struct {
+	op       sync.Mutex // 串行执行 Start 和 Stop
+	mu       sync.Mutex
+	mapper   PortMapper
+	internal int
+	external *net.UDPAddr
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+var portMapping = &PortMapping{}
+
+// Start 为本机UDP端口申请映射并定期续期，已有的映射先释放
+func (m *PortMapping) Start(port int) {
+	m.op.Lock()
+	defer m.op.Unlock()
+	m.stop()
+	if !GetConfig().PunchHole.PortMapping {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	m.mu.Lock()
+	m.internal = port
+	m.cancel = cancel
+	m.done = done
+	m.mu.Unlock()
+	go m.run(ctx, port, done)
+}
+
+// Stop 停止续期并删除路由器上的映射
+func (m *PortMapping) Stop() {
+	m.op.Lock()
+	defer m.op.Unlock()
+	m.stop()
+}
+
+func (m *PortMapping) stop() {
+	m.mu.Lock()
+	cancel, done := m.cancel, m.done
+	m.cancel, m.done = nil, nil
+	m.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	// 等待续期协程退出，避免删除映射后又被续期
+	cancel()
+	<-done
+
+	m.mu.Lock()
+	mapper, internal, external := m.mapper, m.internal, m.external
+	m.mapper, m.external = nil, nil
+	m.mu.Unlock()
+	if mapper == nil || external == nil {
+		return
+	}
+	if err := mapper.DeleteMapping(internal, external.Port); err != nil {
+		glog.Warningf("[NAT]删除 %s 端口映射失败：%v", mapper.Name(), err)
+		return
+	}
+	glog.Infof("[NAT]已删除 %s 端口映射 %s", mapper.Name(), external.String())
+}
+
+// run 申请映射并在有效期过半时续期
+func (m *PortMapping) run(ctx context.Context, port int, done chan struct{}) {
+	defer close(done)
+	for {
+		wait := portMappingRetry
+		if lifetime, err := m.renew(port); err != nil {
+			glog.Debugf("[NAT]端口映射不可用：%v", err)
+		} else {
+			wait = lifetime / 2
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// renew 申请或续期映射，尚未找到网关或续期失败时重新发现
+func (m *PortMapping) renew(port int) (time.Duration, error) {
+	m.mu.Lock()
+	mapper, external := m.mapper, m.external
+	m.mu.Unlock()
+	if mapper == nil {
+		var err error
+		if mapper, err = discoverPortMapper(); err != nil {
+			return 0, err
+		}
+	}
+	suggested := port
+	if external != nil {
+		suggested = external.Port
+	}
+	addr, lifetime, err := mapper.AddMapping(port, suggested, portMappingLifetime)
+	if err != nil {
+		m.mu.Lock()
+		m.mapper, m.external = nil, nil
+		m.mu.Unlock()
+		return 0, fmt.Errorf("%s 映射失败：%v", mapper.Name(), err)
+	}
+	if lifetime <= 0 {
+		lifetime = portMappingLifetime
+	}
+	if external == nil || external.String() != addr.String() {
+		glog.Infof("[NAT]已通过 %s 将外部地址 %s 映射到本机端口 %d，有效期 %v", mapper.Name(), addr.String(), port, lifetime)
+	}
+	m.mu.Lock()
+	m.mapper, m.external = mapper, addr
+	m.mu.Unlock()
+	return lifetime, nil
+}
+
+// Info 当前使用的映射协议和外部地址，没有映射时为空
+func (m *PortMapping) Info() (string, string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mapper == nil || m.external == nil {
+		return "", ""
+	}
+	return m.mapper.Name(), m.external.String()
+}
+
+// Advertised 可告知注册中心的外部地址
+// 外部IP与注册中心看到的公网IP不一致时，路由器之外还有一层NAT（如运营商级NAT），映射无法从公网访问
+func (m *PortMapping) Advertised() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.external == nil || m.external.IP.String() != myPubNetIp {
+		return ""
+	}
+	return m.external.String()
+}
+
+// discoverPortMapper 依次尝试默认网关上的 PCP、NAT-PMP 和局域网内的 UPnP IGD，返回第一个可用的协议
+func discoverPortMapper() (PortMapper, error) {
+	gateway, err := defaultGateway()
+	if err != nil {
+		glog.Debugf("[NAT]获取默认网关失败：%v", err)
+	} else {
+		addr := &net.UDPAddr{IP: gateway, Port: pcpPort}
+		if mapper, err := newPCPMapper(addr); err == nil {
+			return mapper, nil
+		}
+		mapper := &natPMPMapper{gateway: addr}
+		if _, err := mapper.externalIP(); err == nil {
+			return mapper, nil
+		}
+	}
+	mapper, err := discoverUPnP(ssdpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("没有找到支持 PCP、NAT-PMP 或 UPnP 的网关")
+	}
+	return mapper, nil
+}
+
+// gatewayRequest 向网关发送请求并等待符合要求的回复
+// 按 RFC 6886 的建议从250ms开始逐次加倍超时时间，重试3次
+func gatewayRequest(gateway *net.UDPAddr, request []byte, accept func([]byte) bool) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	buf := make([]byte, 1100)
+	timeout := 250 * time.Millisecond
+	for try := 0; try < 3; try++ {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if accept(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+		timeout *= 2
+	}
+	return nil, fmt.Errorf("网关 %s 没有回复", gateway.String())
+}
+
+// localIPFor 本机访问指定地址时使用的源地址
+func localIPFor(addr *net.UDPAddr) (net.IP, error) {
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// natPMPMapper NAT-PMP（RFC 6886）
+type natPMPMapper struct {
+	gateway *net.UDPAddr
+}
+
+func (m *natPMPMapper) Name() string {
+	return "NAT-PMP"
+}
+
+// externalIP 查询网关的外部地址，NAT-PMP 的映射回复不包含外部地址
+func (m *natPMPMapper) externalIP() (net.IP, error) {
+	resp, err := gatewayRequest(m.gateway, []byte{0, 0}, func(b []byte) bool {
+		return len(b) >= 12 && b[0] == 0 && b[1] == 128
+	})
+	if err != nil {
+		return nil, err
+	}
+	if code := binary.BigEndian.Uint16(resp[2:4]); code != 0 {
+		return nil, fmt.Errorf("NAT-PMP 错误码 %d", code)
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]).To4(), nil
+}
+
+// request 发送UDP映射请求，有效期为0时删除映射
+func (m *natPMPMapper) request(internalPort int, externalPort int, lifetime time.Duration) (int, time.Duration, error) {
+	req := make([]byte, 12)
+	req[1] = 1 // 映射UDP端口
+	binary.BigEndian.PutUint16(req[4:6], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+	resp, err := gatewayRequest(m.gateway, req, func(b []byte) bool {
+		return len(b) >= 16 && b[0] == 0 && b[1] == 129 && int(binary.BigEndian.Uint16(b[8:10])) == internalPort
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if code := binary.BigEndian.Uint16(resp[2:4]); code != 0 {
+		return 0, 0, fmt.Errorf("NAT-PMP 错误码 %d", code)
+	}
+	return int(binary.BigEndian.Uint16(resp[10:12])), time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second, nil
+}
+
+func (m *natPMPMapper) AddMapping(internalPort int, externalPort int, lifetime time.Duration) (*net.UDPAddr, time.Duration, error) {
+	ip, err := m.externalIP()
+	if err != nil {
+		return nil, 0, err
+	}
+	port, granted, err := m.request(internalPort, externalPort, lifetime)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, granted, nil
+}
+
+func (m *natPMPMapper) DeleteMapping(internalPort int, _ int) error {
+	_, _, err := m.request(internalPort, 0, 0)
+	return err
+}
+
+// pcpMapper PCP（RFC 6887），NAT-PMP 的后续协议，使用相同的端口
+type pcpMapper struct {
+	gateway *net.UDPAddr
+	local   net.IP
+	nonce   [12]byte // 续期和删除映射时必须使用与创建时相同的随机数
+}
+
+// newPCPMapper 发送 ANNOUNCE 确认网关支持 PCP
+// 只支持 NAT-PMP 的网关以版本0回复“不支持的版本”，此时返回错误
+func newPCPMapper(gateway *net.UDPAddr) (*pcpMapper, error) {
+	local, err := localIPFor(gateway)
+	if err != nil {
+		return nil, err
+	}
+	m := &pcpMapper{gateway: gateway, local: local}
+	if _, err := rand.Read(m.nonce[:]); err != nil {
+		return nil, err
+	}
+	resp, err := gatewayRequest(gateway, m.header(0, 0), func(b []byte) bool {
+		return len(b) >= 4 && b[1] == 0x80
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp[0] != 2 {
+		return nil, fmt.Errorf("网关不支持 PCP")
+	}
+	return m, nil
+}
+
+func (m *pcpMapper) Name() string {
+	return "PCP"
+}
+
+// header PCP请求头：版本、操作码、有效期和本机地址（IPv4映射的IPv6形式）
+func (m *pcpMapper) header(opcode byte, lifetime time.Duration) []byte {
+	header := make([]byte, 24)
+	header[0] = 2
+	header[1] = opcode
+	binary.BigEndian.PutUint32(header[4:8], uint32(lifetime/time.Second))
+	copy(header[8:24], m.local.To16())
+	return header
+}
+
+// request 发送 MAP 请求，有效期为0时删除映射
+func (m *pcpMapper) request(internalPort int, externalPort int, lifetime time.Duration) (*net.UDPAddr, time.Duration, error) {
+	req := m.header(1, lifetime)
+	payload := make([]byte, 36)
+	copy(payload[0:12], m.nonce[:])
+	payload[12] = 17 // UDP
+	binary.BigEndian.PutUint16(payload[16:18], uint16(internalPort))
+	binary.BigEndian.PutUint16(payload[18:20], uint16(externalPort))
+	// 不指定外部地址时使用IPv4映射形式的全零地址
+	copy(payload[20:36], net.IPv4zero.To16())
+	req = append(req, payload...)
+	resp, err := gatewayRequest(m.gateway, req, func(b []byte) bool {
+		return len(b) >= 60 && b[0] == 2 && b[1] == 0x81 && string(b[24:36]) == string(m.nonce[:])
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if code := resp[3]; code != 0 {
+		return nil, 0, fmt.Errorf("PCP 错误码 %d", code)
+	}
+	addr := &net.UDPAddr{
+		IP:   net.IP(append([]byte(nil), resp[44:60]...)).To4(),
+		Port: int(binary.BigEndian.Uint16(resp[42:44])),
+	}
+	return addr, time.Duration(binary.BigEndian.Uint32(resp[4:8])) * time.Second, nil
+}
+
+func (m *pcpMapper) AddMapping(internalPort int, externalPort int, lifetime time.Duration) (*net.UDPAddr, time.Duration, error) {
+	addr, granted, err := m.request(internalPort, externalPort, lifetime)
+	if err == nil && addr.IP == nil {
+		err = fmt.Errorf("PCP 网关分配的外部地址不是IPv4地址")
+	}
+	return addr, granted, err
+}
+
+func (m *pcpMapper) DeleteMapping(internalPort int, _ int) error {
+	_, _, err := m.request(internalPort, 0, 0)
+	return err
+}
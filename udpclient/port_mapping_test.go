@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGateway 本机回环地址上的假网关，按 handle 的返回值回复请求，返回nil时不回复
+type fakeGateway struct {
+	conn     *net.UDPConn
+	mu       sync.Mutex
+	handle   func(req []byte) []byte
+	requests [][]byte
+}
+
+func newFakeGateway(t *testing.T, handle func(req []byte) []byte) *fakeGateway {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("监听假网关失败: %v", err)
+	}
+	g := &fakeGateway{conn: conn, handle: handle}
+	t.Cleanup(func() { conn.Close() })
+	go g.serve()
+	return g
+}
+
+func (g *fakeGateway) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, addr, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := append([]byte(nil), buf[:n]...)
+		g.mu.Lock()
+		g.requests = append(g.requests, req)
+		handle := g.handle
+		g.mu.Unlock()
+		if resp := handle(req); resp != nil {
+			g.conn.WriteToUDP(resp, addr)
+		}
+	}
+}
+
+func (g *fakeGateway) addr() *net.UDPAddr {
+	return g.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (g *fakeGateway) setHandle(handle func(req []byte) []byte) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.handle = handle
+}
+
+// lastRequest 最后一个操作码为 opcode 的请求
+func (g *fakeGateway) lastRequest(opcode byte) []byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i := len(g.requests) - 1; i >= 0; i-- {
+		if len(g.requests[i]) > 1 && g.requests[i][1] == opcode {
+			return g.requests[i]
+		}
+	}
+	return nil
+}
+
+var testExternalIP = net.IPv4(203, 0, 113, 7).To4()
+
+// pcpGateway PCP网关：ANNOUNCE 直接回复，MAP 以 result 作为结果码，分配 port 指定的外部端口
+func pcpGateway(result byte, lifetime uint32, port func(suggested int) int) func(req []byte) []byte {
+	return func(req []byte) []byte {
+		if len(req) < 24 || req[0] != 2 {
+			return nil
+		}
+		switch req[1] {
+		case 0:
+			resp := make([]byte, 24)
+			resp[0], resp[1] = 2, 0x80
+			return resp
+		case 1:
+			if len(req) < 60 {
+				return nil
+			}
+			resp := make([]byte, 60)
+			resp[0], resp[1], resp[3] = 2, 0x81, result
+			binary.BigEndian.PutUint32(resp[4:8], lifetime)
+			copy(resp[24:40], req[24:40]) // 随机数和协议
+			copy(resp[40:42], req[40:42])
+			suggested := int(binary.BigEndian.Uint16(req[42:44]))
+			binary.BigEndian.PutUint16(resp[42:44], uint16(port(suggested)))
+			copy(resp[44:60], testExternalIP.To16())
+			return resp
+		}
+		return nil
+	}
+}
+
+// natPMPGateway NAT-PMP网关：查询外部地址和映射分别以 addrCode 和 mapCode 作为结果码
+// 不支持PCP，对版本2的请求以“不支持的版本”回复
+func natPMPGateway(addrCode uint16, mapCode uint16, lifetime uint32, port func(suggested int) int) func(req []byte) []byte {
+	return func(req []byte) []byte {
+		if len(req) < 2 {
+			return nil
+		}
+		if req[0] != 0 {
+			resp := make([]byte, 8)
+			resp[1] = 128 + req[1]
+			binary.BigEndian.PutUint16(resp[2:4], 1)
+			return resp
+		}
+		switch req[1] {
+		case 0:
+			resp := make([]byte, 12)
+			resp[1] = 128
+			binary.BigEndian.PutUint16(resp[2:4], addrCode)
+			copy(resp[8:12], testExternalIP)
+			return resp
+		case 1:
+			if len(req) < 12 {
+				return nil
+			}
+			resp := make([]byte, 16)
+			resp[1] = 129
+			binary.BigEndian.PutUint16(resp[2:4], mapCode)
+			copy(resp[8:10], req[4:6])
+			suggested := int(binary.BigEndian.Uint16(req[6:8]))
+			if binary.BigEndian.Uint32(req[8:12]) == 0 {
+				// 删除映射
+				binary.BigEndian.PutUint16(resp[10:12], 0)
+			} else {
+				binary.BigEndian.PutUint16(resp[10:12], uint16(port(suggested)))
+				binary.BigEndian.PutUint32(resp[12:16], lifetime)
+			}
+			return resp
+		}
+		return nil
+	}
+}
+
+func samePort(suggested int) int {
+	return suggested
+}
+
+func TestPCPMapperAddAndDeleteMapping(t *testing.T) {
+	gateway := newFakeGateway(t, pcpGateway(0, 3600, func(int) int { return 40000 }))
+	mapper, err := newPCPMapper(gateway.addr())
+	if err != nil {
+		t.Fatalf("newPCPMapper: %v", err)
+	}
+
+	addr, lifetime, err := mapper.AddMapping(5000, 5000, portMappingLifetime)
+	if err != nil {
+		t.Fatalf("AddMapping: %v", err)
+	}
+	if addr.String() != "203.0.113.7:40000" || lifetime != time.Hour {
+		t.Fatalf("AddMapping = %v %v, want 203.0.113.7:40000 1h0m0s", addr, lifetime)
+	}
+	req := gateway.lastRequest(1)
+	if !bytes.Equal(req[24:36], mapper.nonce[:]) {
+		t.Fatal("MAP 请求的随机数与 mapper 不一致")
+	}
+	if got := binary.BigEndian.Uint32(req[4:8]); got != uint32(portMappingLifetime/time.Second) {
+		t.Fatalf("请求的有效期 = %d", got)
+	}
+	if req[36] != 17 || binary.BigEndian.Uint16(req[40:42]) != 5000 || binary.BigEndian.Uint16(req[42:44]) != 5000 {
+		t.Fatalf("MAP 请求的协议或端口错误: %v", req[36:44])
+	}
+
+	if err := mapper.DeleteMapping(5000, 40000); err != nil {
+		t.Fatalf("DeleteMapping: %v", err)
+	}
+	req = gateway.lastRequest(1)
+	if got := binary.BigEndian.Uint32(req[4:8]); got != 0 {
+		t.Fatalf("删除映射请求的有效期 = %d, want 0", got)
+	}
+	if !bytes.Equal(req[24:36], mapper.nonce[:]) {
+		t.Fatal("删除映射请求的随机数与创建时不一致")
+	}
+}
+
+func TestPCPMapperErrorResult(t *testing.T) {
+	// 2: NOT_AUTHORIZED
+	gateway := newFakeGateway(t, pcpGateway(2, 0, samePort))
+	mapper, err := newPCPMapper(gateway.addr())
+	if err != nil {
+		t.Fatalf("newPCPMapper: %v", err)
+	}
+	if _, _, err := mapper.AddMapping(5000, 5000, portMappingLifetime); err == nil || !strings.Contains(err.Error(), "PCP 错误码 2") {
+		t.Fatalf("AddMapping err = %v, want PCP 错误码 2", err)
+	}
+}
+
+func TestPCPMapperUnsupportedByNatPMPGateway(t *testing.T) {
+	gateway := newFakeGateway(t, natPMPGateway(0, 0, 3600, samePort))
+	if _, err := newPCPMapper(gateway.addr()); err == nil {
+		t.Fatal("只支持 NAT-PMP 的网关上 newPCPMapper 成功")
+	}
+}
+
+func TestNatPMPMapperAddAndDeleteMapping(t *testing.T) {
+	gateway := newFakeGateway(t, natPMPGateway(0, 0, 7200, func(suggested int) int { return suggested + 1 }))
+	mapper := &natPMPMapper{gateway: gateway.addr()}
+
+	addr, lifetime, err := mapper.AddMapping(5000, 6000, portMappingLifetime)
+	if err != nil {
+		t.Fatalf("AddMapping: %v", err)
+	}
+	if addr.String() != "203.0.113.7:6001" || lifetime != 2*time.Hour {
+		t.Fatalf("AddMapping = %v %v, want 203.0.113.7:6001 2h0m0s", addr, lifetime)
+	}
+	req := gateway.lastRequest(1)
+	if binary.BigEndian.Uint16(req[4:6]) != 5000 || binary.BigEndian.Uint16(req[6:8]) != 6000 {
+		t.Fatalf("映射请求的端口错误: %v", req[4:8])
+	}
+
+	if err := mapper.DeleteMapping(5000, 6001); err != nil {
+		t.Fatalf("DeleteMapping: %v", err)
+	}
+	req = gateway.lastRequest(1)
+	if binary.BigEndian.Uint16(req[6:8]) != 0 || binary.BigEndian.Uint32(req[8:12]) != 0 {
+		t.Fatalf("删除映射请求的外部端口或有效期不为0: %v", req[4:12])
+	}
+}
+
+func TestNatPMPMapperErrorResult(t *testing.T) {
+	// 2: NOT_AUTHORIZED，查询外部地址失败
+	gateway := newFakeGateway(t, natPMPGateway(2, 0, 3600, samePort))
+	mapper := &natPMPMapper{gateway: gateway.addr()}
+	if _, _, err := mapper.AddMapping(5000, 5000, portMappingLifetime); err == nil || !strings.Contains(err.Error(), "NAT-PMP 错误码 2") {
+		t.Fatalf("AddMapping err = %v, want NAT-PMP 错误码 2", err)
+	}
+
+	// 4: OUT_OF_RESOURCES，映射失败
+	gateway.setHandle(natPMPGateway(0, 4, 3600, samePort))
+	if _, _, err := mapper.AddMapping(5000, 5000, portMappingLifetime); err == nil || !strings.Contains(err.Error(), "NAT-PMP 错误码 4") {
+		t.Fatalf("AddMapping err = %v, want NAT-PMP 错误码 4", err)
+	}
+}
+
+// TestPortMappingRenew 续期以上次分配的外部端口作为建议值，并沿用创建映射时的随机数
+func TestPortMappingRenew(t *testing.T) {
+	var mu sync.Mutex
+	next := 40000
+	gateway := newFakeGateway(t, pcpGateway(0, 600, func(suggested int) int {
+		mu.Lock()
+		defer mu.Unlock()
+		if suggested == next {
+			return suggested
+		}
+		next++
+		return next
+	}))
+	mapper, err := newPCPMapper(gateway.addr())
+	if err != nil {
+		t.Fatalf("newPCPMapper: %v", err)
+	}
+	m := &PortMapping{mapper: mapper}
+
+	lifetime, err := m.renew(5000)
+	if err != nil {
+		t.Fatalf("首次申请映射: %v", err)
+	}
+	if lifetime != 10*time.Minute {
+		t.Fatalf("首次申请的有效期 = %v, want 10m0s", lifetime)
+	}
+	if name, external := m.Info(); name != "PCP" || external != "203.0.113.7:40001" {
+		t.Fatalf("Info = %q %q, want PCP 203.0.113.7:40001", name, external)
+	}
+	first := gateway.lastRequest(1)
+	if binary.BigEndian.Uint16(first[42:44]) != 5000 {
+		t.Fatalf("首次申请建议的外部端口 = %d, want 5000", binary.BigEndian.Uint16(first[42:44]))
+	}
+
+	if _, err := m.renew(5000); err != nil {
+		t.Fatalf("续期: %v", err)
+	}
+	second := gateway.lastRequest(1)
+	if binary.BigEndian.Uint16(second[42:44]) != 40001 {
+		t.Fatalf("续期建议的外部端口 = %d, want 40001", binary.BigEndian.Uint16(second[42:44]))
+	}
+	if !bytes.Equal(first[24:36], second[24:36]) {
+		t.Fatal("续期请求的随机数与创建时不一致")
+	}
+	if _, external := m.Info(); external != "203.0.113.7:40001" {
+		t.Fatalf("续期后外部地址 = %q, want 203.0.113.7:40001", external)
+	}
+
+	// 续期失败时清除映射，下次重新发现网关
+	gateway.setHandle(pcpGateway(8, 0, samePort))
+	if _, err := m.renew(5000); err == nil {
+		t.Fatal("网关返回错误码时续期成功")
+	}
+	if name, external := m.Info(); name != "" || external != "" {
+		t.Fatalf("续期失败后 Info = %q %q, want 空", name, external)
+	}
+}
+
+// TestPortMappingRenewDefaultLifetime 网关没有给出有效期时按请求的有效期续期
+func TestPortMappingRenewDefaultLifetime(t *testing.T) {
+	gateway := newFakeGateway(t, natPMPGateway(0, 0, 0, samePort))
+	m := &PortMapping{mapper: &natPMPMapper{gateway: gateway.addr()}}
+	lifetime, err := m.renew(5000)
+	if err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	if lifetime != portMappingLifetime {
+		t.Fatalf("有效期 = %v, want %v", lifetime, portMappingLifetime)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/venshao/natun/gjson"
+	"github.com/venshao/natun/glog"
+)
+
+// 打洞策略，配置为 auto 时根据双方的NAT类型自动选择
+const (
+	PunchAuto     = "auto"
+	PunchScan     = "scan"     // 在对方端口附近随机扫描，适用于锥形NAT
+	PunchDelta    = "delta"    // 按对方NAT的端口分配步长顺序预测，适用于顺序分配端口的对称型NAT
+	PunchBirthday = "birthday" // 生日攻击，用大量映射和探测包碰撞，适用于随机分配端口的对称型NAT
+)
+
+// 端口步长的绝对值超过该值时认为对称型NAT随机分配端口，无法顺序预测
+const maxSequentialDelta = 64
+
+// 生日攻击时锥形NAT一侧每轮向对方随机端口发送的探测包数量
+// 对方打开64个映射时，1024个探测包至少命中一个的概率约为64%
+const birthdayProbes = 1024
+
+// 生日攻击时对称型NAT一侧的套接字每秒发送一次心跳，持续的轮数需覆盖对方发送探测包的时间
+const birthdayRounds = 10
+
+// PunchTarget 打洞目标
+type PunchTarget struct {
+	peer      *Peer
+	ip        net.IP
+	port      int    // 注册中心看到的对方端口
+	natType   string // 对方的NAT类型
+	portDelta int    // 对方NAT的端口分配步长
+	// 直连候选地址：对方上报的IPv6地址（本机有IPv6时）和路由器映射的外部地址
+	candidates []*net.UDPAddr
+}
+
+// parsePunchTarget 解析注册中心下发的对方地址信息，对方IP无效时返回false
+func parsePunchTarget(p *Peer, json *gjson.Json) (*PunchTarget, bool) {
+	ip := net.ParseIP(json.GetString("ip"))
+	if ip == nil || ip.IsUnspecified() {
+		return nil, false
+	}
+	target := &PunchTarget{
+		peer:      p,
+		ip:        ip,
+		port:      json.GetInt("port"),
+		natType:   json.GetString("natType"),
+		portDelta: json.GetInt("portDelta"),
+	}
+	if hasIPv6() {
+		for _, value := range json.GetStrings("ip6") {
+			if candidate, err := net.ResolveUDPAddr("udp", value); err == nil && candidate.IP.To4() == nil {
+				target.candidates = append(target.candidates, candidate)
+			}
+		}
+	}
+	if mapped, err := net.ResolveUDPAddr("udp", json.GetString("mapped")); err == nil && mapped.IP.To4() != nil && mapped.Port != 0 {
+		target.candidates = append(target.candidates, mapped)
+	}
+	return target, true
+}
+
+// active 对等节点在打洞期间被断开（如被新的连接请求替换）时返回false
+func (t *PunchTarget) active() bool {
+	return GetConnectionManager().GetPeer(t.peer.clientId) == t.peer
+}
+
+// pending 打洞是否需要继续，中转模式下重新打洞时直到切换为直连
+func (t *PunchTarget) pending() bool {
+	return !t.peer.IsDirectMode() && t.active()
+}
+
+// punchCandidates 先向候选地址打洞，返回是否已直连
+// IPv6通常没有NAT，路由器映射的端口也允许入站，均无需端口预测
+func punchCandidates(conn *net.UDPConn, target *PunchTarget) bool {
+	if len(target.candidates) == 0 {
+		return false
+	}
+	for tryCount := 0; tryCount < 5 && target.pending(); tryCount++ {
+		for _, candidate := range target.candidates {
+			beatPeer(conn, target.peer, candidate)
+		}
+		time.Sleep(time.Millisecond * 300)
+	}
+	if target.peer.IsDirectMode() {
+		glog.Infof("[INNER]与 %s 通过候选地址 %s 直连成功", target.peer.clientId, target.peer.GetAddr())
+		return true
+	}
+	glog.Debugf("[INNER]与 %s 的候选地址直连未成功，继续IPv4打洞", target.peer.clientId)
+	return false
+}
+
+// repunch 中转模式下重新打洞，对方的心跳到达后 beatHandler 将连接切换为直连
+func repunch(conn *net.UDPConn, target *PunchTarget) {
+	p := target.peer
+	if !p.beginRepunch() {
+		return
+	}
+	defer p.endRepunch()
+	if punchCandidates(conn, target) {
+		return
+	}
+	strategy := selectPunchStrategy(target)
+	glog.Debugf("[NAT]与 %s 处于中转模式，使用 %s 策略重新打洞", p.clientId, strategy)
+	punchStrategies[strategy].Punch(conn, target)
+}
+
+// repunchHandler 注册中心向双方同时下发对方的最新地址，中转模式下双方同时重新打洞
+func repunchHandler(conn *net.UDPConn, _ *net.UDPAddr, _ string, json *gjson.Json) {
+	p := GetConnectionManager().GetPeer(json.GetString("clientId"))
+	if p == nil || !p.IsRelayMode() {
+		return
+	}
+	target, ok := parsePunchTarget(p, json)
+	if !ok {
+		return
+	}
+	p.SetLeasedVip(json.GetString("vip"))
+	go repunch(conn, target)
+}
+
+// predictPort 预测对方为本机分配的第k个新映射的端口
+// 顺序分配端口的对称型NAT为新的目的地址依次分配端口，对方向本机发包使用的端口约为注册中心看到的端口加上k倍步长；
+// 锥形NAT的映射与目的地址无关，注册中心看到的端口就是对方向本机发包使用的端口
+func (t *PunchTarget) predictPort(k int) int {
+	if t.natType != NatSym || isRandomAllocation(t.natType, t.portDelta) {
+		return t.port
+	}
+	port := t.port + k*t.portDelta
+	if port < 1 || port > 65535 {
+		return t.port
+	}
+	return port
+}
+
+// PunchStrategy 打洞策略，Punch 在打通、对等节点被断开或尝试结束后返回
+type PunchStrategy interface {
+	Punch(conn *net.UDPConn, target *PunchTarget)
+}
+
+var punchStrategies = map[string]PunchStrategy{
+	PunchScan:     scanStrategy{},
+	PunchDelta:    deltaStrategy{},
+	PunchBirthday: birthdayStrategy{},
+}
+
+// isRandomAllocation 是否为随机分配端口的对称型NAT，步长为0或过大时无法顺序预测
+func isRandomAllocation(natType string, delta int) bool {
+	return natType == NatSym && (delta == 0 || delta > maxSequentialDelta || delta < -maxSequentialDelta)
+}
+
+// selectPunchStrategy 选择打洞策略，双方按相同的规则自动选择，保证一方使用生日攻击时另一方也使用生日攻击
+func selectPunchStrategy(target *PunchTarget) string {
+	name := GetConfig().PunchHole.Strategy
+	if name != PunchAuto {
+		return name
+	}
+	self := natDetector.GetNatInfo()
+	switch {
+	case isRandomAllocation(self.Type, self.PortDelta) || isRandomAllocation(target.natType, target.portDelta):
+		return PunchBirthday
+	case target.natType == NatSym:
+		return PunchDelta
+	default:
+		return PunchScan
+	}
+}
+
+// scanStrategy 在对方端口附近随机扫描，每轮最先探测预测的端口
+type scanStrategy struct{}
+
+func (scanStrategy) Punch(conn *net.UDPConn, target *PunchTarget) {
+	cfg := GetConfig().PunchHole
+	predicted := target.predictPort(1)
+
+	// 计算有效端口范围
+	startPort := predicted + cfg.BasePortOffset
+	if startPort < 1 {
+		startPort = 1
+	}
+	endPort := startPort + cfg.PortRange
+	if endPort > 65535 {
+		endPort = 65535
+	}
+	ports := make([]int, endPort-startPort)
+	for i := startPort; i < endPort; i++ {
+		ports[i-startPort] = i
+	}
+
+	primePorts(conn, target, ports)
+	// 不断尝试预测端口
+	for tryCount := 0; tryCount < 3 && target.pending(); tryCount++ {
+		rand.Shuffle(len(ports), func(i, j int) {
+			ports[i], ports[j] = ports[j], ports[i]
+		})
+		// 预测的端口命中率最高，每轮最先探测
+		for i, port := range ports {
+			if port == predicted {
+				ports[0], ports[i] = ports[i], ports[0]
+				break
+			}
+		}
+		sprayPorts(conn, target, ports)
+		time.Sleep(time.Second * 1)
+	}
+}
+
+// deltaStrategy 顺序预测，对方NAT在注册中心看到的端口之后按步长为新的目的地址分配端口，
+// 期间对方的其他连接也可能占用端口，因此按顺序探测多个步长
+type deltaStrategy struct{}
+
+func (deltaStrategy) Punch(conn *net.UDPConn, target *PunchTarget) {
+	cfg := GetConfig().PunchHole
+	seen := make(map[int]bool)
+	var ports []int
+	for k := 1; k <= cfg.PortRange; k++ {
+		if port := target.predictPort(k); !seen[port] {
+			seen[port] = true
+			ports = append(ports, port)
+		}
+	}
+
+	primePorts(conn, target, ports)
+	for tryCount := 0; tryCount < 3 && target.pending(); tryCount++ {
+		sprayPorts(conn, target, ports)
+		time.Sleep(time.Second * 1)
+	}
+}
+
+// birthdayStrategy 生日攻击：本机为对称型NAT时打开多个本地套接字，每个套接字在本机NAT上产生一个新的映射；
+// 本机为锥形NAT时向对方的随机端口发送大量探测包，任意一个探测包命中对方的映射即可打通
+type birthdayStrategy struct{}
+
+func (birthdayStrategy) Punch(conn *net.UDPConn, target *PunchTarget) {
+	if natDetector.GetNatInfo().Type == NatSym {
+		punchWithSockets(target)
+	} else {
+		punchRandomPorts(conn, target)
+	}
+}
+
+// punchWithSockets 打开多个本地套接字分别向对方发送心跳，打通的套接字留给该对等节点使用，其余关闭
+func punchWithSockets(target *PunchTarget) {
+	count := GetConfig().PunchHole.BirthdaySockets
+	sockets := make([]*net.UDPConn, 0, count)
+	for i := 0; i < count; i++ {
+		sock, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			glog.Warningf("[NAT]打开生日攻击套接字失败：%v", err)
+			break
+		}
+		sockets = append(sockets, sock)
+		go natConnection.serve(sock)
+	}
+	glog.Infof("[NAT]与 %s 打洞打开了 %d 个本地套接字", target.peer.clientId, len(sockets))
+
+	// 对方为随机分配端口的对称型NAT时无法预测端口，每个套接字探测一个随机端口
+	ports := make([]int, len(sockets))
+	for i := range ports {
+		ports[i] = target.predictPort(1)
+		if isRandomAllocation(target.natType, target.portDelta) {
+			ports[i] = randomPort()
+		}
+	}
+	for i, sock := range sockets {
+		primePorts(sock, target, ports[i:i+1])
+	}
+	for round := 0; round < birthdayRounds && target.pending(); round++ {
+		for i, sock := range sockets {
+			if !target.pending() {
+				break
+			}
+			beatPeer(sock, target.peer, &net.UDPAddr{IP: target.ip, Port: ports[i]})
+		}
+		time.Sleep(time.Second * 1)
+	}
+
+	winner := target.peer.GetConn()
+	for _, sock := range sockets {
+		if sock != winner {
+			sock.Close()
+		}
+	}
+}
+
+// punchRandomPorts 向对方的随机端口发送大量探测包，每轮先探测预测的端口
+func punchRandomPorts(conn *net.UDPConn, target *PunchTarget) {
+	for tryCount := 0; tryCount < 3 && target.pending(); tryCount++ {
+		beatPeer(conn, target.peer, &net.UDPAddr{IP: target.ip, Port: target.predictPort(1)})
+		for i := 0; i < birthdayProbes && target.pending(); i++ {
+			beatPeer(conn, target.peer, &net.UDPAddr{IP: target.ip, Port: randomPort()})
+			time.Sleep(time.Millisecond * 2)
+		}
+		time.Sleep(time.Second * 1)
+	}
+}
+
+// randomPort NAT通常不分配1024以下的端口
+func randomPort() int {
+	return 1024 + rand.Intn(65536-1024)
+}
+
+// sprayPorts 以配置的并发数向对方的一组端口发送心跳，打通或对等节点被断开时停止
+func sprayPorts(conn *net.UDPConn, target *PunchTarget, ports []int) {
+	sem := make(chan struct{}, GetConfig().PunchHole.MaxConcurrency)
+	for _, port := range ports {
+		if !target.pending() {
+			break
+		}
+		// 不要向自己打洞
+		if myPubNetPort == port && target.ip.String() == myPubNetIp {
+			continue
+		}
+		sem <- struct{}{}
+		go func(port int) {
+			defer func() { <-sem }()
+			beatPeer(conn, target.peer, &net.UDPAddr{IP: target.ip, Port: port})
+			// 随机间隔避免洪水攻击
+			time.Sleep(time.Duration(10+rand.Intn(50)) * time.Millisecond)
+		}(port)
+	}
+	// 等待本轮的发送协程结束
+	for i := 0; i < cap(sem); i++ {
+		sem <- struct{}{}
+	}
+}
+
+// primePorts 以较小的TTL向对方的端口发送预热报文
+// 预热报文在本机NAT上建立映射和放行规则，但在到达对方NAT之前被丢弃，
+// 避免对方NAT因收到未经请求的报文而回复ICMP错误或将本机地址列入黑名单
+// 主套接字上已有连通的对等节点时不预热，以免修改TTL影响其他连接的报文
+func primePorts(conn *net.UDPConn, target *PunchTarget, ports []int) {
+	ttl := GetConfig().PunchHole.PrimingTTL
+	if ttl <= 0 || target.ip.To4() == nil {
+		return
+	}
+	if conn == natConnection.listen && GetConnectionManager().AlivePeerCount() > 0 {
+		return
+	}
+	saved, err := setSocketTTL(conn, ttl)
+	if err != nil {
+		glog.Debugf("[NAT]设置预热报文的TTL失败：%v", err)
+		return
+	}
+	for _, port := range ports {
+		beatPeer(conn, target.peer, &net.UDPAddr{IP: target.ip, Port: port})
+	}
+	if err := restoreSocketTTL(conn, saved); err != nil {
+		glog.Warningf("[NAT]恢复套接字的TTL失败：%v", err)
+	}
+	glog.Debugf("[NAT]已向 %s 的 %d 个端口发送TTL=%d的预热报文", target.peer.clientId, len(ports), ttl)
+}
+
+// ttlOption 控制发出报文TTL的套接字选项
+type ttlOption struct {
+	level int
+	name  int
+}
+
+// 双栈套接字发往IPv4地址时，Linux 使用 IP_TTL，macOS 使用 IPV6_UNICAST_HOPS，因此两者都设置
+var ttlOptions = []ttlOption{
+	{syscall.IPPROTO_IP, syscall.IP_TTL},
+	{syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS},
+}
+
+// socketTTL 修改前各选项原来的值，只包含设置成功的选项
+type socketTTL map[ttlOption]int
+
+// setSocketTTL 设置套接字发出报文的TTL，返回各选项原来的值
+// 两个选项的默认值可能不同，恢复时须逐个恢复
+func setSocketTTL(conn *net.UDPConn, ttl int) (socketTTL, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	saved := make(socketTTL)
+	err = raw.Control(func(fd uintptr) {
+		for _, opt := range ttlOptions {
+			value, err := syscall.GetsockoptInt(sockFd(fd), opt.level, opt.name)
+			if err != nil || syscall.SetsockoptInt(sockFd(fd), opt.level, opt.name, ttl) != nil {
+				continue
+			}
+			saved[opt] = value
+		}
+	})
+	if err == nil && len(saved) == 0 {
+		err = fmt.Errorf("套接字不支持设置TTL")
+	}
+	return saved, err
+}
+
+// restoreSocketTTL 将 setSocketTTL 修改过的选项恢复为原来的值
+func restoreSocketTTL(conn *net.UDPConn, saved socketTTL) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var setErr error
+	err = raw.Control(func(fd uintptr) {
+		for opt, value := range saved {
+			if err := syscall.SetsockoptInt(sockFd(fd), opt.level, opt.name, value); err != nil && setErr == nil {
+				setErr = err
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return setErr
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func getSocketOption(t *testing.T, conn *net.UDPConn, opt ttlOption) int {
+	t.Helper()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn: %v", err)
+	}
+	var value int
+	var getErr error
+	if err := raw.Control(func(fd uintptr) {
+		value, getErr = syscall.GetsockoptInt(sockFd(fd), opt.level, opt.name)
+	}); err != nil {
+		t.Fatalf("Control: %v", err)
+	}
+	if getErr != nil {
+		t.Skipf("套接字不支持选项 %v: %v", opt, getErr)
+	}
+	return value
+}
+
+// TestSocketTTLRestoresEachOption 两个TTL选项的原值不同时分别恢复
+func TestSocketTTLRestoresEachOption(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6unspecified})
+	if err != nil {
+		t.Skipf("不支持双栈套接字: %v", err)
+	}
+	defer conn.Close()
+
+	hops := ttlOptions[1]
+	// 使两个选项的值不同
+	raw, _ := conn.SyscallConn()
+	raw.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(sockFd(fd), ttlOptions[0].level, ttlOptions[0].name, 64)
+		syscall.SetsockoptInt(sockFd(fd), hops.level, hops.name, 17)
+	})
+	before := map[ttlOption]int{}
+	for _, opt := range ttlOptions {
+		before[opt] = getSocketOption(t, conn, opt)
+	}
+	if before[ttlOptions[0]] == before[hops] {
+		t.Skip("无法使两个选项的值不同")
+	}
+
+	saved, err := setSocketTTL(conn, 3)
+	if err != nil {
+		t.Fatalf("setSocketTTL: %v", err)
+	}
+	for _, opt := range ttlOptions {
+		if got := getSocketOption(t, conn, opt); got != 3 {
+			t.Fatalf("设置后选项 %v = %d, want 3", opt, got)
+		}
+	}
+	if err := restoreSocketTTL(conn, saved); err != nil {
+		t.Fatalf("restoreSocketTTL: %v", err)
+	}
+	for _, opt := range ttlOptions {
+		if got := getSocketOption(t, conn, opt); got != before[opt] {
+			t.Fatalf("恢复后选项 %v = %d, want %d", opt, got, before[opt])
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/venshao/natun/glog"
+)
+
+// 网络变化（如Wi-Fi与移动网络切换、DHCP续租更换地址）后本机的公网地址随之改变，
+// 注册中心会通知对等节点断开；注册中心长时间收不到本机的ping时同样会移除本机并通知对等节点断开。
+// 本机据此重新注册，并自动恢复之前由本机发起的会话
+const (
+	netWatchInterval     = 3 * time.Second  // 检查本机网卡地址和注册中心可达性的间隔
+	underlayTimeout      = 10 * time.Second // 超过该时间没有收到pong认为底层网络不可用
+	registryTimeout      = 30 * time.Second // 注册中心超过该时间未收到ping会移除本机，与注册中心的离线判定一致
+	reconnectMinDelay    = 2 * time.Second
+	reconnectMaxDelay    = 60 * time.Second
+	reconnectMaxAttempts = 10
+)
+
+// NetWatcher 监视本机网卡地址、公网地址和注册中心的可达性
+type NetWatcher struct {
+	mu           sync.Mutex
+	addrs        string    // 本机网卡地址快照
+	lastPong     time.Time // 最近一次收到pong的时间
+	localPort    int       // 收到上一次pong的本地端口
+	pubAddr      string    // 上一次pong中注册中心看到的本机地址
+	underlayDown bool
+}
+
+var netWatcher = &NetWatcher{}
+
+// Start 启动网卡地址和注册中心可达性的检查
+func (w *NetWatcher) Start() {
+	w.mu.Lock()
+	w.addrs = interfaceSnapshot()
+	w.mu.Unlock()
+	go func() {
+		ticker := time.NewTicker(netWatchInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			w.check()
+		}
+	}()
+}
+
+func (w *NetWatcher) check() {
+	addrs := interfaceSnapshot()
+	w.mu.Lock()
+	addrsChanged := addrs != w.addrs
+	w.addrs = addrs
+	down := !w.lastPong.IsZero() && !w.underlayDown && time.Since(w.lastPong) > underlayTimeout
+	if down {
+		w.underlayDown = true
+	}
+	w.mu.Unlock()
+
+	if addrsChanged {
+		glog.Infof("[NET]本机网卡地址发生变化，重新向注册中心注册")
+		onLocalNetworkChange()
+	}
+	if down {
+		glog.Warningf("[NET]超过%d秒没有收到注册中心的响应，底层网络可能不可用", int(underlayTimeout/time.Second))
+	}
+}
+
+// Registered 最近是否收到过注册中心的pong
+func (w *NetWatcher) Registered() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return !w.lastPong.IsZero() && time.Since(w.lastPong) <= underlayTimeout
+}
+
+// OnPong 比较注册中心看到的本机地址，同一本地端口的公网地址改变或本机已被注册中心移除时恢复会话
+// 本机为打洞更换端口后公网地址也会改变，此时本地端口不同，不视为网络变化
+func (w *NetWatcher) OnPong(conn *net.UDPConn, pubAddr string) {
+	localPort := conn.LocalAddr().(*net.UDPAddr).Port
+	w.mu.Lock()
+	gap := time.Since(w.lastPong)
+	changed := w.pubAddr != "" && w.localPort == localPort && w.pubAddr != pubAddr
+	expired := !w.lastPong.IsZero() && gap > registryTimeout
+	recovered := w.underlayDown
+	w.lastPong = time.Now()
+	w.localPort = localPort
+	w.pubAddr = pubAddr
+	w.underlayDown = false
+	w.mu.Unlock()
+
+	switch {
+	case changed:
+		recoverSessions(fmt.Sprintf("本机公网地址变为 %s", pubAddr))
+	case expired:
+		recoverSessions(fmt.Sprintf("注册中心%d秒没有收到本机的心跳", int(gap/time.Second)))
+	case recovered:
+		glog.Infof("[NET]与注册中心的连接已恢复")
+	}
+}
+
+// interfaceSnapshot 本机网卡地址的快照，虚拟网段的地址不计入
+func interfaceSnapshot() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	var values []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() || inOverlay(ipNet.IP) {
+			continue
+		}
+		values = append(values, ipNet.String())
+	}
+	sort.Strings(values)
+	return strings.Join(values, ",")
+}
+
+// onLocalNetworkChange 网卡地址变化后立即发送ping，之前的NAT类型和路由器端口映射可能已经失效
+// 公网地址是否改变以注册中心的pong为准，地址不变时已有的会话保持不变
+func onLocalNetworkChange() {
+	natDetector.Invalidate()
+	natConnection.pingNow()
+	go portMapping.Start(natConnection.listen.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// recoverSessions 注册中心已通知对等节点断开，关闭本机的全部会话，
+// 本机发起的会话使用原密码自动重连，对方发起的会话由对方重连
+func recoverSessions(reason string) {
+	cm := GetConnectionManager()
+	peers := cm.GetPeers()
+	if len(peers) == 0 {
+		return
+	}
+	glog.Warningf("[NET]%s，恢复与对等节点的会话", reason)
+	for _, p := range peers {
+		alive := p.IsAlive()
+		closePeer(p)
+		if alive {
+			reconnector.Schedule(p.clientId)
+		}
+	}
+	cm.SetConnecting(false, "网络已变化，等待重新连接")
+}
+
+// Reconnector 按退避间隔自动重连断开的对等节点
+type Reconnector struct {
+	mu      sync.Mutex
+	pending map[string]context.CancelFunc // 客户端ID -> 取消自动重连
+}
+
+var reconnector = &Reconnector{pending: make(map[string]context.CancelFunc)}
+
+// Schedule 开始自动重连对等节点，只有本机主动连接过（保存了对方密码）的节点才能自动重连
+func (r *Reconnector) Schedule(peerId string) {
+	if !GetConfig().AutoReconnect {
+		return
+	}
+	if _, ok := GetConnectionManager().GetCredential(peerId); !ok {
+		glog.Debugf("[NET]没有 %s 的连接密码，等待对方重新连接", peerId)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.pending[peerId]; exists {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.pending[peerId] = cancel
+	go r.run(ctx, peerId)
+}
+
+// Cancel 取消对等节点的自动重连，用户主动连接、断开或重新连接时调用
+func (r *Reconnector) Cancel(peerId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cancel, exists := r.pending[peerId]; exists {
+		cancel()
+		delete(r.pending, peerId)
+	}
+}
+
+func (r *Reconnector) run(ctx context.Context, peerId string) {
+	defer func() {
+		// 被取消时记录已由 Cancel 删除，之后可能已有新的自动重连
+		if ctx.Err() == nil {
+			r.Cancel(peerId)
+		}
+	}()
+	delay := reconnectMinDelay
+	for attempt := 1; attempt <= reconnectMaxAttempts; attempt++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+		if p := GetConnectionManager().GetPeer(peerId); p != nil && p.IsAlive() {
+			// 对方已先连上本机
+			return
+		}
+		if !netWatcher.Registered() {
+			glog.Debugf("[NET]尚未重新注册到注册中心，推迟重连 %s", peerId)
+			continue
+		}
+		glog.Infof("[NET]第%d次自动重连 %s", attempt, peerId)
+		if err := requestReconnectPeer(peerId); err != nil {
+			glog.Warningf("[NET]自动重连 %s 失败：%v", peerId, err)
+			continue
+		}
+		if r.waitAlive(ctx, peerId) {
+			glog.Infof("[NET]已自动重连 %s", peerId)
+			return
+		}
+	}
+	glog.Warningf("[NET]自动重连 %s 失败%d次，放弃", peerId, reconnectMaxAttempts)
+}
+
+// waitAlive 等待打洞或中转完成，最长为打洞超时加上中转建立的时间
+func (r *Reconnector) waitAlive(ctx context.Context, peerId string) bool {
+	deadline := time.Now().Add(time.Duration(GetConfig().PunchHole.PunchTimeout)*time.Second + 15*time.Second)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+		if p := GetConnectionManager().GetPeer(peerId); p != nil && p.IsAlive() {
+			return true
+		}
+	}
+	return false
+}
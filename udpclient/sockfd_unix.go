@@ -0,0 +1,7 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+// sockFd 套接字描述符，syscall 的套接字选项函数在各平台上的参数类型不同
+type sockFd = int
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "syscall"
+
+// sockFd 套接字句柄，syscall 的套接字选项函数在各平台上的参数类型不同
+type sockFd = syscall.Handle
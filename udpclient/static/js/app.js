@@ -3,6 +3,8 @@ const {createApp} = Vue;
 // 应用配置
 const APP_CONFIG = {
     POLLING_INTERVAL: 1000,
+    // 事件流连接时状态由服务端推送，轮询只用于刷新失败尝试等其他信息
+    STREAM_POLLING_INTERVAL: 10000,
     CONNECT_TIMEOUT: 8000,
     MAX_RECENT_DEVICES: 3
 };
@@ -27,37 +29,99 @@ const utils = {
     
     formatTime(timestamp) {
         return new Date(timestamp).toLocaleString();
+    },
+    
+    formatBytes(bytes) {
+        const units = ['B', 'KB', 'MB', 'GB'];
+        let value = bytes || 0;
+        let i = 0;
+        while (value >= 1024 && i < units.length - 1) {
+            value /= 1024;
+            i++;
+        }
+        return (i === 0 ? value : value.toFixed(1)) + units[i];
     }
 };
 
 // API服务
 const apiService = {
-    async fetchLocalDevice() {
-        const response = await fetch('/api/device');
-        return response.ok ? await response.json() : null;
-    },
+    // 登录后下发的CSRF令牌，POST请求需要在请求头中携带
+    csrfToken: '',
+    // 会话失效（接口返回401）时的回调
+    onUnauthorized: null,
     
-    async fetchPeerStatus() {
-        const response = await fetch('/api/peerStatus');
+    async get(url) {
+        const response = await fetch(url);
+        if (response.status === 401 && this.onUnauthorized) {
+            this.onUnauthorized();
+        }
         return response.ok ? await response.json() : null;
     },
     
-    async connectPeer(targetId, targetPwd) {
-        const response = await fetch('/api/connect', {
+    async post(url, data) {
+        const response = await fetch(url, {
             method: 'POST',
-            headers: {'Content-Type': 'application/json'},
-            body: JSON.stringify({ targetId, targetPwd })
+            headers: {'Content-Type': 'application/json', 'X-CSRF-Token': this.csrfToken},
+            body: JSON.stringify(data)
         });
+        if (response.status === 401 && this.onUnauthorized) {
+            this.onUnauthorized();
+        }
         return await response.json();
     },
     
-    async resetPassword(newPassword) {
-        const response = await fetch('/api/resetPassword', {
+    async fetchSession() {
+        const response = await fetch('/api/session');
+        return response.ok ? await response.json() : null;
+    },
+    
+    async login(token) {
+        const response = await fetch('/api/login', {
             method: 'POST',
             headers: {'Content-Type': 'application/json'},
-            body: JSON.stringify({ newPassword })
+            body: JSON.stringify({ token })
         });
         return await response.json();
+    },
+    
+    async logout() {
+        return await this.post('/api/logout', {});
+    },
+    
+    async fetchLocalDevice() {
+        return await this.get('/api/device');
+    },
+    
+    async fetchPassword() {
+        return await this.get('/api/password');
+    },
+    
+    async fetchPeerStatus() {
+        return await this.get('/api/peerStatus');
+    },
+    
+    async connectPeer(targetId, targetPwd) {
+        return await this.post('/api/connect', { targetId, targetPwd });
+    },
+    
+    async disconnectPeer(targetId) {
+        return await this.post('/api/disconnect', { targetId });
+    },
+    
+    async reconnectPeer(targetId) {
+        return await this.post('/api/reconnect', { targetId });
+    },
+    
+    async resetStats(targetId) {
+        return await this.post('/api/stats/reset', { targetId });
+    },
+    
+    async fetchFailedAttempts() {
+        return await this.get('/api/failedAttempts');
+    },
+    
+    async resetPassword(newPassword) {
+        return await this.post('/api/resetPassword', { newPassword });
     }
 };
 
@@ -99,15 +163,13 @@ createApp({
             localDevice: {
                 clientId: '加载中...',
                 IP: '0.0.0.0',
-                natType: '未知',
-                password: ''
-            },
-            peerDevice: {
-                clientId: '等待连接',
-                IP: '0.0.0.0',
-                alive: false,
-                latency: '-'
+                natType: '未知'
             },
+            // 本机连接密码，默认隐藏，需要时单独获取
+            localPassword: '',
+            passwordVisible: false,
+            // 全部对等节点（可同时连接多个设备）
+            peers: [],
             connectionInfo: {
                 mode: '断开状态',
                 modeCode: 2,
@@ -133,9 +195,23 @@ createApp({
             passwordErrorMessage: '',
             isResetting: false,
             
+            // 登录状态
+            authChecked: false,
+            needLogin: false,
+            loginToken: '',
+            loginError: '',
+            isLoggingIn: false,
+            
             // 最近设备
             recentDevices: [],
             
+            // 针对本机的失败连接尝试
+            failedAttempts: [],
+            
+            // 事件流推送的各对等节点流量
+            peerTraffic: {},
+            eventSource: null,
+            
             // 复制状态
             copyStatus: {
                 id: '点击复制',
@@ -149,6 +225,104 @@ createApp({
     },
     
     methods: {
+        // 登录管理
+        async checkSession() {
+            try {
+                const session = await apiService.fetchSession();
+                if (session && session.authenticated) {
+                    apiService.csrfToken = session.csrfToken;
+                    this.startDashboard();
+                } else {
+                    this.needLogin = true;
+                }
+            } catch (e) {
+                console.error(e);
+                this.needLogin = true;
+            } finally {
+                this.authChecked = true;
+            }
+        },
+        
+        async login() {
+            if (!this.loginToken || this.isLoggingIn) return;
+            this.isLoggingIn = true;
+            this.loginError = '';
+            try {
+                const result = await apiService.login(this.loginToken.trim());
+                if (result.code === 0) {
+                    apiService.csrfToken = result.csrfToken;
+                    this.loginToken = '';
+                    this.needLogin = false;
+                    this.startDashboard();
+                } else {
+                    this.loginError = result.message || '登录失败';
+                }
+            } catch (e) {
+                console.error(e);
+                this.loginError = '登录失败，请检查程序是否正在运行';
+            } finally {
+                this.isLoggingIn = false;
+            }
+        },
+        
+        async logout() {
+            try {
+                await apiService.logout();
+            } catch (e) {
+                console.error(e);
+            }
+            this.handleUnauthorized();
+        },
+        
+        // 会话失效时停止轮询并显示登录框
+        handleUnauthorized() {
+            if (this.peerStatusInterval) {
+                clearInterval(this.peerStatusInterval);
+                this.peerStatusInterval = null;
+            }
+            this.closeEventStream();
+            apiService.csrfToken = '';
+            this.localPassword = '';
+            this.passwordVisible = false;
+            this.needLogin = true;
+        },
+        
+        startDashboard() {
+            this.fetchLocalDevice();
+            this.fetchPeerStatus();
+            this.openEventStream();
+        },
+        
+        // 订阅事件流，连接状态变化时立即刷新，延迟和流量直接更新
+        // 事件流断开期间恢复为每秒轮询，EventSource 会自动重连
+        openEventStream() {
+            if (!window.EventSource || this.eventSource) return;
+            const source = new EventSource('/api/events');
+            source.onopen = () => this.fetchPeerStatus(APP_CONFIG.STREAM_POLLING_INTERVAL);
+            source.onerror = () => this.fetchPeerStatus(APP_CONFIG.POLLING_INTERVAL);
+            source.addEventListener('snapshot', e => this.applyPeerStatus(JSON.parse(e.data)));
+            source.addEventListener('state', () => this.refreshPeerStatus());
+            source.addEventListener('latency', e => {
+                const event = JSON.parse(e.data);
+                const peer = this.peers.find(p => p.clientId === event.peerId);
+                if (peer) {
+                    peer.latency = event.latency;
+                }
+            });
+            source.addEventListener('traffic', e => {
+                const event = JSON.parse(e.data);
+                this.peerTraffic = { ...this.peerTraffic, [event.peerId]: event };
+            });
+            this.eventSource = source;
+        },
+        
+        closeEventStream() {
+            if (this.eventSource) {
+                this.eventSource.close();
+                this.eventSource = null;
+            }
+        },
+        
         // 设备管理
         async fetchLocalDevice() {
             const device = await apiService.fetchLocalDevice();
@@ -157,6 +331,23 @@ createApp({
             }
         },
         
+        async loadPassword() {
+            if (!this.localPassword) {
+                const result = await apiService.fetchPassword();
+                if (result && result.code === 0) {
+                    this.localPassword = result.password;
+                }
+            }
+            return this.localPassword;
+        },
+        
+        async togglePassword() {
+            if (!this.passwordVisible) {
+                await this.loadPassword();
+            }
+            this.passwordVisible = !this.passwordVisible;
+        },
+        
         // 连接管理
         showConnectPasswordModal() {
             if (!this.targetId || this.targetId.length !== 8) {
@@ -201,38 +392,103 @@ createApp({
             }
         },
         
+        // 断开与对等节点的连接
+        async disconnectPeer(peer) {
+            if (!confirm(`确定要断开与 ${peer.clientId} 的连接吗？`)) {
+                return;
+            }
+            try {
+                const result = await apiService.disconnectPeer(peer.clientId);
+                if (result.code !== 0) {
+                    alert(result.message || '断开连接失败');
+                }
+            } catch (e) {
+                console.error(e);
+                alert('操作失败，请检查程序是否正在运行');
+            }
+        },
+        
+        // 清零对等节点的流量统计
+        async resetPeerStats(peer) {
+            try {
+                const result = await apiService.resetStats(peer.clientId);
+                if (result.code !== 0) {
+                    alert(result.message || '清零流量统计失败');
+                }
+            } catch (e) {
+                console.error(e);
+                alert('操作失败，请检查程序是否正在运行');
+            }
+        },
+        
+        // 使用上次的密码重新连接对等节点
+        async reconnectPeer(peer) {
+            this.isConnecting = true;
+            this.connectionStatus = { online: false, message: '正在重新连接...' };
+            this.lastConnectTime = +new Date();
+            try {
+                const result = await apiService.reconnectPeer(peer.clientId);
+                if (result.code !== 0) {
+                    alert(result.message || '重新连接失败');
+                    this.isConnecting = false;
+                }
+            } catch (e) {
+                console.error(e);
+                alert('操作失败，请检查程序是否正在运行');
+                this.isConnecting = false;
+            }
+        },
+        
         // 状态轮询
-        fetchPeerStatus() {
+        fetchPeerStatus(interval = APP_CONFIG.POLLING_INTERVAL) {
             if (this.peerStatusInterval) {
                 clearInterval(this.peerStatusInterval);
             }
-            
-            const req = async () => {
-                try {
-                    const data = await apiService.fetchPeerStatus();
-                    if (data) {
-                        this.peerDevice = data.device;
-                        this.connectionInfo = data.status;
-                        this.updateConnectionStatus();
-                    }
-                } catch (e) {
-                    console.error(e);
-                    this.resetToDefaultState();
+            this.peerStatusInterval = setInterval(() => this.refreshPeerStatus(), interval);
+            this.refreshPeerStatus();
+        },
+        
+        async refreshPeerStatus() {
+            try {
+                const data = await apiService.fetchPeerStatus();
+                if (data) {
+                    this.applyPeerStatus(data);
                 }
-            };
-            
-            this.peerStatusInterval = setInterval(req, APP_CONFIG.POLLING_INTERVAL);
-            req();
+                const attempts = await apiService.fetchFailedAttempts();
+                if (attempts && attempts.code === 0) {
+                    this.failedAttempts = attempts.attempts;
+                }
+            } catch (e) {
+                console.error(e);
+                this.resetToDefaultState();
+            }
+        },
+        
+        applyPeerStatus(data) {
+            this.peers = data.peers || [];
+            // 完整状态中带有流量统计，之后由 traffic 事件更新
+            const traffic = {};
+            this.peers.forEach(p => {
+                if (p.traffic) {
+                    traffic[p.clientId] = p.traffic;
+                }
+            });
+            this.peerTraffic = traffic;
+            this.connectionInfo = data.status;
+            this.updateConnectionStatus();
         },
         
         updateConnectionStatus() {
+            const targetAlive = this.peers.some(p => p.clientId === this.targetId && p.alive);
             if (this.connectionInfo.connectFailed) {
                 this.handleConnectionFailed();
-            } else if (this.peerDevice.alive) {
+            } else if (this.isConnecting && targetAlive) {
                 this.handleConnectionSuccess();
             } else if (this.connectionInfo.isConnecting || this.isConnecting) {
                 // 如果后端显示正在连接，或者前端正在连接中，都显示连接状态
                 this.handleConnecting();
+            } else if (this.alivePeers.length > 0) {
+                this.handleConnectionSuccess();
             } else {
                 this.handleDisconnected();
             }
@@ -275,7 +531,7 @@ createApp({
         resetToDefaultState() {
             this.connectionStatus = { message: "未连接", online: false };
             this.localDevice = { clientId: '加载中...', IP: '0.0.0.0', natType: '未知' };
-            this.peerDevice = { clientId: '等待连接', IP: '0.0.0.0', alive: false, latency: '-' };
+            this.peers = [];
             this.connectionInfo = {
                 mode: '断开状态',
                 modeCode: 2,
@@ -316,7 +572,7 @@ createApp({
             try {
                 const result = await apiService.resetPassword(this.newPassword);
                 if (result.code === 0) {
-                    this.localDevice.password = result.password;
+                    this.localPassword = result.password;
                     this.closeResetPasswordModal();
                 } else {
                     this.passwordError = true;
@@ -340,15 +596,16 @@ createApp({
         },
         
         async copyPassword() {
-            if (this.localDevice.password) {
-                const result = await utils.copyToClipboard(this.localDevice.password);
+            const password = await this.loadPassword();
+            if (password) {
+                const result = await utils.copyToClipboard(password);
                 this.updateCopyStatus('pwd', result.message);
             }
         },
         
-        async copyPeerIP() {
-            if (this.peerDevice.IP) {
-                const result = await utils.copyToClipboard(this.peerDevice.IP);
+        async copyPeerIP(peer) {
+            if (peer.IP) {
+                const result = await utils.copyToClipboard(peer.IP);
                 this.updateCopyStatus('peerIP', result.message);
             }
         },
@@ -389,12 +646,34 @@ createApp({
         // 工具方法
         formatTime(timestamp) {
             return utils.formatTime(timestamp);
+        },
+        
+        formatBytes(bytes) {
+            return utils.formatBytes(bytes);
+        }
+    },
+    
+    computed: {
+        // 已连通的对等节点
+        alivePeers() {
+            return this.peers.filter(p => p.alive);
+        },
+        // NAT类型说明
+        natTypeText() {
+            const names = {
+                OPEN: '无NAT（公网）',
+                NAT1: 'NAT1 完全锥形',
+                NAT2: 'NAT2 地址限制锥形',
+                NAT3: 'NAT3 端口限制锥形',
+                NAT4: 'NAT4 对称型'
+            };
+            return names[this.localDevice.natType] || '检测中';
         }
     },
     
     mounted() {
-        this.fetchLocalDevice();
-        this.fetchPeerStatus();
+        apiService.onUnauthorized = () => this.handleUnauthorized();
+        this.checkSession();
         this.loadRecentDevices();
     },
     
@@ -402,5 +681,6 @@ createApp({
         if (this.peerStatusInterval) {
             clearInterval(this.peerStatusInterval);
         }
+        this.closeEventStream();
     }
 }).mount('#app');
@@ -0,0 +1,152 @@
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"net/netip"
+
+	"github.com/venshao/natun/glog"
+)
+
+// 未配置时使用的虚拟局域网网段
+const defaultSubnet = "10.10.10.0/24"
+
+// 旧版本使用的固定IPv6虚拟网段，所有部署共用同一前缀会相互冲突，加载配置时改为随机生成的网段
+const legacySubnet6 = "fd00:6e61:7475::/64"
+
+// IPv4虚拟网段的最大范围，与注册中心地址池的限制一致
+const minSubnetBits = 16
+
+// parseSubnet 解析IPv4虚拟网段，要求至少能容纳网关和一个客户端地址
+func parseSubnet(cidr string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("虚拟网段 %s 格式错误: %v", cidr, err)
+	}
+	if !prefix.Addr().Is4() || prefix.Bits() < minSubnetBits || prefix.Bits() > 30 {
+		return netip.Prefix{}, fmt.Errorf("虚拟网段 %s 必须是掩码在/%d到/30之间的IPv4网段", cidr, minSubnetBits)
+	}
+	return prefix.Masked(), nil
+}
+
+// parseSubnet6 解析IPv6虚拟网段，配置为空表示不启用IPv6，返回无效前缀
+func parseSubnet6(cidr string) (netip.Prefix, error) {
+	if cidr == "" {
+		return netip.Prefix{}, nil
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("IPv6虚拟网段 %s 格式错误: %v", cidr, err)
+	}
+	// 本机IPv6虚拟地址的低32位为IPv4虚拟IP，网段至少要留出32位
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() || prefix.Bits() > 96 {
+		return netip.Prefix{}, fmt.Errorf("IPv6虚拟网段 %s 必须是掩码不超过/96的IPv6网段", cidr)
+	}
+	return prefix.Masked(), nil
+}
+
+// generateSubnet6 按 RFC 4193 生成IPv6虚拟网段：fd00::/8 + 40位随机全局ID + 子网ID 0，共 /64
+// 生成后保存在配置中；同一网络内的客户端以注册中心下发的网段为准
+func generateSubnet6() string {
+	var raw [16]byte
+	raw[0] = 0xfd
+	if _, err := cryptorand.Read(raw[1:6]); err != nil {
+		glog.Errorf("[CONFIG]生成IPv6虚拟网段失败：%v", err)
+	}
+	return netip.PrefixFrom(netip.AddrFrom16(raw), 64).String()
+}
+
+// getSubnet 获取当前配置的IPv4虚拟网段，配置已在加载时校验
+func getSubnet() netip.Prefix {
+	prefix, err := parseSubnet(GetConfig().Subnet)
+	if err != nil {
+		return netip.MustParsePrefix(defaultSubnet)
+	}
+	return prefix
+}
+
+// getSubnet6 获取当前配置的IPv6虚拟网段，未配置时返回无效前缀
+func getSubnet6() netip.Prefix {
+	prefix, _ := parseSubnet6(GetConfig().Subnet6)
+	return prefix
+}
+
+// getTunIP6 本机的IPv6虚拟地址，由IPv6虚拟网段前缀和IPv4虚拟IP组成
+// IPv4虚拟IP由注册中心保证唯一，IPv6地址因此无需单独分配；未启用IPv6时返回空字符串
+func getTunIP6() string {
+	return vip6For(getTunIP())
+}
+
+// vip6For 虚拟IP对应的IPv6虚拟地址，对等节点的IPv6虚拟地址同样由其虚拟IP计算
+func vip6For(vip string) string {
+	subnet6 := getSubnet6()
+	addr, err := netip.ParseAddr(vip)
+	if !subnet6.IsValid() || err != nil || !addr.Is4() {
+		return ""
+	}
+	raw := subnet6.Addr().As16()
+	v4 := addr.As4()
+	copy(raw[12:], v4[:])
+	return netip.AddrFrom16(raw).String()
+}
+
+// subnetOffset 地址相对网络地址的偏移
+func subnetOffset(prefix netip.Prefix, addr netip.Addr) uint32 {
+	network := prefix.Addr().As4()
+	raw := addr.As4()
+	return binary.BigEndian.Uint32(raw[:]) - binary.BigEndian.Uint32(network[:])
+}
+
+// subnetAddr 网段中指定偏移的地址
+func subnetAddr(prefix netip.Prefix, offset uint32) netip.Addr {
+	network := prefix.Addr().As4()
+	var raw [4]byte
+	binary.BigEndian.PutUint32(raw[:], binary.BigEndian.Uint32(network[:])+offset)
+	return netip.AddrFrom4(raw)
+}
+
+// subnetSize 网段包含的地址数量
+func subnetSize(prefix netip.Prefix) uint32 {
+	return uint32(1) << (32 - prefix.Bits())
+}
+
+// isHostAddr 地址是否可分配给客户端，网络地址、网关地址（第一个地址）和广播地址除外
+func isHostAddr(prefix netip.Prefix, addr netip.Addr) bool {
+	if !addr.Is4() || !prefix.Contains(addr) {
+		return false
+	}
+	offset := subnetOffset(prefix, addr)
+	return offset >= 2 && offset < subnetSize(prefix)-1
+}
+
+// randomHostAddr 在网段中随机选择一个可分配的地址
+func randomHostAddr(prefix netip.Prefix) string {
+	offset := uint32(mathrand.Int63n(int64(subnetSize(prefix)-3))) + 2
+	return subnetAddr(prefix, offset).String()
+}
+
+// gatewayAddr 网段中保留给网关的第一个地址，macOS 点对点接口以此作为对端地址
+func gatewayAddr(prefix netip.Prefix) string {
+	return subnetAddr(prefix, 1).String()
+}
+
+// subnetMask 点分十进制形式的子网掩码，用于 Windows netsh 和 route 命令
+func subnetMask(prefix netip.Prefix) string {
+	return net.IP(net.CIDRMask(prefix.Bits(), 32)).String()
+}
+
+// inOverlay 地址是否属于虚拟局域网，IPv6地址仅在启用了IPv6虚拟网段时有效
+func inOverlay(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	if addr.Is4In6() || addr.Is4() {
+		return getSubnet().Contains(addr.Unmap())
+	}
+	subnet6 := getSubnet6()
+	return subnet6.IsValid() && subnet6.Contains(addr)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestGenerateSubnet6(t *testing.T) {
+	first := generateSubnet6()
+	prefix, err := parseSubnet6(first)
+	if err != nil {
+		t.Fatalf("生成的网段无效：%v", err)
+	}
+	if prefix.Bits() != 64 || !netip.MustParsePrefix("fd00::/8").Contains(prefix.Addr()) {
+		t.Fatalf("生成的网段 %s 不是 fd00::/8 内的 /64", first)
+	}
+	raw := prefix.Addr().As16()
+	for _, b := range raw[6:] {
+		if b != 0 {
+			t.Fatalf("生成的网段 %s 的子网ID和接口ID应为0", first)
+		}
+	}
+	if first == legacySubnet6 || first == generateSubnet6() {
+		t.Fatalf("生成的网段 %s 不是随机的", first)
+	}
+}
+
+func TestEnsureConfigDefaultsReplacesLegacySubnet6(t *testing.T) {
+	cfg := createDefaultConfig()
+	cfg.Subnet6 = legacySubnet6
+	ensureConfigDefaults(cfg)
+	if cfg.Subnet6 == legacySubnet6 {
+		t.Fatalf("旧版本的固定网段没有被替换")
+	}
+	if _, err := parseSubnet6(cfg.Subnet6); err != nil {
+		t.Fatalf("替换后的网段无效：%v", err)
+	}
+
+	custom := "fd12:3456:789a::/64"
+	cfg.Subnet6 = custom
+	ensureConfigDefaults(cfg)
+	if cfg.Subnet6 != custom {
+		t.Fatalf("自定义网段被修改为 %s", cfg.Subnet6)
+	}
+}
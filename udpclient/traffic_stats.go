@@ -0,0 +1,223 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 隧道流量统计：按对等节点和连接模式统计收发的IP数据包，以及丢弃的数据包和解密、解析错误
+// 字节数为隧道内IP数据包的长度，不含协议头和加密开销
+const trafficSampleInterval = time.Second
+
+// modeCounters 一种连接模式下的收发计数
+type modeCounters struct {
+	txBytes   atomic.Uint64
+	txPackets atomic.Uint64
+	rxBytes   atomic.Uint64
+	rxPackets atomic.Uint64
+}
+
+// TrafficStats 一个对等节点的流量统计，无法归属到对等节点的丢包和错误记入 unattributedTraffic
+type TrafficStats struct {
+	direct modeCounters
+	relay  modeCounters
+
+	dropLength    atomic.Uint64 // 帧头或IP头部声明的长度与实际长度不符
+	dropNoTun     atomic.Uint64 // TUN设备未启动
+	dropNoPeer    atomic.Uint64 // 目的虚拟IP或来源不属于任何已连接的对等节点
+	dropFiltered  atomic.Uint64 // 源地址或目的地址不在虚拟网段内
+	dropSpoofed   atomic.Uint64 // 源地址不是发送方的虚拟IP
+	decryptErrors atomic.Uint64
+	parseErrors   atomic.Uint64 // 无法识别的IP数据包
+
+	mu      sync.Mutex
+	since   time.Time // 开始统计或上次清零的时间
+	lastTx  uint64    // 上一次采样时的累计字节数
+	lastRx  uint64
+	txRate  uint64 // 最近一个采样间隔的速率（字节/秒）
+	rxRate  uint64
+	sampled bool
+}
+
+// ModeTraffic 一种连接模式下的收发计数
+type ModeTraffic struct {
+	TxBytes   uint64 `json:"txBytes"`
+	TxPackets uint64 `json:"txPackets"`
+	RxBytes   uint64 `json:"rxBytes"`
+	RxPackets uint64 `json:"rxPackets"`
+}
+
+// DropStats 按原因统计的丢包数
+type DropStats struct {
+	LengthMismatch uint64 `json:"lengthMismatch"`
+	NoTun          uint64 `json:"noTun"`
+	NoPeer         uint64 `json:"noPeer"`
+	Filtered       uint64 `json:"filtered"`
+	Spoofed        uint64 `json:"spoofed"`
+}
+
+// TrafficSnapshot 流量统计的快照
+type TrafficSnapshot struct {
+	ModeTraffic
+	TxRate        uint64      `json:"txRate"` // 字节/秒
+	RxRate        uint64      `json:"rxRate"`
+	Direct        ModeTraffic `json:"direct"`
+	Relay         ModeTraffic `json:"relay"`
+	Drops         DropStats   `json:"drops"`
+	DecryptErrors uint64      `json:"decryptErrors"`
+	ParseErrors   uint64      `json:"parseErrors"`
+	Since         int64       `json:"since"` // 开始统计或上次清零的时间（毫秒时间戳）
+}
+
+// 无法归属到对等节点的丢包和错误，如来自未知地址的数据、目的地址不属于任何对等节点的数据包
+var unattributedTraffic = newTrafficStats()
+
+func newTrafficStats() *TrafficStats {
+	return &TrafficStats{since: time.Now()}
+}
+
+// statsOf 对等节点的流量统计，peer 为nil时返回 unattributedTraffic
+func statsOf(peer *Peer) *TrafficStats {
+	if peer == nil {
+		return unattributedTraffic
+	}
+	return peer.stats
+}
+
+func (s *TrafficStats) counters(mode ConnectionMode) *modeCounters {
+	if mode == ModeRelay {
+		return &s.relay
+	}
+	return &s.direct
+}
+
+// CountSent 记录一个经隧道发出的数据包
+func (s *TrafficStats) CountSent(mode ConnectionMode, n int) {
+	c := s.counters(mode)
+	c.txBytes.Add(uint64(n))
+	c.txPackets.Add(1)
+}
+
+// CountReceived 记录一个经隧道收到的数据包
+func (s *TrafficStats) CountReceived(mode ConnectionMode, n int) {
+	c := s.counters(mode)
+	c.rxBytes.Add(uint64(n))
+	c.rxPackets.Add(1)
+}
+
+func (c *modeCounters) snapshot() ModeTraffic {
+	return ModeTraffic{
+		TxBytes:   c.txBytes.Load(),
+		TxPackets: c.txPackets.Load(),
+		RxBytes:   c.rxBytes.Load(),
+		RxPackets: c.rxPackets.Load(),
+	}
+}
+
+func (c *modeCounters) reset() {
+	c.txBytes.Store(0)
+	c.txPackets.Store(0)
+	c.rxBytes.Store(0)
+	c.rxPackets.Store(0)
+}
+
+// totals 两种模式合计的收发字节数
+func (s *TrafficStats) totals() (uint64, uint64) {
+	return s.direct.txBytes.Load() + s.relay.txBytes.Load(), s.direct.rxBytes.Load() + s.relay.rxBytes.Load()
+}
+
+// sample 计算最近一个采样间隔的速率，由 startTrafficSampler 每秒调用
+func (s *TrafficStats) sample() {
+	tx, rx := s.totals()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 采样间隔为1秒，两次采样之差即为速率；期间被清零时重新开始
+	if s.sampled && tx >= s.lastTx && rx >= s.lastRx {
+		s.txRate = tx - s.lastTx
+		s.rxRate = rx - s.lastRx
+	} else {
+		s.txRate, s.rxRate = 0, 0
+	}
+	s.lastTx, s.lastRx = tx, rx
+	s.sampled = true
+}
+
+// Snapshot 获取当前的统计值
+func (s *TrafficStats) Snapshot() TrafficSnapshot {
+	snapshot := TrafficSnapshot{
+		Direct: s.direct.snapshot(),
+		Relay:  s.relay.snapshot(),
+		Drops: DropStats{
+			LengthMismatch: s.dropLength.Load(),
+			NoTun:          s.dropNoTun.Load(),
+			NoPeer:         s.dropNoPeer.Load(),
+			Filtered:       s.dropFiltered.Load(),
+			Spoofed:        s.dropSpoofed.Load(),
+		},
+		DecryptErrors: s.decryptErrors.Load(),
+		ParseErrors:   s.parseErrors.Load(),
+	}
+	snapshot.TxBytes = snapshot.Direct.TxBytes + snapshot.Relay.TxBytes
+	snapshot.TxPackets = snapshot.Direct.TxPackets + snapshot.Relay.TxPackets
+	snapshot.RxBytes = snapshot.Direct.RxBytes + snapshot.Relay.RxBytes
+	snapshot.RxPackets = snapshot.Direct.RxPackets + snapshot.Relay.RxPackets
+	s.mu.Lock()
+	snapshot.TxRate, snapshot.RxRate = s.txRate, s.rxRate
+	snapshot.Since = s.since.UnixMilli()
+	s.mu.Unlock()
+	return snapshot
+}
+
+// add 累加另一份快照，用于计算全部对等节点的合计；Since 取最早的时间
+func (t *TrafficSnapshot) add(o TrafficSnapshot) {
+	t.ModeTraffic.add(o.ModeTraffic)
+	t.Direct.add(o.Direct)
+	t.Relay.add(o.Relay)
+	t.TxRate += o.TxRate
+	t.RxRate += o.RxRate
+	t.Drops.LengthMismatch += o.Drops.LengthMismatch
+	t.Drops.NoTun += o.Drops.NoTun
+	t.Drops.NoPeer += o.Drops.NoPeer
+	t.Drops.Filtered += o.Drops.Filtered
+	t.Drops.Spoofed += o.Drops.Spoofed
+	t.DecryptErrors += o.DecryptErrors
+	t.ParseErrors += o.ParseErrors
+	if t.Since == 0 || (o.Since != 0 && o.Since < t.Since) {
+		t.Since = o.Since
+	}
+}
+
+func (m *ModeTraffic) add(o ModeTraffic) {
+	m.TxBytes += o.TxBytes
+	m.TxPackets += o.TxPackets
+	m.RxBytes += o.RxBytes
+	m.RxPackets += o.RxPackets
+}
+
+// Reset 将全部计数清零
+func (s *TrafficStats) Reset() {
+	s.direct.reset()
+	s.relay.reset()
+	for _, counter := range []*atomic.Uint64{&s.dropLength, &s.dropNoTun, &s.dropNoPeer, &s.dropFiltered, &s.dropSpoofed, &s.decryptErrors, &s.parseErrors} {
+		counter.Store(0)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.since = time.Now()
+	s.txRate, s.rxRate = 0, 0
+	s.sampled = false
+}
+
+// startTrafficSampler 每秒计算各对等节点的收发速率
+func startTrafficSampler() {
+	go func() {
+		ticker := time.NewTicker(trafficSampleInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, p := range GetConnectionManager().GetPeers() {
+				p.stats.sample()
+			}
+		}
+	}()
+}
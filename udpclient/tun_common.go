@@ -7,37 +7,128 @@ import (
 	"github.com/venshao/natun/glog"
 )
 
+// IPHeader 从IP数据包头部解析出的基本信息，同时支持IPv4和IPv6
+type IPHeader struct {
+	Version   int
+	Src       net.IP
+	Dst       net.IP
+	Protocol  byte // IPv4的协议号或IPv6的下一个头部
+	HeaderLen int  // 传输层数据的起始偏移
+	TotalLen  int  // 头部声明的数据包总长度
+}
+
+// parseIPHeader 解析IPv4或IPv6数据包头部，数据包过短或版本未知时返回 false
+// IPv6扩展头不做展开，此时 Protocol 为第一个扩展头的类型
+func parseIPHeader(packet []byte) (IPHeader, bool) {
+	if len(packet) < 1 {
+		return IPHeader{}, false
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		headerLen := int(packet[0]&0x0f) * 4
+		if len(packet) < 20 || headerLen < 20 || len(packet) < headerLen {
+			return IPHeader{}, false
+		}
+		return IPHeader{
+			Version:   4,
+			Src:       net.IP(packet[12:16]),
+			Dst:       net.IP(packet[16:20]),
+			Protocol:  packet[9],
+			HeaderLen: headerLen,
+			TotalLen:  int(packet[2])<<8 | int(packet[3]),
+		}, true
+	case 6:
+		if len(packet) < 40 {
+			return IPHeader{}, false
+		}
+		return IPHeader{
+			Version:   6,
+			Src:       net.IP(packet[8:24]),
+			Dst:       net.IP(packet[24:40]),
+			Protocol:  packet[6],
+			HeaderLen: 40,
+			TotalLen:  40 + (int(packet[4])<<8 | int(packet[5])), // IPv6头部只声明负载长度
+		}, true
+	default:
+		return IPHeader{}, false
+	}
+}
+
 func sendToTunnel(conn *net.UDPConn, frame []byte, size int) {
 	if tun == nil {
 		glog.Warning("[TUN]警告：TUN设备为空！无法发送数据")
+		unattributedTraffic.dropNoTun.Add(1)
 		return
 	}
 
-	// 获取连接管理器
-	cm := GetConnectionManager()
+	packet := frame[:size]
+	header, ok := parseIPHeader(packet)
+	if !ok {
+		glog.Debugf("[TUN]丢弃无法识别的数据包%d字节", size)
+		unattributedTraffic.parseErrors.Add(1)
+		return
+	}
+
+	// 按目的虚拟IP选择对等节点，虚拟网段以外的目的地址（如IPv6组播）不经隧道转发
+	if !inOverlay(header.Dst) {
+		glog.Debugf("[TUN]目的地址 %s 不在虚拟网段内，丢弃", header.Dst)
+		unattributedTraffic.dropFiltered.Add(1)
+		return
+	}
+	dstIP := header.Dst.String()
+	peer := GetConnectionManager().PeerByVip(dstIP)
+	if peer == nil {
+		glog.Debugf("[TUN]目的地址 %s 不属于任何已连接的对等节点，丢弃", dstIP)
+		unattributedTraffic.dropNoPeer.Add(1)
+		return
+	}
 
-	// 直接发送原始TUN数据，让sendDirectPacket根据模式添加协议头
-	sendDirectPacket(conn, frame[:size], cm)
+	// 直接发送原始TUN数据，让sendDirectPacket根据该节点的模式添加协议头
+	sendDirectPacket(conn, packet, peer)
 }
 
-// HandleReceivedPacket  收到报文后的处理
-func HandleReceivedPacket(listen *net.UDPConn, packet []byte) {
+// HandleReceivedPacket  收到报文后的处理，peer 为发送方，丢弃的数据包计入其流量统计
+func HandleReceivedPacket(listen *net.UDPConn, packet []byte, peer *Peer) {
+	stats := statsOf(peer)
 	if tun == nil {
 		glog.Warning("[TUN]警告：TUN设备为空！无法写入数据")
+		stats.dropNoTun.Add(1)
 		return
 	}
 
-	// 解析IP包并输出调试信息
-	parseAndLogIPPacket(packet, "TUN")
+	// 只接受源地址和目的地址都在虚拟网段内的数据包，避免对等节点借隧道向本机注入其他网段的流量
+	header, ok := parseIPHeader(packet)
+	if !ok {
+		glog.Warningf("[TUN]丢弃无法识别的数据包%d字节", len(packet))
+		stats.parseErrors.Add(1)
+		return
+	}
+	if !inOverlay(header.Src) || !inOverlay(header.Dst) {
+		glog.Warningf("[TUN]IPv%d数据包 %s -> %s 不在虚拟网段内，丢弃", header.Version, header.Src, header.Dst)
+		stats.dropFiltered.Add(1)
+		return
+	}
+	// 源地址必须是发送方自己的虚拟IP，避免对等节点冒充其他对等节点向本机发送数据
+	if peer == nil {
+		stats.dropNoPeer.Add(1)
+		return
+	}
+	if !header.Src.Equal(net.ParseIP(peer.GetVirtualIp())) && !header.Src.Equal(net.ParseIP(peer.GetVirtualIp6())) {
+		glog.Warningf("[TUN]对等节点 %s 发来的IPv%d数据包源地址 %s 不是其虚拟IP，丢弃", peer.clientId, header.Version, header.Src)
+		stats.dropSpoofed.Add(1)
+		return
+	}
 
-	// 检查数据包长度是否与IP头部声明的长度一致
-	if len(packet) >= 20 {
-		declaredLength := int(packet[2])<<8 | int(packet[3])
-		if len(packet) != declaredLength {
-			glog.Warningf("[TUN]数据包长度不匹配: 实际=%d, 声明=%d", len(packet), declaredLength)
-		}
+	// 数据包长度必须与IP头部声明的长度一致（IPv4为总长度，IPv6为40字节头部加负载长度）
+	if len(packet) != header.TotalLen {
+		glog.Warningf("[TUN]IPv%d数据包长度不匹配: 实际=%d, 声明=%d，丢弃", header.Version, len(packet), header.TotalLen)
+		stats.dropLength.Add(1)
+		return
 	}
 
+	// 解析IP包并输出调试信息
+	parseAndLogIPPacket(packet, "TUN")
+
 	_, err := tun.Write(packet)
 	if err != nil {
 		glog.Errorf("[TUN]写入TUN设备失败：%v", err)
@@ -48,128 +139,160 @@ func HandleReceivedPacket(listen *net.UDPConn, packet []byte) {
 
 // 解析IP包并输出调试信息
 func parseAndLogIPPacket(packet []byte, prefix string) {
-	if len(packet) >= 20 {
-		totalLength := int(packet[2])<<8 | int(packet[3])
-		protocol := packet[9]
-		srcIP := net.IP(packet[12:16]).String()
-		dstIP := net.IP(packet[16:20]).String()
-
-		glog.Debugf("[%s]收到数据包: %s -> %s, 协议=%d, 长度=%d", prefix, srcIP, dstIP, protocol, totalLength)
-
-		// 打印数据包前32字节的十六进制，用于调试
-		hexStr := ""
-		for i := 0; i < 32 && i < len(packet); i++ {
-			hexStr += fmt.Sprintf("%02x ", packet[i])
-		}
-		glog.Debugf("[%s]数据包前32字节: %s", prefix, hexStr)
-
-		// 特殊处理ICMP包
-		if protocol == 1 { // ICMP
-			if len(packet) >= 28 {
-				icmpType := packet[20]
-				icmpCode := packet[21]
-				var icmpTypeStr string
-				switch icmpType {
-				case 0:
-					icmpTypeStr = "Echo Reply"
-				case 8:
-					icmpTypeStr = "Echo Request"
-				case 3:
-					icmpTypeStr = "Destination Unreachable"
-				case 11:
-					icmpTypeStr = "Time Exceeded"
-				default:
-					icmpTypeStr = fmt.Sprintf("Unknown(%d)", icmpType)
-				}
-				glog.Debugf("[%s]ICMP包: %s -> %s, 类型=%s, 代码=%d", prefix, srcIP, dstIP, icmpTypeStr, icmpCode)
-			}
-		}
+	header, ok := parseIPHeader(packet)
+	if !ok {
+		return
+	}
+	srcIP := header.Src.String()
+	dstIP := header.Dst.String()
+	protocol := header.Protocol
+	l4 := header.HeaderLen
 
-		// 特殊处理TCP包
-		if protocol == 6 && len(packet) >= 40 { // TCP
-			srcPort := int(packet[20])<<8 | int(packet[21])
-			dstPort := int(packet[22])<<8 | int(packet[23])
-			flags := packet[33]
+	glog.Debugf("[%s]收到IPv%d数据包: %s -> %s, 协议=%d, 长度=%d", prefix, header.Version, srcIP, dstIP, protocol, header.TotalLen)
 
-			var flagStr string
-			if flags&0x02 != 0 {
-				flagStr += "SYN "
-			}
-			if flags&0x10 != 0 {
-				flagStr += "ACK "
-			}
-			if flags&0x01 != 0 {
-				flagStr += "FIN "
-			}
-			if flags&0x08 != 0 {
-				flagStr += "PSH "
-			}
-			if flags&0x04 != 0 {
-				flagStr += "RST "
-			}
+	// 打印数据包前32字节的十六进制，用于调试
+	hexStr := ""
+	for i := 0; i < 32 && i < len(packet); i++ {
+		hexStr += fmt.Sprintf("%02x ", packet[i])
+	}
+	glog.Debugf("[%s]数据包前32字节: %s", prefix, hexStr)
 
-			glog.Debugf("[%s]TCP包: %s:%d -> %s:%d, 标志=%s", prefix, srcIP, srcPort, dstIP, dstPort, flagStr)
+	// 特殊处理ICMP包
+	if protocol == 1 && len(packet) >= l4+8 { // ICMP
+		icmpType := packet[l4]
+		icmpCode := packet[l4+1]
+		var icmpTypeStr string
+		switch icmpType {
+		case 0:
+			icmpTypeStr = "Echo Reply"
+		case 8:
+			icmpTypeStr = "Echo Request"
+		case 3:
+			icmpTypeStr = "Destination Unreachable"
+		case 11:
+			icmpTypeStr = "Time Exceeded"
+		default:
+			icmpTypeStr = fmt.Sprintf("Unknown(%d)", icmpType)
 		}
+		glog.Debugf("[%s]ICMP包: %s -> %s, 类型=%s, 代码=%d", prefix, srcIP, dstIP, icmpTypeStr, icmpCode)
+	}
 
-		// 特殊处理UDP包
-		if protocol == 17 && len(packet) >= 28 { // UDP
-			srcPort := int(packet[20])<<8 | int(packet[21])
-			dstPort := int(packet[22])<<8 | int(packet[23])
-			glog.Debugf("[%s]UDP包: %s:%d -> %s:%d", prefix, srcIP, srcPort, dstIP, dstPort)
+	// 特殊处理ICMPv6包
+	if protocol == 58 && len(packet) >= l4+8 { // ICMPv6
+		icmpType := packet[l4]
+		icmpCode := packet[l4+1]
+		var icmpTypeStr string
+		switch icmpType {
+		case 128:
+			icmpTypeStr = "Echo Request"
+		case 129:
+			icmpTypeStr = "Echo Reply"
+		case 1:
+			icmpTypeStr = "Destination Unreachable"
+		case 3:
+			icmpTypeStr = "Time Exceeded"
+		case 135:
+			icmpTypeStr = "Neighbor Solicitation"
+		case 136:
+			icmpTypeStr = "Neighbor Advertisement"
+		default:
+			icmpTypeStr = fmt.Sprintf("Unknown(%d)", icmpType)
 		}
+		glog.Debugf("[%s]ICMPv6包: %s -> %s, 类型=%s, 代码=%d", prefix, srcIP, dstIP, icmpTypeStr, icmpCode)
+	}
+
+	// 特殊处理TCP包
+	if protocol == 6 && len(packet) >= l4+20 { // TCP
+		srcPort := int(packet[l4])<<8 | int(packet[l4+1])
+		dstPort := int(packet[l4+2])<<8 | int(packet[l4+3])
+		flags := packet[l4+13]
+
+		var flagStr string
+		if flags&0x02 != 0 {
+			flagStr += "SYN "
+		}
+		if flags&0x10 != 0 {
+			flagStr += "ACK "
+		}
+		if flags&0x01 != 0 {
+			flagStr += "FIN "
+		}
+		if flags&0x08 != 0 {
+			flagStr += "PSH "
+		}
+		if flags&0x04 != 0 {
+			flagStr += "RST "
+		}
+
+		glog.Debugf("[%s]TCP包: %s -> %s, 标志=%s", prefix, net.JoinHostPort(srcIP, fmt.Sprint(srcPort)), net.JoinHostPort(dstIP, fmt.Sprint(dstPort)), flagStr)
+	}
+
+	// 特殊处理UDP包
+	if protocol == 17 && len(packet) >= l4+8 { // UDP
+		srcPort := int(packet[l4])<<8 | int(packet[l4+1])
+		dstPort := int(packet[l4+2])<<8 | int(packet[l4+3])
+		glog.Debugf("[%s]UDP包: %s -> %s", prefix, net.JoinHostPort(srcIP, fmt.Sprint(srcPort)), net.JoinHostPort(dstIP, fmt.Sprint(dstPort)))
 	}
 }
 
-// 直接发送数据包（不分包）
-func sendDirectPacket(conn *net.UDPConn, tunData []byte, cm *ConnectionManager) {
-	if cm.IsDirectMode() {
+// 直接发送数据包（不分包），TUN数据在封装前经过会话密钥加密
+// 中转模式经 conn 发往注册中心，直连模式经该节点的直连套接字发送
+func sendDirectPacket(conn *net.UDPConn, tunData []byte, peer *Peer) {
+	sessionCipher := peer.GetCipher()
+	if sessionCipher == nil {
+		glog.Warningf("[CRYPTO]与 %s 的会话密钥未建立：无法发送数据包", peer.clientId)
+		return
+	}
+	switch peer.GetMode() {
+	case ModeDirect:
 		// 直连模式：添加直连协议头并发送到对等节点
-		if peer.peerAddr != nil {
-			// 协议格式: [魔数4B] + [0x01] + [数据长度(2B)] + [TUN数据]
-			header := []byte{0x12, 0x34, 0x56, 0x78, 0x01, byte(len(tunData) >> 8), byte(len(tunData) & 0xFF)}
-			tunnelPacket := append(header, tunData...)
+		if peerAddr := peer.GetAddr(); peerAddr != nil {
+			// 协议格式: [魔数4B] + [0x01] + [数据长度(2B)] + [计数器(8B) + 密文]
+			sealed := sessionCipher.Seal(0x01, tunData)
+			header := []byte{0x12, 0x34, 0x56, 0x78, 0x01, byte(len(sealed) >> 8), byte(len(sealed) & 0xFF)}
+			tunnelPacket := append(header, sealed...)
 
-			//glog.Debugf("[TUN]直连模式：向peer %s 发送包%d字节", peer.peerAddr.String(), len(tunnelPacket))
-			conn.WriteToUDP(tunnelPacket, peer.peerAddr)
-		} else {
-			glog.Warning("[TUN]直连模式：无法向peer发送包,peer.peerAddr为空")
-		}
-	} else if cm.IsRelayMode() {
-		// 中转模式：添加中转协议头并通过服务器转发
-		peerClientId, _ := cm.GetPeerInfo()
-		if peerClientId != "" {
-			// 协议格式: [魔数4B] + [0x02] + [targetId长度(1B)] + [targetId] + [数据长度(2B)] + [TUN数据]
-			targetIdBytes := []byte(peerClientId)
-			dataLen := len(tunData)
-			packet := make([]byte, 4+1+1+len(targetIdBytes)+2+dataLen)
-
-			// 魔数和模式标识
-			packet[0] = 0x12
-			packet[1] = 0x34
-			packet[2] = 0x56
-			packet[3] = 0x78
-			packet[4] = 0x02 // 中转模式标识
-
-			// targetId长度和targetId
-			packet[5] = byte(len(targetIdBytes))
-			copy(packet[6:6+len(targetIdBytes)], targetIdBytes)
-
-			// 数据长度
-			packet[6+len(targetIdBytes)] = byte(dataLen >> 8)
-			packet[6+len(targetIdBytes)+1] = byte(dataLen & 0xFF)
-
-			// TUN数据
-			copy(packet[6+len(targetIdBytes)+2:], tunData)
-
-			// 直接发送二进制数据到服务器
-			_, err := conn.WriteToUDP(packet, serverAddr)
-			if err != nil {
-				glog.Errorf("[TUN]中转模式：发送数据失败：%v", err)
+			//glog.Debugf("[TUN]直连模式：向peer %s 发送包%d字节", peerAddr.String(), len(tunnelPacket))
+			if _, err := peer.GetConn().WriteToUDP(tunnelPacket, peerAddr); err == nil {
+				peer.stats.CountSent(ModeDirect, len(tunData))
 			}
 		} else {
-			glog.Warning("[TUN]中转模式：无法向peer发送包,peerClientId为空")
+			glog.Warningf("[TUN]直连模式：无法向peer %s 发送包,peerAddr为空", peer.clientId)
+		}
+	case ModeRelay:
+		// 中转模式：添加中转协议头并通过服务器转发，帧头携带目标节点ID
+		// 协议格式: [魔数4B] + [0x02] + [targetId长度(1B)] + [targetId] + [数据长度(2B)] + [计数器(8B) + 密文]
+		sealed := sessionCipher.Seal(0x02, tunData)
+		targetIdBytes := []byte(peer.clientId)
+		dataLen := len(sealed)
+		packet := make([]byte, 4+1+1+len(targetIdBytes)+2+dataLen)
+
+		// 魔数和模式标识
+		packet[0] = 0x12
+		packet[1] = 0x34
+		packet[2] = 0x56
+		packet[3] = 0x78
+		packet[4] = 0x02 // 中转模式标识
+
+		// targetId长度和targetId
+		packet[5] = byte(len(targetIdBytes))
+		copy(packet[6:6+len(targetIdBytes)], targetIdBytes)
+
+		// 数据长度
+		packet[6+len(targetIdBytes)] = byte(dataLen >> 8)
+		packet[6+len(targetIdBytes)+1] = byte(dataLen & 0xFF)
+
+		// 加密后的TUN数据
+		copy(packet[6+len(targetIdBytes)+2:], sealed)
+
+		// 直接发送二进制数据到服务器
+		_, err := conn.WriteToUDP(packet, serverAddr)
+		if err != nil {
+			glog.Errorf("[TUN]中转模式：发送数据失败：%v", err)
+			return
 		}
-	} else {
-		glog.Warning("[TUN]未连接状态：无法发送数据包")
+		peer.stats.CountSent(ModeRelay, len(tunData))
+	default:
+		glog.Warningf("[TUN]与 %s 未连接：无法发送数据包", peer.clientId)
 	}
 }
@@ -38,7 +38,7 @@ func CreateTun() NetDevice {
 	}
 	glog.Debugf("Interface Name: %s", ifce.Name())
 	// 手动设置 IP
-	output, exeErr := exec.Command("ifconfig", ifce.Name(), getTunIP(), "10.10.10.1", "up").CombinedOutput()
+	output, exeErr := exec.Command("ifconfig", ifce.Name(), getTunIP(), gatewayAddr(getSubnet()), "up").CombinedOutput()
 	if exeErr != nil {
 		glog.Errorf("[TUN]设置TUN设备IP失败: %v", exeErr)
 		panic(err)
@@ -46,13 +46,29 @@ func CreateTun() NetDevice {
 		glog.Debugf("[TUN]设置TUN设备IP成功,命令返回:%s", string(output))
 	}
 	// sudo route add -net 10.10.10.0/24 -interface utun<x>
-	cmd := exec.Command("route", "-n", "add", "-net", "10.10.10.0/24", "-interface", ifce.Name())
+	cmd := exec.Command("route", "-n", "add", "-net", getSubnet().String(), "-interface", ifce.Name())
 	output, err = cmd.CombinedOutput()
 	if err != nil {
 		glog.Errorf("[ROUTE] 添加路由失败: %v, 输出: %s", err, string(output))
 	} else {
 		glog.Debugf("[ROUTE] 添加路由成功: %s", string(output))
 	}
+	if subnet6 := getSubnet6(); subnet6.IsValid() {
+		// sudo ifconfig utun<x> inet6 fd3a:91c4:7e52::a0a:a02 prefixlen 128
+		output, err = exec.Command("ifconfig", ifce.Name(), "inet6", getTunIP6(), "prefixlen", "128").CombinedOutput()
+		if err != nil {
+			glog.Errorf("[TUN]设置TUN设备IPv6地址失败: %v, 输出: %s", err, string(output))
+		} else {
+			glog.Debugf("[TUN]设置TUN设备IPv6地址成功: %s", getTunIP6())
+		}
+		// sudo route add -inet6 -net fd3a:91c4:7e52::/64 -interface utun<x>
+		output, err = exec.Command("route", "-n", "add", "-inet6", "-net", subnet6.String(), "-interface", ifce.Name()).CombinedOutput()
+		if err != nil {
+			glog.Errorf("[ROUTE] 添加IPv6路由失败: %v, 输出: %s", err, string(output))
+		} else {
+			glog.Debugf("[ROUTE] 添加IPv6路由成功: %s", string(output))
+		}
+	}
 
 	return &DarwinTunDevice{
 		ifce: ifce,
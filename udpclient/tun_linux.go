@@ -38,7 +38,7 @@ func CreateTun() NetDevice {
 	}
 	glog.Debugf("Interface Name: %s", ifce.Name())
 	// 手动设置 IP
-	// sudo ip addr add 10.10.10.2/24 dev tun0
+	// sudo ip addr add 10.10.10.2 dev tun0
 	output, exeErr := exec.Command("ip", "addr", "add", getTunIP(), "dev", ifce.Name()).CombinedOutput()
 	if exeErr != nil {
 		glog.Fatalf("[TUN]设置TUN设备IP失败: %v", exeErr)
@@ -49,13 +49,29 @@ func CreateTun() NetDevice {
 	// sudo ip link set dev tun0 up
 	output, exeErr = exec.Command("ip", "link", "set", "dev", ifce.Name(), "up").CombinedOutput()
 	// sudo ip route add 10.10.10.0/24 dev tun0
-	cmd := exec.Command("ip", "route", "add", "10.10.10.0/24", "dev", ifce.Name())
+	cmd := exec.Command("ip", "route", "add", getSubnet().String(), "dev", ifce.Name())
 	output, err = cmd.CombinedOutput()
 	if err != nil {
 		glog.Errorf("[ROUTE] 添加路由失败: %v, 输出: %s", err, string(output))
 	} else {
 		glog.Debugf("[ROUTE] 添加路由成功: %s", string(output))
 	}
+	if subnet6 := getSubnet6(); subnet6.IsValid() {
+		// sudo ip -6 addr add fd3a:91c4:7e52::a0a:a02 dev tun0
+		output, err = exec.Command("ip", "-6", "addr", "add", getTunIP6(), "dev", ifce.Name()).CombinedOutput()
+		if err != nil {
+			glog.Errorf("[TUN]设置TUN设备IPv6地址失败: %v, 输出: %s", err, string(output))
+		} else {
+			glog.Debugf("[TUN]设置TUN设备IPv6地址成功: %s", getTunIP6())
+		}
+		// sudo ip -6 route add fd3a:91c4:7e52::/64 dev tun0
+		output, err = exec.Command("ip", "-6", "route", "add", subnet6.String(), "dev", ifce.Name()).CombinedOutput()
+		if err != nil {
+			glog.Errorf("[ROUTE] 添加IPv6路由失败: %v, 输出: %s", err, string(output))
+		} else {
+			glog.Debugf("[ROUTE] 添加IPv6路由成功: %s", string(output))
+		}
+	}
 
 	return &LinuxTunDevice{
 		ifce: ifce,
@@ -31,16 +31,14 @@ func (p *WinTunDevice) Write(b []byte) (n int, err error) {
 	// 添加调试信息
 	glog.Debugf("[WINTUN]准备写入数据包，长度=%d", len(b))
 
-	// 检查数据包长度
-	if len(b) < 20 {
-		glog.Warningf("[WINTUN]数据包长度过短: %d", len(b))
-		return 0, fmt.Errorf("packet too short")
-	}
-
-	// 检查IP版本
-	if b[0]>>4 != 4 {
-		glog.Warningf("[WINTUN]非IPv4数据包: version=%d", b[0]>>4)
-		return 0, fmt.Errorf("not IPv4 packet")
+	// 检查数据包长度和IP版本，只写入完整的IPv4或IPv6头部
+	if _, ok := parseIPHeader(b); !ok {
+		if len(b) == 0 {
+			glog.Warningf("[WINTUN]数据包为空")
+			return 0, fmt.Errorf("packet too short")
+		}
+		glog.Warningf("[WINTUN]无效的IP数据包: version=%d, 长度=%d", b[0]>>4, len(b))
+		return 0, fmt.Errorf("invalid IP packet")
 	}
 
 	// 分配缓冲区
@@ -83,7 +81,7 @@ func CreateTun() NetDevice {
 	}
 	// 手动设置 IP
 	output, exeErr := exec.Command("netsh", "interface", "ip", "set", "address",
-		adapterName, "static", getTunIP(), "mask=255.255.255.0").CombinedOutput()
+		adapterName, "static", getTunIP(), "mask="+subnetMask(getSubnet())).CombinedOutput()
 	if exeErr != nil {
 		glog.Errorf("[TUN]设置TUN设备IP失败: %v", exeErr)
 		panic(err)
@@ -97,7 +95,8 @@ func CreateTun() NetDevice {
 	}
 
 	// 添加路由配置
-	routeCmd := exec.Command("route", "add", "10.10.10.0", "mask", "255.255.255.0",
+	subnet := getSubnet()
+	routeCmd := exec.Command("route", "add", subnet.Addr().String(), "mask", subnetMask(subnet),
 		getTunIP(), "metric", "1")
 	_, routeErr := routeCmd.CombinedOutput()
 	if routeErr != nil {
@@ -105,6 +104,22 @@ func CreateTun() NetDevice {
 	} else {
 		glog.Debugf("[ROUTE]添加路由成功")
 	}
+	if subnet6 := getSubnet6(); subnet6.IsValid() {
+		output, exeErr = exec.Command("netsh", "interface", "ipv6", "add", "address",
+			adapterName, getTunIP6()).CombinedOutput()
+		if exeErr != nil {
+			glog.Errorf("[TUN]设置TUN设备IPv6地址失败: %v, 输出: %s", exeErr, string(output))
+		} else {
+			glog.Debugf("[TUN]设置TUN设备IPv6地址成功: %s", getTunIP6())
+		}
+		_, routeErr = exec.Command("netsh", "interface", "ipv6", "add", "route",
+			subnet6.String(), adapterName, "metric=1").CombinedOutput()
+		if routeErr != nil {
+			glog.Errorf("[ROUTE]添加IPv6路由失败: %v", routeErr)
+		} else {
+			glog.Debugf("[ROUTE]添加IPv6路由成功")
+		}
+	}
 
 	// 获取MAC地址
 	return &WinTunDevice{
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SSDP组播地址，UPnP设备在此响应搜索请求
+const ssdpAddr = "239.255.255.250:1900"
+
+// UPnP IGD 的错误码
+const (
+	upnpConflictInMappingEntry       = 718 // 外部端口已被其他主机映射
+	upnpOnlyPermanentLeasesSupported = 725 // 只支持永久映射，有效期必须为0
+)
+
+// WAN连接服务类型，按优先级排列
+var igdServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// upnpDevice 设备描述中的设备，WAN连接服务位于嵌套的子设备中
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// findService 在设备树中查找指定类型的服务
+func (d *upnpDevice) findService(serviceType string) *upnpService {
+	for i := range d.Services {
+		if d.Services[i].ServiceType == serviceType {
+			return &d.Services[i]
+		}
+	}
+	for i := range d.Devices {
+		if service := d.Devices[i].findService(serviceType); service != nil {
+			return service
+		}
+	}
+	return nil
+}
+
+// upnpError 网关返回的SOAP错误
+type upnpError struct {
+	code        int
+	description string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("UPnP 错误码 %d %s", e.code, e.description)
+}
+
+// upnpMapper UPnP IGD，通过SOAP调用WAN连接服务
+type upnpMapper struct {
+	controlURL  string
+	serviceType string
+	localIP     net.IP // 本机访问网关时使用的地址，即映射的内部地址
+}
+
+// discoverUPnP 通过SSDP搜索局域网内的IGD设备
+func discoverUPnP(addr string) (*upnpMapper, error) {
+	target, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n\r\n"
+	if _, err := conn.WriteToUDP([]byte(search), target); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, fmt.Errorf("没有找到UPnP网关")
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := resp.Header.Get("Location")
+		if location == "" {
+			continue
+		}
+		if mapper, err := loadIGD(location); err == nil {
+			return mapper, nil
+		}
+	}
+}
+
+// loadIGD 读取设备描述，查找WAN连接服务的控制地址
+func loadIGD(location string) (*upnpMapper, error) {
+	client := http.Client{Timeout: 3 * time.Second}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var desc struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&desc); err != nil {
+		return nil, err
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if desc.URLBase != "" {
+		if urlBase, err := url.Parse(desc.URLBase); err == nil {
+			base = urlBase
+		}
+	}
+	for _, serviceType := range igdServiceTypes {
+		service := desc.Device.findService(serviceType)
+		if service == nil {
+			continue
+		}
+		control, err := base.Parse(service.ControlURL)
+		if err != nil {
+			return nil, err
+		}
+		port, _ := strconv.Atoi(control.Port())
+		if port == 0 {
+			port = 80
+		}
+		localIP, err := localIPFor(&net.UDPAddr{IP: net.ParseIP(control.Hostname()), Port: port})
+		if err != nil {
+			return nil, err
+		}
+		return &upnpMapper{controlURL: control.String(), serviceType: serviceType, localIP: localIP}, nil
+	}
+	return nil, fmt.Errorf("设备 %s 不提供WAN连接服务", location)
+}
+
+func (m *upnpMapper) Name() string {
+	return "UPnP"
+}
+
+// soap 调用WAN连接服务的操作，返回响应中的参数
+func (m *upnpMapper) soap(action string, args [][2]string) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, m.serviceType)
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%s>", arg[0])
+		xml.EscapeText(&body, []byte(arg[1]))
+		fmt.Fprintf(&body, "</%s>", arg[0])
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequest(http.MethodPost, m.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, m.serviceType, action))
+	client := http.Client{Timeout: 3 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	values := soapValues(data)
+	if resp.StatusCode != http.StatusOK {
+		code, _ := strconv.Atoi(values["errorCode"])
+		return nil, &upnpError{code: code, description: values["errorDescription"]}
+	}
+	return values, nil
+}
+
+// soapValues 提取响应中所有只包含文本的元素，参数名在各操作中不重复，无需区分层级
+func soapValues(data []byte) map[string]string {
+	values := make(map[string]string)
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var name string
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return values
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+		case xml.CharData:
+			if name != "" {
+				values[name] = strings.TrimSpace(string(t))
+			}
+		case xml.EndElement:
+			name = ""
+		}
+	}
+}
+
+// addPortMapping 有效期以秒为单位，0表示永久映射
+func (m *upnpMapper) addPortMapping(internalPort int, externalPort int, lease int) error {
+	_, err := m.soap("AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(externalPort)},
+		{"NewProtocol", "UDP"},
+		{"NewInternalPort", strconv.Itoa(internalPort)},
+		{"NewInternalClient", m.localIP.String()},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", "natun " + getClientId()},
+		{"NewLeaseDuration", strconv.Itoa(lease)},
+	})
+	return err
+}
+
+func (m *upnpMapper) AddMapping(internalPort int, externalPort int, lifetime time.Duration) (*net.UDPAddr, time.Duration, error) {
+	values, err := m.soap("GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	ip := net.ParseIP(values["NewExternalIPAddress"]).To4()
+	if ip == nil {
+		return nil, 0, fmt.Errorf("UPnP 网关没有外部IPv4地址")
+	}
+	// 外部端口被占用时改用随机端口
+	for try := 0; try < 3; try++ {
+		err = m.addPortMapping(internalPort, externalPort, int(lifetime/time.Second))
+		if e, ok := err.(*upnpError); ok && e.code == upnpOnlyPermanentLeasesSupported {
+			// 永久映射在退出时删除，程序异常退出时会残留在网关上
+			lifetime = 0
+			err = m.addPortMapping(internalPort, externalPort, 0)
+		}
+		if e, ok := err.(*upnpError); ok && e.code == upnpConflictInMappingEntry {
+			externalPort = 1024 + rand.Intn(65536-1024)
+			continue
+		}
+		break
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return &net.UDPAddr{IP: ip, Port: externalPort}, lifetime, nil
+}
+
+func (m *upnpMapper) DeleteMapping(_ int, externalPort int) error {
+	_, err := m.soap("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(externalPort)},
+		{"NewProtocol", "UDP"},
+	})
+	return err
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testIGDDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<controlURL>/ctl/IPConn</controlURL>
+</service></serviceList>
+</device></deviceList>
+</device></deviceList>
+</device>
+</root>`
+
+// upnpCall 假网关收到的SOAP调用
+type upnpCall struct {
+	action string
+	args   map[string]string
+}
+
+// fakeIGD 本机回环地址上的假UPnP网关，SSDP搜索和SOAP控制分别由UDP和HTTP服务响应
+type fakeIGD struct {
+	ssdp *net.UDPConn
+	http *httptest.Server
+
+	mu         sync.Mutex
+	calls      []upnpCall
+	addResults []int // 依次作为 AddPortMapping 的错误码，0或用完时成功
+}
+
+func newFakeIGD(t *testing.T) *fakeIGD {
+	t.Helper()
+	igd := &fakeIGD{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testIGDDescription)
+	})
+	mux.HandleFunc("/ctl/IPConn", igd.control)
+	igd.http = httptest.NewServer(mux)
+	t.Cleanup(igd.http.Close)
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("监听SSDP失败: %v", err)
+	}
+	igd.ssdp = conn
+	t.Cleanup(func() { conn.Close() })
+	go igd.serveSSDP()
+
+	// UPnP映射的描述包含客户端ID，避免读写工作目录下的配置文件
+	saved := config
+	config = &Config{ClientID: "test-client"}
+	t.Cleanup(func() { config = saved })
+	return igd
+}
+
+func (g *fakeIGD) serveSSDP() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := g.ssdp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !strings.HasPrefix(string(buf[:n]), "M-SEARCH") {
+			continue
+		}
+		resp := "HTTP/1.1 200 OK\r\n" +
+			"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+			"LOCATION: " + g.http.URL + "/desc.xml\r\n\r\n"
+		g.ssdp.WriteToUDP([]byte(resp), addr)
+	}
+}
+
+func (g *fakeIGD) control(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	soapAction := strings.Trim(r.Header.Get("SOAPAction"), `"`)
+	action := soapAction[strings.LastIndex(soapAction, "#")+1:]
+
+	g.mu.Lock()
+	g.calls = append(g.calls, upnpCall{action: action, args: soapValues(body)})
+	code := 0
+	if action == "AddPortMapping" && len(g.addResults) > 0 {
+		code, g.addResults = g.addResults[0], g.addResults[1:]
+	}
+	g.mu.Unlock()
+
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	if code != 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>`+
+			`<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+			`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>test error</errorDescription></UPnPError>`+
+			`</detail></s:Fault></s:Body></s:Envelope>`, code)
+		return
+	}
+	result := ""
+	if action == "GetExternalIPAddress" {
+		result = "<NewExternalIPAddress>203.0.113.7</NewExternalIPAddress>"
+	}
+	fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+		`<u:%sResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">%s</u:%sResponse></s:Body></s:Envelope>`, action, result, action)
+}
+
+func (g *fakeIGD) setAddResults(codes ...int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.addResults = codes
+}
+
+// callsOf 指定操作的全部调用
+func (g *fakeIGD) callsOf(action string) []upnpCall {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var calls []upnpCall
+	for _, call := range g.calls {
+		if call.action == action {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// discover 通过假网关的SSDP地址发现UPnP网关
+func (g *fakeIGD) discover(t *testing.T) *upnpMapper {
+	t.Helper()
+	mapper, err := discoverUPnP(g.ssdp.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("discoverUPnP: %v", err)
+	}
+	return mapper
+}
+
+func TestDiscoverUPnP(t *testing.T) {
+	igd := newFakeIGD(t)
+	mapper := igd.discover(t)
+	if mapper.controlURL != igd.http.URL+"/ctl/IPConn" {
+		t.Fatalf("controlURL = %q, want %q", mapper.controlURL, igd.http.URL+"/ctl/IPConn")
+	}
+	if mapper.serviceType != "urn:schemas-upnp-org:service:WANIPConnection:1" {
+		t.Fatalf("serviceType = %q", mapper.serviceType)
+	}
+	if !mapper.localIP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("localIP = %v, want 127.0.0.1", mapper.localIP)
+	}
+}
+
+func TestUPnPMapperAddAndDeleteMapping(t *testing.T) {
+	igd := newFakeIGD(t)
+	mapper := igd.discover(t)
+
+	addr, lifetime, err := mapper.AddMapping(5000, 6000, portMappingLifetime)
+	if err != nil {
+		t.Fatalf("AddMapping: %v", err)
+	}
+	if addr.String() != "203.0.113.7:6000" || lifetime != portMappingLifetime {
+		t.Fatalf("AddMapping = %v %v, want 203.0.113.7:6000 %v", addr, lifetime, portMappingLifetime)
+	}
+	calls := igd.callsOf("AddPortMapping")
+	if len(calls) != 1 {
+		t.Fatalf("AddPortMapping 调用了%d次, want 1", len(calls))
+	}
+	args := calls[0].args
+	want := map[string]string{
+		"NewExternalPort":           "6000",
+		"NewProtocol":               "UDP",
+		"NewInternalPort":           "5000",
+		"NewInternalClient":         "127.0.0.1",
+		"NewPortMappingDescription": "natun test-client",
+		"NewLeaseDuration":          strconv.Itoa(int(portMappingLifetime / time.Second)),
+	}
+	for name, value := range want {
+		if args[name] != value {
+			t.Fatalf("%s = %q, want %q", name, args[name], value)
+		}
+	}
+
+	if err := mapper.DeleteMapping(5000, 6000); err != nil {
+		t.Fatalf("DeleteMapping: %v", err)
+	}
+	calls = igd.callsOf("DeletePortMapping")
+	if len(calls) != 1 || calls[0].args["NewExternalPort"] != "6000" || calls[0].args["NewProtocol"] != "UDP" {
+		t.Fatalf("DeletePortMapping 调用 = %v", calls)
+	}
+}
+
+// TestUPnPMapperConflict 外部端口已被占用时改用其他端口重试
+func TestUPnPMapperConflict(t *testing.T) {
+	igd := newFakeIGD(t)
+	mapper := igd.discover(t)
+	igd.setAddResults(upnpConflictInMappingEntry)
+
+	addr, _, err := mapper.AddMapping(5000, 6000, portMappingLifetime)
+	if err != nil {
+		t.Fatalf("AddMapping: %v", err)
+	}
+	calls := igd.callsOf("AddPortMapping")
+	if len(calls) != 2 || calls[0].args["NewExternalPort"] != "6000" {
+		t.Fatalf("AddPortMapping 调用 = %v", calls)
+	}
+	if retried := calls[1].args["NewExternalPort"]; retried != strconv.Itoa(addr.Port) {
+		t.Fatalf("返回的外部端口 %d 与重试时请求的端口 %s 不一致", addr.Port, retried)
+	}
+	if addr.Port < 1024 {
+		t.Fatalf("重试使用了保留端口 %d", addr.Port)
+	}
+
+	// 始终冲突时重试3次后放弃
+	igd.setAddResults(upnpConflictInMappingEntry, upnpConflictInMappingEntry, upnpConflictInMappingEntry)
+	if _, _, err := mapper.AddMapping(5000, 6000, portMappingLifetime); err == nil || !strings.Contains(err.Error(), "UPnP 错误码 718") {
+		t.Fatalf("AddMapping err = %v, want UPnP 错误码 718", err)
+	}
+}
+
+// TestUPnPMapperPermanentLease 网关只支持永久映射时以有效期0重新申请
+func TestUPnPMapperPermanentLease(t *testing.T) {
+	igd := newFakeIGD(t)
+	mapper := igd.discover(t)
+	igd.setAddResults(upnpOnlyPermanentLeasesSupported)
+
+	addr, lifetime, err := mapper.AddMapping(5000, 6000, portMappingLifetime)
+	if err != nil {
+		t.Fatalf("AddMapping: %v", err)
+	}
+	if addr.Port != 6000 || lifetime != 0 {
+		t.Fatalf("AddMapping = %v %v, want 端口6000 有效期0", addr, lifetime)
+	}
+	calls := igd.callsOf("AddPortMapping")
+	if len(calls) != 2 || calls[1].args["NewLeaseDuration"] != "0" {
+		t.Fatalf("AddPortMapping 调用 = %v", calls)
+	}
+}
+
+func TestUPnPMapperErrorResult(t *testing.T) {
+	igd := newFakeIGD(t)
+	mapper := igd.discover(t)
+	// 501: ActionFailed
+	igd.setAddResults(501)
+
+	if _, _, err := mapper.AddMapping(5000, 6000, portMappingLifetime); err == nil || !strings.Contains(err.Error(), "UPnP 错误码 501") {
+		t.Fatalf("AddMapping err = %v, want UPnP 错误码 501", err)
+	}
+	if calls := igd.callsOf("AddPortMapping"); len(calls) != 1 {
+		t.Fatalf("其他错误码时重试了 AddPortMapping %d 次", len(calls))
+	}
+}
+
+// TestUPnPPortMappingRenew 永久映射按默认有效期续期，续期时请求上次的外部端口
+func TestUPnPPortMappingRenew(t *testing.T) {
+	igd := newFakeIGD(t)
+	m := &PortMapping{mapper: igd.discover(t)}
+	igd.setAddResults(upnpConflictInMappingEntry, upnpOnlyPermanentLeasesSupported)
+
+	lifetime, err := m.renew(5000)
+	if err != nil {
+		t.Fatalf("首次申请映射: %v", err)
+	}
+	if lifetime != portMappingLifetime {
+		t.Fatalf("永久映射的续期间隔 = %v, want %v", lifetime, portMappingLifetime)
+	}
+	_, external := m.Info()
+	_, port, _ := net.SplitHostPort(external)
+
+	if _, err := m.renew(5000); err != nil {
+		t.Fatalf("续期: %v", err)
+	}
+	calls := igd.callsOf("AddPortMapping")
+	if last := calls[len(calls)-1].args["NewExternalPort"]; last != port {
+		t.Fatalf("续期请求的外部端口 = %s, want %s", last, port)
+	}
+	if _, renewed := m.Info(); renewed != external {
+		t.Fatalf("续期后外部地址 = %q, want %q", renewed, external)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/venshao/natun/gin"
+	"github.com/venshao/natun/glimit"
+	"github.com/venshao/natun/glog"
+)
+
+// Web控制台的访问控制：浏览器使用访问令牌登录后以会话Cookie访问接口，
+// 会话的POST请求必须携带登录时下发的CSRF令牌；命令行和脚本直接在请求头中携带访问令牌
+const (
+	webSessionCookie = "natun_session"
+	webSessionTTL    = 12 * time.Hour
+	csrfHeader       = "X-CSRF-Token"
+	maxWebSessions   = 64
+)
+
+// webSession 浏览器的一次登录会话
+type webSession struct {
+	csrfToken string
+	expires   time.Time
+}
+
+var (
+	webSessionMu sync.Mutex
+	webSessions  = make(map[string]*webSession)
+)
+
+// 按来源IP限制登录失败次数，避免局域网内暴力猜测访问令牌
+var webLoginLimiter = glimit.New()
+
+// LoginRequest 登录请求结构体
+type LoginRequest struct {
+	Token string `json:"token"`
+}
+
+// checkWebToken 以固定时间比较访问令牌
+func checkWebToken(token string) bool {
+	expected := GetConfig().WebToken
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// newWebSession 创建会话并写入会话Cookie，返回会话的CSRF令牌
+func newWebSession(c *gin.Context) string {
+	id := randomHex(32)
+	session := &webSession{csrfToken: randomHex(16), expires: time.Now().Add(webSessionTTL)}
+
+	webSessionMu.Lock()
+	now := time.Now()
+	for key, s := range webSessions {
+		if now.After(s.expires) {
+			delete(webSessions, key)
+		}
+	}
+	// 会话过多时丢弃最早过期的会话
+	for len(webSessions) >= maxWebSessions {
+		var oldest string
+		for key, s := range webSessions {
+			if oldest == "" || s.expires.Before(webSessions[oldest].expires) {
+				oldest = key
+			}
+		}
+		delete(webSessions, oldest)
+	}
+	webSessions[id] = session
+	webSessionMu.Unlock()
+
+	http.SetCookie(c.W, &http.Cookie{
+		Name:     webSessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(webSessionTTL / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return session.csrfToken
+}
+
+// getWebSession 查找请求的会话，会话不存在或已过期时返回nil
+func getWebSession(c *gin.Context) (string, *webSession) {
+	cookie, err := c.R.Cookie(webSessionCookie)
+	if err != nil {
+		return "", nil
+	}
+	webSessionMu.Lock()
+	defer webSessionMu.Unlock()
+	session, ok := webSessions[cookie.Value]
+	if !ok {
+		return "", nil
+	}
+	if time.Now().After(session.expires) {
+		delete(webSessions, cookie.Value)
+		return "", nil
+	}
+	return cookie.Value, session
+}
+
+// bearerToken 请求头 Authorization: Bearer <令牌> 中的访问令牌
+func bearerToken(c *gin.Context) string {
+	auth := c.R.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// clientIP 请求的来源IP，用于限制登录失败次数
+func clientIP(c *gin.Context) string {
+	host, _, err := net.SplitHostPort(c.R.RemoteAddr)
+	if err != nil {
+		return c.R.RemoteAddr
+	}
+	return host
+}
+
+// requireWebAuth 校验访问令牌或会话，会话的POST请求还需校验CSRF令牌
+func requireWebAuth(c *gin.Context) {
+	if token := bearerToken(c); token != "" {
+		ip := clientIP(c)
+		if ok, _ := webLoginLimiter.Allow(ip); ok && checkWebToken(token) {
+			return
+		}
+		webLoginLimiter.Fail(ip)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"code": -1, "message": "访问令牌错误"})
+		return
+	}
+	_, session := getWebSession(c)
+	if session == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"code": -1, "message": "未登录"})
+		return
+	}
+	if c.R.Method != http.MethodGet {
+		csrf := c.R.Header.Get(csrfHeader)
+		if subtle.ConstantTimeCompare([]byte(csrf), []byte(session.csrfToken)) != 1 {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"code": -1, "message": "CSRF令牌无效，请刷新页面"})
+			return
+		}
+	}
+}
+
+// 使用访问令牌登录
+func loginHandler(c *gin.Context) {
+	ip := clientIP(c)
+	if ok, wait := webLoginLimiter.Allow(ip); !ok {
+		c.JSON(http.StatusTooManyRequests, gin.H{"code": -1, "message": "尝试过于频繁，请" + wait.Round(time.Second).String() + "后重试"})
+		return
+	}
+	var req LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "message": "无效的请求参数"})
+		return
+	}
+	if !checkWebToken(strings.TrimSpace(req.Token)) {
+		webLoginLimiter.Fail(ip)
+		glog.Warningf("[WEB]来自 %s 的登录失败，访问令牌错误", ip)
+		c.JSON(http.StatusUnauthorized, gin.H{"code": -1, "message": "访问令牌错误"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 0, "message": "登录成功", "csrfToken": newWebSession(c)})
+}
+
+// 查询当前会话，页面刷新后据此恢复登录状态和CSRF令牌
+func sessionHandler(c *gin.Context) {
+	_, session := getWebSession(c)
+	if session == nil {
+		c.JSON(http.StatusOK, gin.H{"code": 0, "authenticated": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 0, "authenticated": true, "csrfToken": session.csrfToken})
+}
+
+// 退出登录
+func logoutHandler(c *gin.Context) {
+	if id, _ := getWebSession(c); id != "" {
+		webSessionMu.Lock()
+		delete(webSessions, id)
+		webSessionMu.Unlock()
+	}
+	http.SetCookie(c.W, &http.Cookie{Name: webSessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	c.JSON(http.StatusOK, gin.H{"code": 0, "message": "已退出登录"})
+}
+
+// loginWithQueryToken 地址中携带正确的访问令牌时直接登录，并跳转到不含令牌的地址，
+// 启动时自动打开的浏览器借此免去手动输入令牌
+func loginWithQueryToken(c *gin.Context) bool {
+	token := c.R.URL.Query().Get("token")
+	if token == "" {
+		return false
+	}
+	ip := clientIP(c)
+	if ok, _ := webLoginLimiter.Allow(ip); ok && checkWebToken(token) {
+		newWebSession(c)
+	} else {
+		webLoginLimiter.Fail(ip)
+	}
+	http.Redirect(c.W, c.R, "/", http.StatusFound)
+	return true
+}
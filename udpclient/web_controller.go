@@ -2,9 +2,12 @@ package main
 
 import (
 	"embed"
+	"net"
 	"net/http"
+	"net/url"
 	"os/exec"
 	"runtime"
+	"sort"
 
 	"github.com/venshao/natun/gin"
 	"github.com/venshao/natun/glog"
@@ -13,14 +16,24 @@ import (
 //go:embed static/*
 var staticFiles embed.FS
 
+// Web控制台默认只监听本机回环地址
+const defaultWebAddr = "127.0.0.1:8898"
+
 // DeviceInfo 设备信息结构体
 type DeviceInfo struct {
-	ClientId string `json:"clientId"`
-	IP       string `json:"IP"`
-	Alive    bool   `json:"alive"`
-	NatType  string `json:"natType"`
-	Latency  int    `json:"latency"`
-	Password string `json:"password"`
+	ClientId  string   `json:"clientId"`
+	IP        string   `json:"IP"`
+	IP6       string   `json:"IP6,omitempty"`       // IPv6虚拟地址，未启用IPv6时为空
+	PrefixLen int      `json:"prefixLen,omitempty"` // 虚拟网段掩码长度
+	Alive     bool     `json:"alive"`
+	NatType   string   `json:"natType"`
+	Latency   int      `json:"latency"`
+	Password  string   `json:"password,omitempty"`  // 连接密码只通过 /api/password 单独获取
+	PublicKey string   `json:"publicKey,omitempty"` // 身份公钥，用于核对对方身份
+	Nat       *NatInfo `json:"nat,omitempty"`       // 本机NAT类型检测结果
+	// 路由器端口映射的协议和外部地址，没有映射时为空
+	MappingProtocol string `json:"mappingProtocol,omitempty"`
+	MappedAddr      string `json:"mappedAddr,omitempty"`
 }
 
 // ConnectionStatus 连接状态信息
@@ -34,12 +47,35 @@ type ConnectionStatus struct {
 	ConnectMessage string `json:"connectMessage"` // 连接状态消息
 }
 
+// PeerStatus 单个对等节点的设备信息和连接模式
+type PeerStatus struct {
+	DeviceInfo
+	Mode       string           `json:"mode"`              // 连接模式：直连模式、中转模式、断开状态
+	ModeCode   int              `json:"modeCode"`          // 模式代码：0=直连，1=中转，2=断开
+	StatusText string           `json:"statusText"`        // 状态文本
+	ModeSince  int64            `json:"modeSince"`         // 最近一次切换连接模式的时间（毫秒时间戳），0表示尚未切换
+	ModeReason string           `json:"modeReason"`        // 最近一次切换连接模式的原因
+	Traffic    *TrafficSnapshot `json:"traffic,omitempty"` // 流量统计
+}
+
+// PeerTraffic 单个对等节点的流量统计
+type PeerTraffic struct {
+	ClientId string          `json:"clientId"`
+	Mode     string          `json:"mode"`
+	Stats    TrafficSnapshot `json:"stats"`
+}
+
 // ConnectRequest 连接请求结构体
 type ConnectRequest struct {
 	TargetId  string `json:"targetId"`
 	TargetPwd string `json:"targetPwd"`
 }
 
+// PeerRequest 断开或重新连接对等节点的请求结构体
+type PeerRequest struct {
+	TargetId string `json:"targetId"`
+}
+
 // ResetPasswordRequest 重设密码请求结构体
 type ResetPasswordRequest struct {
 	NewPassword string `json:"newPassword"`
@@ -47,15 +83,28 @@ type ResetPasswordRequest struct {
 
 // 获取本机设备信息
 func getDeviceHandler(c *gin.Context) {
+	natInfo := natDetector.GetNatInfo()
+	mappingProtocol, mappedAddr := portMapping.Info()
 	deviceInfo := DeviceInfo{
-		ClientId: getClientId(),
-		IP:       getTunIP(),
-		NatType:  "NAT3",
-		Password: getClientPassword(),
+		ClientId:  getClientId(),
+		IP:        getTunIP(),
+		IP6:       getTunIP6(),
+		PrefixLen: getSubnet().Bits(),
+		NatType:   natInfo.Type,
+		Nat:       &natInfo,
+		PublicKey: getPublicKey(),
+
+		MappingProtocol: mappingProtocol,
+		MappedAddr:      mappedAddr,
 	}
 	c.JSON(http.StatusOK, deviceInfo)
 }
 
+// 获取本机连接密码，设备信息中不再包含密码，需要显示或复制时单独获取
+func getPasswordHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"code": 0, "password": getClientPassword()})
+}
+
 // 连接目标设备
 func connPeerHandler(c *gin.Context) {
 	var req ConnectRequest
@@ -71,70 +120,191 @@ func connPeerHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "message": "目标识别码错误"})
 		return
 	}
+	if req.TargetId == getClientId() {
+		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "message": "不能连接本机"})
+		return
+	}
 	if req.TargetPwd == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "message": "密码不能为空"})
 		return
 	}
 
-	// 设置连接状态
-	GetConnectionManager().SetConnecting(true, "正在连接...")
+	// 设置连接状态，用户主动连接时不再自动重连
+	reconnector.Cancel(req.TargetId)
+	cm := GetConnectionManager()
+	cm.SetConnecting(true, "正在连接...")
 
-	requestConnectPeer(req.TargetId, req.TargetPwd)
+	if err := requestConnectPeer(req.TargetId, req.TargetPwd); err != nil {
+		cm.SetConnectFailed(false, "")
+		c.JSON(http.StatusOK, gin.H{"code": -1, "message": err.Error()})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{"code": 0, "message": "正在连接..."})
 }
 
+// 断开与目标设备的连接
+func disconnPeerHandler(c *gin.Context) {
+	var req PeerRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.TargetId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "message": "无效的请求参数"})
+		return
+	}
+	reconnector.Cancel(req.TargetId)
+	if err := requestDisconnectPeer(req.TargetId); err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": -1, "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 0, "message": "已断开连接"})
+}
+
+// 使用最近一次的密码重新连接目标设备
+func reconnPeerHandler(c *gin.Context) {
+	var req PeerRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.TargetId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "message": "无效的请求参数"})
+		return
+	}
+
+	reconnector.Cancel(req.TargetId)
+	cm := GetConnectionManager()
+	cm.SetConnecting(true, "正在重新连接...")
+	if err := requestReconnectPeer(req.TargetId); err != nil {
+		cm.SetConnectFailed(false, "")
+		c.JSON(http.StatusOK, gin.H{"code": -1, "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 0, "message": "正在重新连接..."})
+}
+
+// 获取各对等节点的流量统计，unattributed 为无法归属到对等节点的丢包和错误，total 为全部对等节点的合计
+func statsHandler(c *gin.Context) {
+	peers := GetConnectionManager().GetPeers()
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].clientId < peers[j].clientId
+	})
+	var total TrafficSnapshot
+	stats := make([]PeerTraffic, 0, len(peers))
+	for _, p := range peers {
+		snapshot := p.stats.Snapshot()
+		mode, _ := getModeText(p.GetMode())
+		stats = append(stats, PeerTraffic{ClientId: p.clientId, Mode: mode, Stats: snapshot})
+		total.add(snapshot)
+	}
+	unattributed := unattributedTraffic.Snapshot()
+	total.add(unattributed)
+	c.JSON(http.StatusOK, gin.H{"code": 0, "peers": stats, "unattributed": unattributed, "total": total})
+}
+
+// 清零流量统计，未指定 targetId 时清零全部对等节点和无法归属的统计
+func resetStatsHandler(c *gin.Context) {
+	var req PeerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "message": "无效的请求参数"})
+		return
+	}
+	if req.TargetId != "" {
+		peer := GetConnectionManager().GetPeer(req.TargetId)
+		if peer == nil {
+			c.JSON(http.StatusOK, gin.H{"code": -1, "message": "未连接设备 " + req.TargetId})
+			return
+		}
+		peer.stats.Reset()
+		glog.Infof("[WEB]已清零与 %s 的流量统计", req.TargetId)
+		c.JSON(http.StatusOK, gin.H{"code": 0, "message": "流量统计已清零"})
+		return
+	}
+	for _, p := range GetConnectionManager().GetPeers() {
+		p.stats.Reset()
+	}
+	unattributedTraffic.Reset()
+	glog.Infof("[WEB]已清零全部流量统计")
+	c.JSON(http.StatusOK, gin.H{"code": 0, "message": "流量统计已清零"})
+}
+
 func peerStatusHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, buildPeerStatus())
+}
+
+// buildPeerStatus 构建整体连接状态和全部对等节点的状态，事件流订阅时推送的完整状态与此相同
+func buildPeerStatus() map[string]interface{} {
 	// 获取连接管理器
 	cm := GetConnectionManager()
-	mode := cm.GetMode()
 
-	// 构建设备信息
-	deviceInfo := DeviceInfo{
-		ClientId: peer.clientId,
-		IP:       peer.peerVirtualIp,
-		Alive:    peer.peerAlive,
-		Latency:  peer.latency,
+	// 构建每个对等节点的设备信息，整体模式取最优的连接模式
+	peers := cm.GetPeers()
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].clientId < peers[j].clientId
+	})
+	peerStatuses := make([]PeerStatus, 0, len(peers))
+	mode := ModeDisconnected
+	for _, p := range peers {
+		peerMode := p.GetMode()
+		status := PeerStatus{
+			DeviceInfo: DeviceInfo{
+				ClientId:  p.clientId,
+				IP:        p.GetVirtualIp(),
+				IP6:       p.GetVirtualIp6(),
+				PrefixLen: getSubnet().Bits(),
+				Alive:     p.IsAlive(),
+				Latency:   p.GetLatency(),
+			},
+			ModeCode: int(peerMode),
+		}
+		if hs := p.GetHandshake(); hs != nil {
+			status.PublicKey = hs.RemoteStatic()
+		}
+		status.Mode, status.StatusText = getModeText(peerMode)
+		if changedAt, reason := p.GetModeChange(); !changedAt.IsZero() {
+			status.ModeSince = changedAt.UnixMilli()
+			status.ModeReason = reason
+		}
+		traffic := p.stats.Snapshot()
+		status.Traffic = &traffic
+		peerStatuses = append(peerStatuses, status)
+		if status.Alive && peerMode < mode {
+			mode = peerMode
+		}
 	}
 
 	// 构建连接状态信息
 	connectionStatus := ConnectionStatus{
 		ModeCode:       int(mode),
-		IsConnected:    cm.IsConnected(),
+		IsConnected:    mode != ModeDisconnected,
 		IsConnecting:   cm.IsConnecting(),
 		ConnectFailed:  cm.IsConnectFailed(),
 		ConnectMessage: cm.GetConnectMessage(),
 	}
 
 	// 设置模式文本和状态文本
-	switch mode {
-	case ModeDirect:
-		connectionStatus.Mode = "直连模式"
-		connectionStatus.StatusText = "P2P直连"
-	case ModeRelay:
-		connectionStatus.Mode = "中转模式"
-		connectionStatus.StatusText = "服务器中转"
-	case ModeDisconnected:
-		connectionStatus.Mode = "断开状态"
+	connectionStatus.Mode, connectionStatus.StatusText = getModeText(mode)
+	if mode == ModeDisconnected {
 		if connectionStatus.IsConnecting {
 			connectionStatus.StatusText = "正在连接..."
 		} else if connectionStatus.ConnectFailed {
 			connectionStatus.StatusText = "连接失败"
-		} else {
-			connectionStatus.StatusText = "未连接"
 		}
-	default:
-		connectionStatus.Mode = "未知模式"
-		connectionStatus.StatusText = "未知状态"
 	}
 
-	// 返回包含连接状态的响应
-	response := map[string]interface{}{
-		"device": deviceInfo,
+	// 返回包含连接状态的响应，peers 为全部对等节点
+	return map[string]interface{}{
 		"status": connectionStatus,
+		"peers":  peerStatuses,
 	}
+}
 
-	c.JSON(http.StatusOK, response)
+// getModeText 获取连接模式及其状态文本
+func getModeText(mode ConnectionMode) (string, string) {
+	switch mode {
+	case ModeDirect:
+		return "直连模式", "P2P直连"
+	case ModeRelay:
+		return "中转模式", "服务器中转"
+	case ModeDisconnected:
+		return "断开状态", "未连接"
+	default:
+		return "未知模式", "未知状态"
+	}
 }
 
 // 重设密码
@@ -174,6 +344,15 @@ func resetPasswordHandler(c *gin.Context) {
 	})
 }
 
+// 获取最近针对本机的失败连接尝试
+func failedAttemptsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"code":           0,
+		"attempts":       getFailedAttempts(),
+		"blockedSources": authLimiter.Blocked(),
+	})
+}
+
 // 打开浏览器函数
 func openBrowser(url string) {
 	var cmd string
@@ -190,12 +369,37 @@ func openBrowser(url string) {
 	}
 	args = append(args, url)
 
+	// 打开的地址中带有访问令牌，日志中只输出不含令牌的地址
+	consoleURL := webConsoleURL()
 	if err := exec.Command(cmd, args...).Start(); err != nil {
-		glog.Errorf("自动打开浏览器失败，请使用浏览器访问http://127.0.0.1:8898/\n")
+		glog.Errorf("自动打开浏览器失败，请使用浏览器访问%s\n", consoleURL)
 	}
-	glog.Infof("如果浏览器没有自动打开，请使用浏览器访问http://127.0.0.1:8898/\n")
-	glog.Infof("如果浏览器没有自动打开，请使用浏览器访问http://127.0.0.1:8898/\n")
-	glog.Infof("如果浏览器没有自动打开，请使用浏览器访问http://127.0.0.1:8898/\n")
+	glog.Infof("如果浏览器没有自动打开，请使用浏览器访问%s，使用配置文件中的 web_token 登录\n", consoleURL)
+}
+
+// webConsoleURL 本机访问Web控制台的地址，监听所有地址时使用回环地址
+func webConsoleURL() string {
+	host, port, err := net.SplitHostPort(GetConfig().WebAddr)
+	if err != nil {
+		return "http://" + defaultWebAddr + "/"
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port) + "/"
+}
+
+// isLoopbackAddr 监听地址是否只允许本机访问
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 // 设置缓存控制头部
@@ -205,8 +409,8 @@ func setNoCacheHeaders(c *gin.Context) {
 	c.W.Header().Set("Expires", "0")
 }
 
-// 启动 Web 服务器
-func startWebServer() {
+// 启动 Web 服务器，openUI 为false时不打开浏览器
+func startWebServer(openUI bool) {
 	r := gin.New()
 
 	// 将嵌入的文件作为静态资源
@@ -214,6 +418,9 @@ func startWebServer() {
 
 	r.GET("/", func(c *gin.Context) {
 		setNoCacheHeaders(c)
+		if loginWithQueryToken(c) {
+			return
+		}
 		data, _ := staticFiles.ReadFile("static/index.html")
 		c.Data(http.StatusOK, "text/html; charset=utf-8", data)
 	})
@@ -236,30 +443,79 @@ func startWebServer() {
 		c.Data(http.StatusOK, "text/javascript; charset=utf-8", data)
 	})
 
+	// 登录接口不需要认证，其余接口需要访问令牌或登录会话
+	public := r.Group("/api")
+	public.POST("/login", func(c *gin.Context) {
+		setNoCacheHeaders(c)
+		loginHandler(c)
+	})
+	public.GET("/session", func(c *gin.Context) {
+		setNoCacheHeaders(c)
+		sessionHandler(c)
+	})
 	api := r.Group("/api")
-	{
-		api.GET("/device", func(c *gin.Context) {
-			setNoCacheHeaders(c)
-			getDeviceHandler(c)
-		})
-		api.POST("/connect", func(c *gin.Context) {
-			setNoCacheHeaders(c)
-			connPeerHandler(c)
-		})
-		api.GET("/peerStatus", func(c *gin.Context) {
-			setNoCacheHeaders(c)
-			peerStatusHandler(c)
-		})
-		api.POST("/resetPassword", func(c *gin.Context) {
-			setNoCacheHeaders(c)
-			resetPasswordHandler(c)
-		})
-	}
-
-	openBrowser("http://127.0.0.1:8898")
-
-	err := r.Run("0.0.0.0:8898")
+	api.Use(requireWebAuth)
+	api.POST("/logout", func(c *gin.Context) {
+		setNoCacheHeaders(c)
+		logoutHandler(c)
+	})
+	registerApiRoutes(api)
+
+	cfg := GetConfig()
+	if !isLoopbackAddr(cfg.WebAddr) {
+		glog.Warningf("[WEB]Web控制台监听在 %s，其他设备可以访问登录页面，请妥善保管访问令牌", cfg.WebAddr)
+	}
+	if openUI {
+		openBrowser(webConsoleURL() + "?token=" + url.QueryEscape(cfg.WebToken))
+	}
+
+	err := r.Run(cfg.WebAddr)
 	if err != nil {
 		panic(err)
 	}
 }
+
+// registerApiRoutes 注册 /api 接口，Web控制台和本机控制套接字共用
+func registerApiRoutes(api *gin.Group) {
+	api.GET("/device", func(c *gin.Context) {
+		setNoCacheHeaders(c)
+		getDeviceHandler(c)
+	})
+	api.GET("/password", func(c *gin.Context) {
+		setNoCacheHeaders(c)
+		getPasswordHandler(c)
+	})
+	api.POST("/connect", func(c *gin.Context) {
+		setNoCacheHeaders(c)
+		connPeerHandler(c)
+	})
+	api.POST("/disconnect", func(c *gin.Context) {
+		setNoCacheHeaders(c)
+		disconnPeerHandler(c)
+	})
+	api.POST("/reconnect", func(c *gin.Context) {
+		setNoCacheHeaders(c)
+		reconnPeerHandler(c)
+	})
+	api.GET("/peerStatus", func(c *gin.Context) {
+		setNoCacheHeaders(c)
+		peerStatusHandler(c)
+	})
+	api.GET("/events", eventsHandler)
+	api.GET("/stats", func(c *gin.Context) {
+		setNoCacheHeaders(c)
+		statsHandler(c)
+	})
+	api.POST("/stats/reset", func(c *gin.Context) {
+		setNoCacheHeaders(c)
+		resetStatsHandler(c)
+	})
+	api.POST("/resetPassword", func(c *gin.Context) {
+		setNoCacheHeaders(c)
+		resetPasswordHandler(c)
+	})
+	api.GET("/failedAttempts", func(c *gin.Context) {
+		setNoCacheHeaders(c)
+		failedAttemptsHandler(c)
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+
+	"github.com/venshao/natun/gjson"
+	"github.com/venshao/natun/glimit"
+	"github.com/venshao/natun/glog"
+)
+
+// 连接请求的失败尝试限制，分别按发起方ID、发起方IP和目标ID计数
+// 请求在目标客户端确认密码验证通过之前一律按失败计数
+var connectLimiter = glimit.New()
+
+// connectAttemptKeys 一次连接请求对应的计数键
+func connectAttemptKeys(srcId string, srcAddr *net.UDPAddr, targetId string) []string {
+	return []string{
+		"src:" + srcId,
+		"ip:" + srcAddr.IP.String(),
+		"dst:" + targetId,
+	}
+}
+
+// allowConnectAttempt 检查连接请求是否处于退避或锁定状态，被拒绝时通知发起方
+func allowConnectAttempt(conn *net.UDPConn, addr *net.UDPAddr, targetId string, keys []string) bool {
+	for _, key := range keys {
+		if ok, wait := connectLimiter.Allow(key); !ok {
+			retryAfter := int(wait.Seconds()) + 1
+			glog.Warningf("拒绝连接请求 %s，尝试过于频繁，%d秒后解除", key, retryAfter)
+			sendJSON(conn, addr, map[string]interface{}{
+				"path":       "connectRejected",
+				"targetId":   targetId,
+				"reason":     "尝试过于频繁",
+				"retryAfter": retryAfter,
+			})
+			return false
+		}
+	}
+	for _, key := range keys {
+		connectLimiter.Fail(key)
+	}
+	return true
+}
+
+// 目标客户端报告入站连接的密码验证结果
+func authResultHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.Json) {
+	targetId := json.GetString("clientId")
+	srcId := json.GetString("srcId")
+	session, exists := registry.GetNatSession(srcId, targetId)
+	if !exists || session.peerOneId != srcId || session.peerTwoId != targetId {
+		glog.Warningf("收到 %s 的验证结果，但找不到与 %s 的NAT会话，忽略", targetId, srcId)
+		metrics.HandlerError(path, errNoSession)
+		return
+	}
+	if !json.GetBool("ok") {
+		glog.Warningf("%s 对 %s 的连接未通过密码验证", srcId, targetId)
+		metrics.PunchResult(punchAuthFailed)
+		return
+	}
+	metrics.PunchResult(punchAuthOk)
+	for _, key := range session.attemptKeys {
+		connectLimiter.Succeed(key)
+	}
+	glog.Debugf("%s 对 %s 的连接已通过密码验证，清除失败计数", srcId, targetId)
+}
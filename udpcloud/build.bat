@@ -55,6 +55,12 @@ set GOARCH=amd64
 go build -o bin\windows\server.exe ^
     main.go ^
     relay.go ^
+    metrics.go ^
+    nat_probe.go ^
+    ipam.go ^
+    registry.go ^
+    identity.go ^
+    auth_guard.go ^
     server_framework.go
 
 if %errorlevel% equ 0 (
@@ -80,6 +86,12 @@ set GOARCH=amd64
 go build -o bin\linux\server ^
     main.go ^
     relay.go ^
+    metrics.go ^
+    nat_probe.go ^
+    ipam.go ^
+    registry.go ^
+    identity.go ^
+    auth_guard.go ^
     server_framework.go
 
 if %errorlevel% equ 0 (
@@ -105,6 +117,12 @@ set GOARCH=amd64
 go build -o bin\darwin\server ^
     main.go ^
     relay.go ^
+    metrics.go ^
+    nat_probe.go ^
+    ipam.go ^
+    registry.go ^
+    identity.go ^
+    auth_guard.go ^
     server_framework.go
 
 if %errorlevel% equ 0 (
@@ -45,6 +45,12 @@ build_windows() {
     go build -o bin/windows/server.exe \
         main.go \
         relay.go \
+        metrics.go \
+        nat_probe.go \
+        ipam.go \
+        registry.go \
+        identity.go \
+        auth_guard.go \
         server_framework.go
     
     if [ $? -eq 0 ]; then
@@ -70,6 +76,12 @@ build_linux() {
     go build -o bin/linux/server \
         main.go \
         relay.go \
+        metrics.go \
+        nat_probe.go \
+        ipam.go \
+        registry.go \
+        identity.go \
+        auth_guard.go \
         server_framework.go
     
     if [ $? -eq 0 ]; then
@@ -96,6 +108,12 @@ build_darwin() {
     go build -o bin/darwin/server \
         main.go \
         relay.go \
+        metrics.go \
+        nat_probe.go \
+        ipam.go \
+        registry.go \
+        identity.go \
+        auth_guard.go \
         server_framework.go
     
     if [ $? -eq 0 ]; then
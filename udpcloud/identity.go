@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/venshao/natun/gjson"
+	"github.com/venshao/natun/glimit"
+	"github.com/venshao/natun/glog"
+)
+
+// 客户端身份登记文件，保存客户端ID与签名公钥的对应关系，服务器重启后仍然有效
+var identityFile = "identities.json"
+
+// 消息时间戳允许的最大偏差
+const maxClockSkew = 60 * time.Second
+
+// 长期未上线的客户端身份会被释放，允许重装后的客户端重新登记同一ID
+const identityExpiry = 30 * 24 * time.Hour
+
+// 登记的客户端身份数上限，达到上限后拒绝新的登记，直到有身份过期
+const maxIdentities = 10000
+
+// 新身份登记的频率限制，按来源IP计数：每个IP可以免费登记3个身份，
+// 之后每次登记需等待的时长从1分钟起翻倍，累计登记20个后锁定一天
+var registrationLimiter = &glimit.Limiter{
+	FreeAttempts:    3,
+	BaseDelay:       time.Minute,
+	MaxDelay:        time.Hour,
+	LockoutAfter:    20,
+	LockoutDuration: 24 * time.Hour,
+	ResetAfter:      24 * time.Hour,
+}
+
+// 消息中发送方ID所在的字段，需要与签名使用的 id 一致
+var senderFields = map[string]string{
+	"notifyChangePort": "srcId",
+	"portChanged":      "clientId",
+	"enableRelay":      "srcId",
+	"authResult":       "clientId",
+}
+
+// SignedMessage 客户端发来的签名消息，sig 是对 body 原始字节的Ed25519签名
+// 校验直接使用收到的 body 字节，不依赖两端JSON序列化的结果（数字精度、字段顺序、转义）一致
+type SignedMessage struct {
+	Body json.RawMessage `json:"body"`
+	Sig  string          `json:"sig"`
+}
+
+// ParseSignedMessage 解析签名消息的封装，返回原始消息和解析后的内容，签名由 Verify 校验
+func ParseSignedMessage(data []byte) (*SignedMessage, *gjson.Json, error) {
+	var signed SignedMessage
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, nil, err
+	}
+	if len(signed.Body) == 0 {
+		return nil, nil, fmt.Errorf("缺少消息内容")
+	}
+	msg, err := gjson.LoadContent(string(signed.Body))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &signed, msg, nil
+}
+
+// ClientIdentity 已登记的客户端身份
+type ClientIdentity struct {
+	PublicKey string `json:"publicKey"`
+	LastSeen  int64  `json:"lastSeen"`
+}
+
+// IdentityRegistry 客户端ID -> 签名公钥，首次ping时登记（TOFU）
+type IdentityRegistry struct {
+	mu         sync.Mutex
+	identities map[string]*ClientIdentity
+	seenSigs   map[string]time.Time
+	dirty      bool
+}
+
+var identityRegistry = loadIdentityRegistry()
+
+func loadIdentityRegistry() *IdentityRegistry {
+	r := &IdentityRegistry{
+		identities: make(map[string]*ClientIdentity),
+		seenSigs:   make(map[string]time.Time),
+	}
+	data, err := os.ReadFile(identityFile)
+	if err != nil {
+		glog.Infof("未找到客户端身份登记文件 %s，将在客户端首次上线时创建", identityFile)
+		return r
+	}
+	if err := json.Unmarshal(data, &r.identities); err != nil {
+		glog.Errorf("解析客户端身份登记文件失败: %v", err)
+	}
+	return r
+}
+
+// Verify 校验客户端消息签名，首次出现的客户端ID在ping时登记其公钥
+// msg 是 signed.Body 解析后的内容，签名针对 signed.Body 的原始字节；addr 用于限制新身份的登记频率
+func (r *IdentityRegistry) Verify(path string, signed *SignedMessage, msg *gjson.Json, addr *net.UDPAddr) error {
+	id := msg.GetString("id")
+	if id == "" {
+		return fmt.Errorf("缺少客户端ID")
+	}
+	if field, exists := senderFields[path]; exists && msg.GetString(field) != id {
+		return fmt.Errorf("字段 %s 与签名的客户端ID不一致", field)
+	}
+	ts := time.UnixMilli(msg.GetInt64("ts"))
+	if skew := time.Since(ts); skew > maxClockSkew || skew < -maxClockSkew {
+		return fmt.Errorf("消息时间戳超出允许范围")
+	}
+	sig, err := base64.StdEncoding.DecodeString(signed.Sig)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return fmt.Errorf("缺少或无效的签名")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	identity := r.identities[id]
+	if identity != nil && time.Since(time.Unix(identity.LastSeen, 0)) > identityExpiry {
+		glog.Infof("客户端 %s 的身份登记已过期，释放该ID", id)
+		delete(r.identities, id)
+		identity = nil
+	}
+	publicKey := ""
+	if identity != nil {
+		publicKey = identity.PublicKey
+	} else if path == "ping" {
+		publicKey = msg.GetString("pk")
+	} else {
+		return fmt.Errorf("客户端 %s 尚未登记身份", id)
+	}
+	rawKey, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(rawKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("无效的签名公钥")
+	}
+	if !ed25519.Verify(rawKey, signed.Body, sig) {
+		return fmt.Errorf("客户端 %s 的签名校验失败", id)
+	}
+	if _, replayed := r.seenSigs[signed.Sig]; replayed {
+		return fmt.Errorf("重放的消息")
+	}
+	r.seenSigs[signed.Sig] = time.Now()
+
+	if identity == nil {
+		// 登记会写入身份登记文件并保留30天，需要限制频率和总数，避免任意来源无限登记新ID
+		limitKey := "ip:" + addr.IP.String()
+		if ok, wait := registrationLimiter.Allow(limitKey); !ok {
+			return fmt.Errorf("来自 %s 的身份登记过于频繁，%d秒后解除", addr.IP.String(), int(wait.Seconds())+1)
+		}
+		if len(r.identities) >= maxIdentities {
+			return fmt.Errorf("登记的客户端身份已达上限 %d", maxIdentities)
+		}
+		registrationLimiter.Fail(limitKey)
+		identity = &ClientIdentity{PublicKey: publicKey}
+		r.identities[id] = identity
+		glog.Infof("客户端 %s 已登记签名公钥", id)
+	}
+	identity.LastSeen = time.Now().Unix()
+	r.dirty = true
+	return nil
+}
+
+// Maintain 清理过期的重放记录，并在身份有变化时写回登记文件
+func (r *IdentityRegistry) Maintain() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for sig, seen := range r.seenSigs {
+		if time.Since(seen) > 2*maxClockSkew {
+			delete(r.seenSigs, sig)
+		}
+	}
+	// 释放过期的身份，腾出登记名额
+	for id, identity := range r.identities {
+		if time.Since(time.Unix(identity.LastSeen, 0)) > identityExpiry {
+			glog.Infof("客户端 %s 的身份登记已过期，释放该ID", id)
+			delete(r.identities, id)
+			r.dirty = true
+		}
+	}
+	if !r.dirty {
+		return
+	}
+	data, err := json.MarshalIndent(r.identities, "", "  ")
+	if err != nil {
+		glog.Errorf("序列化客户端身份登记失败: %v", err)
+		return
+	}
+	if err := os.WriteFile(identityFile, data, 0600); err != nil {
+		glog.Errorf("保存客户端身份登记文件失败: %v", err)
+		return
+	}
+	r.dirty = false
+}
+
+// maintainIdentities 定期维护客户端身份登记
+func maintainIdentities() {
+	go func() {
+		for {
+			time.Sleep(time.Second * 30)
+			identityRegistry.Maintain()
+		}
+	}()
+}
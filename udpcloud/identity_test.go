@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestIdentityRegistry() *IdentityRegistry {
+	return &IdentityRegistry{
+		identities: make(map[string]*ClientIdentity),
+		seenSigs:   make(map[string]time.Time),
+	}
+}
+
+// signTestMessage 按客户端的格式封装并签名原始消息
+func signTestMessage(key ed25519.PrivateKey, body string) []byte {
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(body)))
+	return []byte(`{"body":` + body + `,"sig":"` + sig + `"}`)
+}
+
+func verifyTestMessage(r *IdentityRegistry, path string, packet []byte) error {
+	signed, msg, err := ParseSignedMessage(packet)
+	if err != nil {
+		return err
+	}
+	return r.Verify(path, signed, msg, testAddr(1))
+}
+
+// TestVerifyRawBody 签名针对原始字节：超过2^53的整数、任意字段顺序和未转义的字符都不影响校验
+func TestVerifyRawBody(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	pk := base64.StdEncoding.EncodeToString(pub)
+	r := newTestIdentityRegistry()
+	ts := time.Now().UnixMilli()
+
+	body := fmt.Sprintf(`{"ts":%d, "n":9223372036854775807,"path":"ping","pk":"%s","id":"a","note":"<&>"}`, ts, pk)
+	if err := verifyTestMessage(r, "ping", signTestMessage(key, body)); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	// 已登记后其他路径的消息同样校验
+	body = fmt.Sprintf(`{"path":"beat","id":"a","ts":%d,"n":9007199254740993}`, ts)
+	packet := signTestMessage(key, body)
+	if err := verifyTestMessage(r, "beat", packet); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if err := verifyTestMessage(r, "beat", packet); err == nil || !strings.Contains(err.Error(), "重放") {
+		t.Fatalf("重放的消息 err = %v", err)
+	}
+}
+
+func TestVerifyRejectsTamperedBody(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	pk := base64.StdEncoding.EncodeToString(pub)
+	r := newTestIdentityRegistry()
+	ts := time.Now().UnixMilli()
+
+	body := fmt.Sprintf(`{"path":"ping","id":"a","ts":%d,"n":1,"pk":"%s"}`, ts, pk)
+	packet := signTestMessage(key, body)
+	// 改变原始字节（即使语义相同）也会使签名失效
+	tampered := strings.Replace(string(packet), `"n":1`, `"n":1.0`, 1)
+	if err := verifyTestMessage(r, "ping", []byte(tampered)); err == nil {
+		t.Fatal("修改后的消息通过了校验")
+	}
+	if err := verifyTestMessage(r, "ping", packet); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	// 其他密钥签名的消息不能冒用已登记的ID
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	body = fmt.Sprintf(`{"path":"beat","id":"a","ts":%d,"n":2}`, ts)
+	if err := verifyTestMessage(r, "beat", signTestMessage(other, body)); err == nil {
+		t.Fatal("其他密钥签名的消息通过了校验")
+	}
+}
+
+func TestVerifyRequiresRegistration(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	r := newTestIdentityRegistry()
+	body := fmt.Sprintf(`{"path":"beat","id":"a","ts":%d,"n":1}`, time.Now().UnixMilli())
+	if err := verifyTestMessage(r, "beat", signTestMessage(key, body)); err == nil {
+		t.Fatal("未登记的客户端通过了校验")
+	}
+	if _, _, err := ParseSignedMessage([]byte(`{"path":"ping","id":"a"}`)); err == nil {
+		t.Fatal("没有签名封装的消息解析成功")
+	}
+}
+
+// TestRegistrationLimits 同一来源IP登记新身份受频率限制，身份总数有上限
+func TestRegistrationLimits(t *testing.T) {
+	r := newTestIdentityRegistry()
+	addr := testAddr(200)
+	ping := func(id string, from *net.UDPAddr) error {
+		pub, key, _ := ed25519.GenerateKey(rand.Reader)
+		body := fmt.Sprintf(`{"path":"ping","id":"%s","ts":%d,"n":1,"pk":"%s"}`,
+			id, time.Now().UnixMilli(), base64.StdEncoding.EncodeToString(pub))
+		signed, msg, err := ParseSignedMessage(signTestMessage(key, body))
+		if err != nil {
+			return err
+		}
+		return r.Verify("ping", signed, msg, from)
+	}
+
+	for i := 0; i < registrationLimiter.FreeAttempts; i++ {
+		if err := ping(fmt.Sprintf("free%d", i), addr); err != nil {
+			t.Fatalf("第%d次登记: %v", i+1, err)
+		}
+	}
+	if err := ping("first-limited", addr); err != nil {
+		t.Fatalf("免费次数用完后的第一次登记: %v", err)
+	}
+	if err := ping("limited", addr); err == nil || !strings.Contains(err.Error(), "过于频繁") {
+		t.Fatalf("超过频率限制后登记 err = %v", err)
+	}
+
+	for i := len(r.identities); i < maxIdentities; i++ {
+		r.identities[fmt.Sprintf("filler%d", i)] = &ClientIdentity{LastSeen: time.Now().Unix()}
+	}
+	if err := ping("full", testAddr(201)); err == nil || !strings.Contains(err.Error(), "上限") {
+		t.Fatalf("达到上限后登记 err = %v", err)
+	}
+
+	// 过期的身份被释放后可以继续登记
+	r.identities["filler9999"].LastSeen = time.Now().Add(-identityExpiry - time.Hour).Unix()
+	savedFile := identityFile
+	identityFile = t.TempDir() + "/identities.json"
+	defer func() { identityFile = savedFile }()
+	r.Maintain()
+	if err := ping("after-expiry", testAddr(202)); err != nil {
+		t.Fatalf("释放过期身份后登记: %v", err)
+	}
+}
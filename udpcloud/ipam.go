@@ -0,0 +1,461 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/venshao/natun/glog"
+)
+
+// 虚拟IP租约文件，保存每个网络中客户端ID与虚拟IP的对应关系，服务器重启后客户端仍获得相同地址
+var leaseFile = "leases.json"
+
+// 长期未上线的客户端租约会被回收
+const leaseExpiry = 30 * 24 * time.Hour
+
+// 客户端未指定网络或网段时使用的默认网络及其地址池网段
+const defaultNetwork = "default"
+
+var defaultPoolPrefix = netip.MustParsePrefix("10.10.10.0/24")
+
+// 地址池网段的前缀长度范围，最大为/16（65534个地址），最小为/30
+const (
+	minPoolBits = 16
+	maxPoolBits = 30
+)
+
+// 网络名称只允许字母、数字、下划线、点和连字符，最长32个字符
+var networkNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+// 未通过 -networks 指定网络时，客户端可以按名称自行创建网络，需要限制数量避免租约文件无限增长
+const (
+	maxNetworks          = 1000 // 网络总数上限
+	maxNetworksPerClient = 2    // 每个客户端身份最多创建的网络数
+	maxLeasesPerClient   = 4    // 每个客户端身份最多同时持有租约的网络数
+)
+
+// AddressLease 虚拟IP租约
+type AddressLease struct {
+	Address  string `json:"address"`
+	LastSeen int64  `json:"lastSeen"`
+}
+
+// AddressPool 一个虚拟网络的地址池
+type AddressPool struct {
+	Prefix  string                   `json:"prefix"`
+	Prefix6 string                   `json:"prefix6,omitempty"` // IPv6虚拟网段（ULA），客户端的IPv6虚拟地址由该前缀和IPv4虚拟IP组成
+	Creator string                   `json:"creator,omitempty"` // 创建网络的客户端ID，由 -networks 指定的网络为空
+	Leases  map[string]*AddressLease `json:"leases"`            // 客户端ID -> 租约
+
+	owners map[netip.Addr]string // 地址 -> 客户端ID，由 Leases 建立，不保存
+}
+
+// IPAM 虚拟IP地址管理，每个网络一个地址池，客户端首次ping时分配租约
+type IPAM struct {
+	mu         sync.Mutex
+	networks   map[string]*AddressPool
+	configured bool                       // 是否通过 -networks 指定了网络，指定后客户端不能创建新网络
+	clients    map[string]map[string]bool // 客户端ID -> 持有租约的网络
+	creators   map[string]int             // 客户端ID -> 创建的网络数
+	dirty      bool
+}
+
+var ipam = loadIPAM()
+
+func loadIPAM() *IPAM {
+	m := newIPAM()
+	data, err := os.ReadFile(leaseFile)
+	if err != nil {
+		glog.Infof("未找到虚拟IP租约文件 %s，将在客户端首次上线时创建", leaseFile)
+		return m
+	}
+	if err := json.Unmarshal(data, &m.networks); err != nil {
+		glog.Errorf("解析虚拟IP租约文件失败: %v", err)
+		m.networks = make(map[string]*AddressPool)
+	}
+	m.reindex()
+	return m
+}
+
+func newIPAM() *IPAM {
+	return &IPAM{
+		networks: make(map[string]*AddressPool),
+		clients:  make(map[string]map[string]bool),
+		creators: make(map[string]int),
+	}
+}
+
+// reindex 根据全部租约重建地址和客户端索引，调用方需持有锁或尚未共享 IPAM
+func (m *IPAM) reindex() {
+	m.clients = make(map[string]map[string]bool)
+	m.creators = make(map[string]int)
+	for network, pool := range m.networks {
+		if pool.Leases == nil {
+			pool.Leases = make(map[string]*AddressLease)
+		}
+		pool.owners = make(map[netip.Addr]string, len(pool.Leases))
+		for id, lease := range pool.Leases {
+			addr, err := netip.ParseAddr(lease.Address)
+			if err != nil {
+				delete(pool.Leases, id)
+				continue
+			}
+			pool.owners[addr] = id
+			m.indexLease(network, id)
+		}
+		if pool.Creator != "" {
+			m.creators[pool.Creator]++
+		}
+	}
+}
+
+// Configure 按 -networks 参数固定服务器提供的网络及其网段，格式为 名称=网段,名称=网段
+// 指定后客户端只能加入这些网络，配置的网段优先于客户端请求的网段；网段变化的网络清空原有租约
+func (m *IPAM) Configure(spec string) error {
+	networks := make(map[string]netip.Prefix)
+	for _, item := range strings.Split(spec, ",") {
+		name, subnet, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || !networkNamePattern.MatchString(name) {
+			return fmt.Errorf("无效的网络配置 %q，格式为 名称=网段", item)
+		}
+		prefix, err := poolPrefix(subnet)
+		if err != nil {
+			return err
+		}
+		networks[name] = prefix
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, pool := range m.networks {
+		prefix, allowed := networks[name]
+		if !allowed {
+			glog.Infof("网络 %s 不在 -networks 中，删除其地址池", name)
+			delete(m.networks, name)
+		} else if pool.Prefix != prefix.String() {
+			glog.Warningf("网络 %s 的网段从 %s 改为 %s，清空原有租约", name, pool.Prefix, prefix)
+			delete(m.networks, name)
+		}
+	}
+	for name, prefix := range networks {
+		if pool := m.networks[name]; pool != nil {
+			pool.Creator = ""
+			continue
+		}
+		m.networks[name] = &AddressPool{Prefix: prefix.String(), Leases: make(map[string]*AddressLease)}
+	}
+	m.configured = true
+	m.dirty = true
+	m.reindex()
+	return nil
+}
+
+// Assign 为客户端分配虚拟IP
+// 网络的地址池由第一个上线的客户端按其配置的网段创建，之后加入的客户端以地址池网段为准；
+// 通过 -networks 指定网络后客户端只能加入已有的网络
+// 已有租约时返回原地址；否则优先使用客户端请求的地址，请求的地址已被其他客户端占用时视为冲突并分配新地址
+func (m *IPAM) Assign(network string, subnet string, clientId string, requested string) (string, bool, error) {
+	if network == "" {
+		network = defaultNetwork
+	}
+	if !networkNamePattern.MatchString(network) {
+		return "", false, fmt.Errorf("网络名称 %q 无效，只能包含字母、数字、下划线、点和连字符，最长32个字符", network)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	pool := m.networks[network]
+	if pool != nil {
+		if lease := pool.Leases[clientId]; lease != nil {
+			lease.LastSeen = now.Unix()
+			m.dirty = true
+			return lease.Address, false, nil
+		}
+		if subnet != "" && subnet != pool.Prefix {
+			glog.Warningf("客户端 %s 配置的网段 %s 与网络 %s 的地址池 %s 不一致，以地址池为准", clientId, subnet, network, pool.Prefix)
+		}
+	}
+	if len(m.clients[clientId]) >= maxLeasesPerClient {
+		return "", false, fmt.Errorf("客户端最多同时加入%d个网络", maxLeasesPerClient)
+	}
+	if pool == nil {
+		var err error
+		if pool, err = m.createPool(network, subnet, clientId); err != nil {
+			return "", false, err
+		}
+	}
+	prefix, err := netip.ParsePrefix(pool.Prefix)
+	if err != nil || !validPoolPrefix(prefix) {
+		return "", false, fmt.Errorf("网络 %s 的地址池 %s 无效", network, pool.Prefix)
+	}
+
+	conflict := false
+	if addr, err := netip.ParseAddr(requested); err == nil && isPoolAddress(prefix, addr) {
+		owner, taken := pool.owners[addr]
+		if !taken {
+			return m.lease(pool, network, clientId, addr, now), false, nil
+		}
+		conflict = true
+		glog.Warningf("客户端 %s 请求的虚拟IP %s 已分配给 %s，重新分配", clientId, requested, owner)
+	}
+	if addr, ok := firstFreeAddress(prefix, pool.owners); ok {
+		return m.lease(pool, network, clientId, addr, now), conflict, nil
+	}
+	return "", conflict, fmt.Errorf("网络 %s 的地址池 %s 已耗尽", network, pool.Prefix)
+}
+
+// createPool 按客户端请求的网段创建网络，调用方需持有锁
+func (m *IPAM) createPool(network string, subnet string, clientId string) (*AddressPool, error) {
+	if m.configured {
+		return nil, fmt.Errorf("网络 %s 不存在", network)
+	}
+	if len(m.networks) >= maxNetworks {
+		return nil, fmt.Errorf("网络数量已达上限 %d", maxNetworks)
+	}
+	if m.creators[clientId] >= maxNetworksPerClient {
+		return nil, fmt.Errorf("客户端最多创建%d个网络", maxNetworksPerClient)
+	}
+	prefix, err := poolPrefix(subnet)
+	if err != nil {
+		return nil, err
+	}
+	pool := &AddressPool{
+		Prefix:  prefix.String(),
+		Creator: clientId,
+		Leases:  make(map[string]*AddressLease),
+		owners:  make(map[netip.Addr]string),
+	}
+	m.networks[network] = pool
+	m.creators[clientId]++
+	m.dirty = true
+	glog.Infof("客户端 %s 创建了网络 %s，网段 %s", clientId, network, pool.Prefix)
+	return pool, nil
+}
+
+// Lookup 获取客户端在与对等节点共同所在网络中的虚拟IP及对应的IPv6虚拟地址，双方没有共同的网络时返回false
+// 网络尚无IPv6虚拟网段时IPv6虚拟地址为空
+func (m *IPAM) Lookup(clientId string, peerId string) (string, string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for network := range m.clients[clientId] {
+		pool := m.networks[network]
+		if pool == nil || pool.Leases[peerId] == nil {
+			continue
+		}
+		if lease := pool.Leases[clientId]; lease != nil {
+			return lease.Address, vip6For(pool.Prefix6, lease.Address), true
+		}
+	}
+	return "", "", false
+}
+
+// Subnet6 获取网络的IPv6虚拟网段，随分配结果下发给客户端
+// 网络还没有IPv6网段时采用客户端请求的ULA网段，客户端未启用IPv6或网段无效时按 RFC 4193 随机生成，之后保持不变
+func (m *IPAM) Subnet6(network string, requested string) string {
+	if network == "" {
+		network = defaultNetwork
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pool := m.networks[network]
+	if pool == nil {
+		return ""
+	}
+	if pool.Prefix6 == "" {
+		prefix, err := netip.ParsePrefix(requested)
+		if err == nil && validPool6Prefix(prefix) {
+			pool.Prefix6 = prefix.Masked().String()
+		} else {
+			pool.Prefix6 = randomULAPrefix().String()
+		}
+		m.dirty = true
+		glog.Infof("网络 %s 的IPv6虚拟网段为 %s", network, pool.Prefix6)
+	}
+	return pool.Prefix6
+}
+
+// Subnet 获取网络的地址池网段，随分配结果下发给客户端
+func (m *IPAM) Subnet(network string) string {
+	if network == "" {
+		network = defaultNetwork
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if pool := m.networks[network]; pool != nil {
+		return pool.Prefix
+	}
+	return ""
+}
+
+// poolPrefix 新建地址池使用的网段，客户端未指定时使用默认网段
+// 网段由客户端指定，超出服务器允许的大小时拒绝，不创建地址池
+func poolPrefix(subnet string) (netip.Prefix, error) {
+	if subnet == "" {
+		return defaultPoolPrefix, nil
+	}
+	prefix, err := netip.ParsePrefix(subnet)
+	if err != nil || !validPoolPrefix(prefix) {
+		return netip.Prefix{}, fmt.Errorf("网段 %s 无效，必须是掩码在/%d到/%d之间的IPv4网段", subnet, minPoolBits, maxPoolBits)
+	}
+	return prefix.Masked(), nil
+}
+
+// lease 记录新的租约，调用方需持有锁
+func (m *IPAM) lease(pool *AddressPool, network string, clientId string, addr netip.Addr, now time.Time) string {
+	pool.Leases[clientId] = &AddressLease{Address: addr.String(), LastSeen: now.Unix()}
+	pool.owners[addr] = clientId
+	m.indexLease(network, clientId)
+	m.dirty = true
+	glog.Infof("已为客户端 %s 在网络 %s 中分配虚拟IP %s", clientId, network, addr)
+	return addr.String()
+}
+
+// indexLease 在客户端索引中记录租约所在的网络，调用方需持有锁
+func (m *IPAM) indexLease(network string, clientId string) {
+	networks := m.clients[clientId]
+	if networks == nil {
+		networks = make(map[string]bool)
+		m.clients[clientId] = networks
+	}
+	networks[network] = true
+}
+
+// expire 回收长期未上线的客户端租约，删除没有租约的客户端创建的网络，调用方需持有锁
+func (m *IPAM) expire(now time.Time) {
+	for network, pool := range m.networks {
+		for id, lease := range pool.Leases {
+			if now.Sub(time.Unix(lease.LastSeen, 0)) <= leaseExpiry {
+				continue
+			}
+			glog.Infof("客户端 %s 在网络 %s 中的虚拟IP租约 %s 已过期，回收该地址", id, network, lease.Address)
+			delete(pool.Leases, id)
+			if addr, err := netip.ParseAddr(lease.Address); err == nil && pool.owners[addr] == id {
+				delete(pool.owners, addr)
+			}
+			if networks := m.clients[id]; networks != nil {
+				delete(networks, network)
+				if len(networks) == 0 {
+					delete(m.clients, id)
+				}
+			}
+			m.dirty = true
+		}
+		if len(pool.Leases) == 0 && pool.Creator != "" {
+			glog.Infof("网络 %s 已没有客户端，删除其地址池", network)
+			delete(m.networks, network)
+			m.creators[pool.Creator]--
+			if m.creators[pool.Creator] <= 0 {
+				delete(m.creators, pool.Creator)
+			}
+			m.dirty = true
+		}
+	}
+}
+
+// ULA（fc00::/7）中本地分配的部分 fd00::/8
+var ulaPrefix = netip.MustParsePrefix("fd00::/8")
+
+// validPool6Prefix IPv6虚拟网段必须是本地分配的ULA，且低32位留给IPv4虚拟IP
+func validPool6Prefix(prefix netip.Prefix) bool {
+	return prefix.Addr().Is6() && !prefix.Addr().Is4In6() && ulaPrefix.Contains(prefix.Addr()) &&
+		prefix.Bits() >= 48 && prefix.Bits() <= 96
+}
+
+// randomULAPrefix 按 RFC 4193 生成 fd00::/8 + 40位随机全局ID + 子网ID 0 组成的 /64 网段
+// 使用随机的全局ID，不同部署的虚拟网络之间不会冲突
+func randomULAPrefix() netip.Prefix {
+	var raw [16]byte
+	raw[0] = 0xfd
+	if _, err := rand.Read(raw[1:6]); err != nil {
+		glog.Errorf("生成IPv6虚拟网段失败: %v", err)
+	}
+	return netip.PrefixFrom(netip.AddrFrom16(raw), 64)
+}
+
+// vip6For 由IPv6虚拟网段前缀和IPv4虚拟IP组成IPv6虚拟地址，与客户端的计算方式一致
+func vip6For(prefix6 string, vip string) string {
+	prefix, err := netip.ParsePrefix(prefix6)
+	addr, addrErr := netip.ParseAddr(vip)
+	if err != nil || addrErr != nil || !addr.Is4() {
+		return ""
+	}
+	raw := prefix.Masked().Addr().As16()
+	v4 := addr.As4()
+	copy(raw[12:], v4[:])
+	return netip.AddrFrom16(raw).String()
+}
+
+// validPoolPrefix 网段是否可以作为地址池，限制地址池的大小
+func validPoolPrefix(prefix netip.Prefix) bool {
+	return prefix.Addr().Is4() && prefix.Bits() >= minPoolBits && prefix.Bits() <= maxPoolBits
+}
+
+// poolSize 地址池网段包含的地址数（含网络地址和广播地址）
+func poolSize(prefix netip.Prefix) uint64 {
+	return uint64(1) << (32 - prefix.Bits())
+}
+
+// firstFreeAddress 按顺序查找地址池中第一个未被占用的地址，跳过网络地址、保留给网关的第一个地址和广播地址
+func firstFreeAddress(prefix netip.Prefix, owners map[netip.Addr]string) (netip.Addr, bool) {
+	network := prefix.Masked().Addr().As4()
+	base := uint64(binary.BigEndian.Uint32(network[:]))
+	size := poolSize(prefix)
+	for offset := uint64(2); offset+1 < size; offset++ {
+		var raw [4]byte
+		binary.BigEndian.PutUint32(raw[:], uint32(base+offset))
+		addr := netip.AddrFrom4(raw)
+		if _, taken := owners[addr]; !taken {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// isPoolAddress 地址是否为地址池中可分配的地址
+func isPoolAddress(prefix netip.Prefix, addr netip.Addr) bool {
+	if !addr.Is4() || !prefix.Contains(addr) {
+		return false
+	}
+	network := prefix.Masked().Addr().As4()
+	raw := addr.As4()
+	offset := uint64(binary.BigEndian.Uint32(raw[:])) - uint64(binary.BigEndian.Uint32(network[:]))
+	return offset >= 2 && offset+1 < poolSize(prefix)
+}
+
+// Maintain 回收过期租约，在租约有变化时写回租约文件
+func (m *IPAM) Maintain() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(time.Now())
+	if !m.dirty {
+		return
+	}
+	data, err := json.MarshalIndent(m.networks, "", "  ")
+	if err != nil {
+		glog.Errorf("序列化虚拟IP租约失败: %v", err)
+		return
+	}
+	if err := os.WriteFile(leaseFile, data, 0600); err != nil {
+		glog.Errorf("保存虚拟IP租约文件失败: %v", err)
+		return
+	}
+	m.dirty = false
+}
+
+// maintainLeases 定期保存虚拟IP租约
+func maintainLeases() {
+	go func() {
+		for {
+			time.Sleep(time.Second * 30)
+			ipam.Maintain()
+		}
+	}()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIPAMAssignKeepsLease(t *testing.T) {
+	m := newIPAM()
+	vip, conflict, err := m.Assign("", "", "a", "10.10.10.7")
+	if err != nil || conflict || vip != "10.10.10.7" {
+		t.Fatalf("Assign = %q %v %v, want 10.10.10.7", vip, conflict, err)
+	}
+	// 请求已被占用的地址时分配新地址
+	vip, conflict, err = m.Assign("default", "", "b", "10.10.10.7")
+	if err != nil || !conflict || vip != "10.10.10.2" {
+		t.Fatalf("Assign = %q %v %v, want 10.10.10.2 冲突", vip, conflict, err)
+	}
+	// 已有租约时忽略请求的地址
+	if vip, _, _ := m.Assign("default", "", "a", "10.10.10.9"); vip != "10.10.10.7" {
+		t.Fatalf("续租返回 %q, want 10.10.10.7", vip)
+	}
+	if vip, _, ok := m.Lookup("a", "b"); !ok || vip != "10.10.10.7" {
+		t.Fatalf("Lookup = %q %v, want 10.10.10.7", vip, ok)
+	}
+	if _, _, ok := m.Lookup("a", "c"); ok {
+		t.Fatal("没有共同网络时 Lookup 成功")
+	}
+}
+
+func TestIPAMRejectsInvalidNetworkName(t *testing.T) {
+	m := newIPAM()
+	for _, name := range []string{"a b", "../x", strings.Repeat("n", 33), "网络"} {
+		if _, _, err := m.Assign(name, "", "a", ""); err == nil {
+			t.Fatalf("网络名称 %q 被接受", name)
+		}
+	}
+	if len(m.networks) != 0 {
+		t.Fatalf("无效的网络名称创建了 %d 个网络", len(m.networks))
+	}
+}
+
+func TestIPAMLimitsPerClient(t *testing.T) {
+	m := newIPAM()
+	for i := 0; i < maxNetworksPerClient; i++ {
+		if _, _, err := m.Assign(fmt.Sprintf("net%d", i), "", "a", ""); err != nil {
+			t.Fatalf("创建第%d个网络: %v", i+1, err)
+		}
+	}
+	if _, _, err := m.Assign("extra", "", "a", ""); err == nil || !strings.Contains(err.Error(), "最多创建") {
+		t.Fatalf("超过创建上限 err = %v", err)
+	}
+	// 其他客户端创建的网络可以加入，但同时持有租约的网络数有上限
+	for i := 0; i < maxLeasesPerClient; i++ {
+		if _, _, err := m.Assign(fmt.Sprintf("shared%d", i), "", fmt.Sprintf("owner%d", i), ""); err != nil {
+			t.Fatalf("创建共享网络: %v", err)
+		}
+	}
+	joined := maxNetworksPerClient
+	for i := 0; joined < maxLeasesPerClient; i++ {
+		if _, _, err := m.Assign(fmt.Sprintf("shared%d", i), "", "a", ""); err != nil {
+			t.Fatalf("加入网络: %v", err)
+		}
+		joined++
+	}
+	if _, _, err := m.Assign(fmt.Sprintf("shared%d", maxLeasesPerClient-1), "", "a", ""); err == nil || !strings.Contains(err.Error(), "最多同时加入") {
+		t.Fatalf("超过租约上限 err = %v", err)
+	}
+}
+
+func TestIPAMConfiguredNetworks(t *testing.T) {
+	m := newIPAM()
+	m.Assign("old", "10.30.0.0/24", "a", "")
+	if err := m.Configure("default=10.20.0.0/24, office=10.21.0.0/16"); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	if _, ok := m.networks["old"]; ok {
+		t.Fatal("未配置的网络没有被删除")
+	}
+	// 配置的网段优先于客户端请求的网段
+	vip, _, err := m.Assign("default", "10.10.10.0/24", "a", "10.10.10.5")
+	if err != nil || vip != "10.20.0.2" {
+		t.Fatalf("Assign = %q %v, want 10.20.0.2", vip, err)
+	}
+	if _, _, err := m.Assign("other", "", "a", ""); err == nil || !strings.Contains(err.Error(), "不存在") {
+		t.Fatalf("加入未配置的网络 err = %v", err)
+	}
+	for _, spec := range []string{"default", "bad name=10.0.0.0/24", "x=10.0.0.0/8"} {
+		if err := newIPAM().Configure(spec); err == nil {
+			t.Fatalf("无效的配置 %q 被接受", spec)
+		}
+	}
+}
+
+func TestIPAMExpireReleasesAddressAndNetwork(t *testing.T) {
+	savedFile := leaseFile
+	leaseFile = t.TempDir() + "/leases.json"
+	defer func() { leaseFile = savedFile }()
+
+	m := newIPAM()
+	m.Assign("team", "10.40.0.0/24", "a", "10.40.0.9")
+	m.Assign("team", "", "b", "")
+	m.networks["team"].Leases["a"].LastSeen = time.Now().Add(-leaseExpiry - time.Hour).Unix()
+	m.Maintain()
+	if _, _, ok := m.Lookup("a", "b"); ok {
+		t.Fatal("过期的租约仍然有效")
+	}
+	if vip, _, _ := m.Assign("team", "", "c", "10.40.0.9"); vip != "10.40.0.9" {
+		t.Fatalf("过期租约的地址没有被回收，分配了 %q", vip)
+	}
+
+	// 没有租约的网络被删除，创建者可以重新创建网络
+	for _, lease := range m.networks["team"].Leases {
+		lease.LastSeen = 0
+	}
+	m.Maintain()
+	if len(m.networks) != 0 || len(m.creators) != 0 || len(m.clients) != 0 {
+		t.Fatalf("过期后仍有 %d 个网络 %d 个创建者 %d 个客户端", len(m.networks), len(m.creators), len(m.clients))
+	}
+
+	// 重新加载租约文件后索引一致
+	m.Assign("team", "10.40.0.0/24", "a", "")
+	m.Assign("team", "", "b", "")
+	m.Maintain()
+	loaded := loadIPAM()
+	if vip, _, ok := loaded.Lookup("b", "a"); !ok || vip != "10.40.0.3" {
+		t.Fatalf("重新加载后 Lookup = %q %v, want 10.40.0.3", vip, ok)
+	}
+	if loaded.creators["a"] != 1 {
+		t.Fatalf("重新加载后创建者计数 = %d, want 1", loaded.creators["a"])
+	}
+}
+
+// TestIPAMSubnet6 网络的IPv6虚拟网段由第一个客户端确定或随机生成，之后保持不变
+func TestIPAMSubnet6(t *testing.T) {
+	m := newIPAM()
+	m.Assign("a-net", "", "a", "10.10.10.5")
+	m.Assign("a-net", "", "b", "")
+	if got := m.Subnet6("a-net", "fd12:3456:789a::/64"); got != "fd12:3456:789a::/64" {
+		t.Fatalf("Subnet6 = %q, want 客户端请求的网段", got)
+	}
+	if got := m.Subnet6("a-net", "fdff::/64"); got != "fd12:3456:789a::/64" {
+		t.Fatalf("之后的客户端 Subnet6 = %q, want 保持不变", got)
+	}
+	if _, vip6, _ := m.Lookup("a", "b"); vip6 != "fd12:3456:789a::a0a:a05" {
+		t.Fatalf("Lookup vip6 = %q, want fd12:3456:789a::a0a:a05", vip6)
+	}
+
+	// 非ULA或过大的网段不被采用，改为随机生成 fdxx:xxxx:xxxx::/64
+	for i, requested := range []string{"", "2001:db8::/64", "fd00::/32", "10.0.0.0/8"} {
+		network := fmt.Sprintf("n%d", i)
+		m.Assign(network, "", network, "")
+		got := m.Subnet6(network, requested)
+		prefix, err := netip.ParsePrefix(got)
+		if err != nil || prefix.Bits() != 64 || !ulaPrefix.Contains(prefix.Addr()) || got == requested {
+			t.Fatalf("请求 %q 时 Subnet6 = %q, want 随机的ULA /64", requested, got)
+		}
+	}
+	if randomULAPrefix() == randomULAPrefix() {
+		t.Fatal("两次生成的全局ID相同")
+	}
+}
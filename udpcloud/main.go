@@ -1,7 +1,10 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"net"
+	"net/netip"
 	"time"
 
 	"github.com/venshao/natun/gjson"
@@ -16,20 +19,23 @@ type NatSession struct {
 	peerTwoId   string
 	peerTwoAddr *net.UDPAddr
 	peerTwoConn *net.UDPConn
+	// 被动方的PAKE回复及确认值，随connectPeer转交给发起方，服务器无法据此猜测密码
+	pakeReply   string
+	pakeConfirm string
+	// 本次连接请求的失败计数键，密码验证通过后清除
+	attemptKeys []string
 }
 
 type Client struct {
 	addr         *net.UDPAddr
 	conn         *net.UDPConn
 	lastBeatTime int64
+	candidates   []*net.UDPAddr // 客户端上报的IPv6直连地址，打洞时优先尝试
+	mapped       *net.UDPAddr   // 客户端在路由器上映射的外部地址，打洞时优先尝试
+	natType      string         // 客户端检测到的NAT类型，转交给对等节点选择打洞策略
+	portDelta    int            // 客户端NAT为不同目的地址分配端口的步长
 }
 
-// 客户端id -> 客户端信息的映射关系
-var clientMap = make(map[string]*Client)
-
-// 客户端id -> NatSession的映射关系
-var natSessionMap = make(map[string]*NatSession)
-
 // 客户端的心跳检测
 func pingHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.Json) {
 	beatTime := time.Now().Unix()
@@ -39,27 +45,33 @@ func pingHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.
 		"clientPort": addr.Port,
 		"timestamp":  beatTime,
 	}
-	sendJSON(conn, addr, resp)
+	if probeConn != nil {
+		// 客户端向探测端口发送 natProbe 检测NAT类型
+		resp["probePort"] = probePort
+	}
 	id := json.GetString("id")
-	client := clientMap[id]
-	if client == nil {
-		clientMap[id] = &Client{
-			addr:         addr,
-			conn:         conn,
-			lastBeatTime: beatTime,
-		}
+	// 分配或续租虚拟IP，随pong下发给客户端
+	network := json.GetString("net")
+	vip, conflict, err := ipam.Assign(network, json.GetString("subnet"), id, json.GetString("vip"))
+	if err != nil {
+		glog.Errorf("为客户端 %s 分配虚拟IP失败: %v", id, err)
+		resp["vipError"] = err.Error()
 	} else {
-		if client.addr.String() != addr.String() {
-			glog.Warningf("收到来自客户端id=%s的心跳, ip=%s, 但是之前已经存在ip=%s，通知其对等节点与之断开", id, addr.String(), client.addr.String())
-			// 需要通知当前客户端的对等节点断开与当前客户端的连接
-			session := natSessionMap[id]
-			if session != nil {
-				notifyPeerDisconnect(session, id)
-			}
+		resp["vip"] = vip
+		resp["vipConflict"] = conflict
+		resp["subnet"] = ipam.Subnet(network)
+		resp["subnet6"] = ipam.Subnet6(network, json.GetString("subnet6"))
+	}
+	sendJSON(conn, addr, resp)
+	prevAddr := registry.Beat(id, conn, addr, beatTime)
+	registry.SetCandidates(id, parseCandidates(json.GetStrings("ip6")), parseMapped(json.GetString("mapped"), addr))
+	registry.SetNatInfo(id, json.GetString("natType"), json.GetInt("portDelta"))
+	if prevAddr != nil && prevAddr.String() != addr.String() {
+		glog.Warningf("收到来自客户端id=%s的心跳, ip=%s, 但是之前已经存在ip=%s，通知其对等节点与之断开", id, addr.String(), prevAddr.String())
+		// 需要通知当前客户端的对等节点断开与当前客户端的连接
+		for _, session := range registry.GetNatSessions(id) {
+			notifyPeerDisconnect(session, id, disconnectAddrChanged)
 		}
-		client.addr = addr
-		client.conn = conn
-		client.lastBeatTime = beatTime
 	}
 	glog.Debugf("收到来自客户端id=%s的心跳, ip=%s ", id, addr.String())
 }
@@ -68,26 +80,35 @@ func pingHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.
 func notifyChangePortHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.Json) {
 	srcId := json.GetString("srcId")
 	targetId := json.GetString("targetId")
-	targetPassword := json.GetString("tp")
-	if srcId == "" || targetId == "" || srcId == targetId || targetPassword == "" {
+	sessionSalt := json.GetString("s")
+	pakeMessage := json.GetString("pa")
+	if srcId == "" || targetId == "" || srcId == targetId || pakeMessage == "" {
+		metrics.HandlerError(path, errBadRequest)
 		return
 	}
+	metrics.PunchRequested()
 	// 刷新客户端地址信息
 	refreshClientInfo(conn, addr, srcId)
-	srcClient := clientMap[srcId]
-	targetClient := clientMap[targetId]
-	if srcClient == nil {
-		glog.Warningf("通过 srcId %s 无法找到对应的客户端，忽略", srcId)
+	srcClient, _ := registry.GetClient(srcId)
+	targetClient, targetExists := registry.GetClient(targetId)
+	if !targetExists {
+		glog.Warningf("通过 targetId %s 无法找到对应的客户端，忽略", targetId)
+		metrics.PunchResult(punchTargetOffline)
 		return
 	}
-	if targetClient == nil {
-		glog.Warningf("通过 targetId %s 无法找到对应的客户端，忽略", targetId)
+	// 限制针对同一目标或来自同一来源的密码猜测
+	attemptKeys := connectAttemptKeys(srcId, addr, targetId)
+	if !allowConnectAttempt(conn, addr, targetId, attemptKeys) {
+		metrics.PunchResult(punchRejected)
 		return
 	}
 	// 向target节点发送changePort命令
 	sendJSON(targetClient.conn, targetClient.addr, map[string]interface{}{
-		"path": "changePort",
-		"p":    targetPassword,
+		"path":    "changePort",
+		"srcId":   srcId,
+		"srcAddr": addr.String(),
+		"s":       sessionSalt,
+		"pa":      pakeMessage,
 	})
 	glog.Debugf("已向%s发送changePort命令", targetId)
 	// 记录当前NAT会话状态
@@ -98,107 +119,151 @@ func notifyChangePortHandler(conn *net.UDPConn, addr *net.UDPAddr, path string,
 		peerTwoId:   targetId,
 		peerTwoAddr: targetClient.addr,
 		peerTwoConn: targetClient.conn,
+		attemptKeys: attemptKeys,
 	}
-	natSessionMap[srcId] = session
-	natSessionMap[targetId] = session
+	registry.PutNatSession(session)
 }
 
 // target 节点收到changePort命令后，会更换端口然后再回调此接口
 func portChangedHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.Json) {
 	targetId := json.GetString("clientId")
+	srcId := json.GetString("srcId")
 	glog.Debugf("收到 %s 的端口已变更回调", targetId)
 	// 刷新target客户端地址信息
 	refreshClientInfo(conn, addr, targetId)
 	// 走到这里说明被通知更换端口的客户端已经更换完毕端口，开始通知双方打洞
-	session := natSessionMap[targetId]
-	if session == nil {
-		glog.Warningf("通过 targetId %s 无法找到对应NAT会话，忽略", targetId)
+	// 也要更新NAT会话信息中被动方的连接信息
+	session, exists := registry.UpdateNatSession(srcId, targetId, func(session *NatSession) {
+		session.peerTwoConn = conn
+		session.peerTwoAddr = addr
+		session.pakeReply = json.GetString("pb")
+		session.pakeConfirm = json.GetString("cb")
+	})
+	if !exists {
+		glog.Warningf("无法找到 %s 与 %s 的NAT会话，忽略", srcId, targetId)
+		metrics.PunchResult(punchNoSession)
 		return
 	}
-	// 也要更新NAT会话信息中被动方的连接信息
-	session.peerTwoConn = conn
-	session.peerTwoAddr = addr
 	// 通知客户端双方同时连接对方
 	sendTraverseCommand(session)
 }
 
 func sendTraverseCommand(session *NatSession) {
-	srcClient := clientMap[session.peerOneId]
-	targetClient := clientMap[session.peerTwoId]
-	if srcClient == nil || targetClient == nil {
+	srcClient, srcExists := registry.GetClient(session.peerOneId)
+	targetClient, targetExists := registry.GetClient(session.peerTwoId)
+	if !srcExists || !targetExists {
 		glog.Warning("srcClient 或 targetClient 为空，不通知打洞")
+		metrics.PunchResult(punchTargetOffline)
 		return
 	}
 	glog.Debugf("开始通知 %s 和 %s 双方打洞", session.peerOneId, session.peerTwoId)
-	srcClientData := buildNatClientJson(srcClient, session.peerOneId)
-	targetClientData := buildNatClientJson(targetClient, session.peerTwoId)
+	srcClientData := buildNatClientJson(&srcClient, session.peerOneId, session.peerTwoId)
+	targetClientData := buildNatClientJson(&targetClient, session.peerTwoId, session.peerOneId)
+	// 发起方需要被动方的PAKE回复来完成密码认证
+	if len(targetClientData) > 0 {
+		targetClientData["pb"] = session.pakeReply
+		targetClientData["cb"] = session.pakeConfirm
+	}
 	sendJSON(srcClient.conn, srcClient.addr, targetClientData)
 	sendJSON(targetClient.conn, targetClient.addr, srcClientData)
+	metrics.PunchResult(punchTraversed)
 }
 
 func refreshClientInfo(conn *net.UDPConn, addr *net.UDPAddr, clientId string) {
-	client := clientMap[clientId]
-	if client == nil {
-		clientMap[clientId] = &Client{
-			addr:         addr,
-			conn:         conn,
-			lastBeatTime: time.Now().Unix(),
-		}
-		client = clientMap[clientId]
-	} else {
-		client.conn = conn
-		client.addr = addr
-	}
+	registry.RefreshClient(clientId, conn, addr, time.Now().Unix())
 }
 
-func buildNatClientJson(client *Client, clientId string) interface{} {
+func buildNatClientJson(client *Client, clientId string, peerId string) map[string]interface{} {
 	glog.Debugf("获取客户端JSON %s", client.addr.String())
 	// 确保地址有效
 	if client.addr == nil || client.addr.IP == nil {
 		return map[string]interface{}{}
 	}
 
-	// 提取IPv4字节（兼容IPv4映射的IPv6地址）
-	ipv4 := client.addr.IP.To4()
-	if ipv4 == nil {
-		return map[string]interface{}{}
+	// 地址以文本形式下发，IPv4映射的IPv6地址会还原为IPv4形式
+	ip := client.addr.IP
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
 	}
 	// todo recovery
 	// if clientId == "75992258" {
-	// ipv4 = net.ParseIP("192.168.93.34").To4() //linux
+	// ip = net.ParseIP("192.168.93.34").To4() //linux
 	// } else if clientId == "45173539" {
-	// ipv4 = net.ParseIP("192.168.93.10").To4() // windows
+	// ip = net.ParseIP("192.168.93.10").To4() // windows
 	// } else if clientId == "51157139" {
-	// ipv4 = net.ParseIP("192.168.0.110").To4() // mac
+	// ip = net.ParseIP("192.168.0.110").To4() // mac
 	// }
-	// 构建数据映射（带类型转换）
-	return map[string]interface{}{
-		"path":     "connectPeer",
-		"ip0":      int8(ipv4[0]),    // 第一个字节转为int8
-		"ip1":      int8(ipv4[1]),    // 第二个字节转为int8
-		"ip2":      int8(ipv4[2]),    // 第三个字节转为int8
-		"ip3":      int8(ipv4[3]),    // 第四个字节转为int8
-		"port":     client.addr.Port, // todo recovery client.addr.Port,
-		"clientId": clientId,
+	candidates := make([]string, 0, len(client.candidates))
+	for _, candidate := range client.candidates {
+		candidates = append(candidates, candidate.String())
+	}
+	mapped := ""
+	if client.mapped != nil {
+		mapped = client.mapped.String()
+	}
+	// 构建数据映射
+	data := map[string]interface{}{
+		"path":      "connectPeer",
+		"ip":        ip.String(),
+		"port":      client.addr.Port, // todo recovery client.addr.Port,
+		"ip6":       candidates,       // IPv6直连候选地址，对等节点优先尝试
+		"mapped":    mapped,           // 路由器端口映射的外部地址，对等节点优先尝试
+		"natType":   client.natType,   // 对方的NAT类型和端口分配步长，用于选择打洞策略
+		"portDelta": client.portDelta,
+		"clientId":  clientId,
+	}
+	// 客户端在双方共同网络中租用的虚拟IP，对等节点据此校验直连心跳中声明的虚拟IP
+	if vip, _, ok := ipam.Lookup(clientId, peerId); ok {
+		data["vip"] = vip
+	}
+	return data
+}
+
+// 每个客户端最多登记的IPv6候选地址数量，避免被用来让对等节点向大量地址发包
+const maxCandidates = 4
+
+// parseCandidates 解析客户端上报的IPv6候选地址，只接受全局单播地址
+func parseCandidates(values []string) []*net.UDPAddr {
+	var candidates []*net.UDPAddr
+	for _, value := range values {
+		if len(candidates) >= maxCandidates {
+			break
+		}
+		addrPort, err := netip.ParseAddrPort(value)
+		if err != nil {
+			continue
+		}
+		ip := addrPort.Addr()
+		if !ip.Is6() || ip.Is4In6() || !ip.IsGlobalUnicast() || ip.IsPrivate() || addrPort.Port() == 0 {
+			continue
+		}
+		candidates = append(candidates, net.UDPAddrFromAddrPort(addrPort))
 	}
+	return candidates
+}
+
+// parseMapped 解析客户端上报的路由器映射地址
+// 只接受与注册中心看到的公网IP相同的地址，避免被用来让对等节点向任意地址发包
+func parseMapped(value string, addr *net.UDPAddr) *net.UDPAddr {
+	addrPort, err := netip.ParseAddrPort(value)
+	if err != nil || addrPort.Port() == 0 {
+		return nil
+	}
+	observed, ok := netip.AddrFromSlice(addr.IP)
+	if !ok || addrPort.Addr().Unmap() != observed.Unmap() {
+		return nil
+	}
+	return net.UDPAddrFromAddrPort(addrPort)
 }
 
 func autoRemoveOfflineClient() {
 	go func() {
 		for {
-			now := time.Now().Unix()
-			for clientId, client := range clientMap {
-				if now-client.lastBeatTime > 30 {
-					delete(clientMap, clientId)
-					glog.Debugf("客户端 %s 已下线!", clientId)
-					session := natSessionMap[clientId]
-					if session == nil {
-						continue
-					}
-					// 清理已关闭的NAT会话
-					delete(natSessionMap, session.peerTwoId)
-					delete(natSessionMap, session.peerOneId)
-					notifyPeerDisconnect(session, clientId)
+			// 移除离线客户端时一并清理其NAT会话，通知对等节点在锁外进行
+			for _, offline := range registry.RemoveOfflineClients(time.Now().Unix(), 30) {
+				glog.Debugf("客户端 %s 已下线!", offline.clientId)
+				for _, session := range offline.sessions {
+					notifyPeerDisconnect(session, offline.clientId, disconnectOffline)
 				}
 			}
 			time.Sleep(time.Second * 1)
@@ -206,7 +271,33 @@ func autoRemoveOfflineClient() {
 	}()
 }
 
-func notifyPeerDisconnect(session *NatSession, offlineClientId string) {
+// disconnectHandler 客户端主动断开与对等节点的连接，删除双方的NAT会话和中转会话并通知对方断开
+func disconnectHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.Json) {
+	targetId := json.GetString("targetId")
+	srcId := senderId(addr, json)
+	if srcId == "" || targetId == "" {
+		glog.Warningf("断开连接失败：无法识别发送方 %s 或缺少targetId参数", addr.String())
+		metrics.HandlerError(path, errBadRequest)
+		return
+	}
+	session, exists := registry.RemoveNatSession(srcId, targetId)
+	if !exists {
+		metrics.HandlerError(path, errNoSession)
+		glog.Debugf("%s 与 %s 之间没有NAT会话，忽略断开请求", srcId, targetId)
+		return
+	}
+	glog.Infof("%s 主动断开与 %s 的连接", srcId, targetId)
+	notifyPeerDisconnect(session, srcId, disconnectClosed)
+}
+
+// 通知对等节点断开的原因，对方下线或更换地址时对等节点会自动重连，主动断开时不重连
+const (
+	disconnectOffline     = "offline"
+	disconnectAddrChanged = "addrChanged"
+	disconnectClosed      = "closed"
+)
+
+func notifyPeerDisconnect(session *NatSession, offlineClientId string, reason string) {
 	// 禁用中转模式
 	disableRelay(session.peerOneId, session.peerTwoId)
 
@@ -220,16 +311,32 @@ func notifyPeerDisconnect(session *NatSession, offlineClientId string) {
 		id = session.peerTwoId
 	}
 	sendJSON(conn, addr, map[string]interface{}{
-		"path": "disconnectPeer",
+		"path":   "disconnectPeer",
+		"peerId": offlineClientId,
+		"reason": reason,
 	})
 	glog.Debugf("已通知 %s 与对等节点断开连接", id)
 }
 
 func main() {
+	flag.StringVar(&metricsAddr, "metrics", "", "监控指标的HTTP监听地址，如 127.0.0.1:9109，不指定时不启动")
+	networks := flag.String("networks", "", "服务器提供的虚拟网络，如 default=10.10.10.0/24,office=10.20.0.0/16，指定后客户端不能自行创建网络")
+	flag.Parse()
+	if *networks != "" {
+		if err := ipam.Configure(*networks); err != nil {
+			panic(fmt.Sprintf("网络配置无效: %v", err))
+		}
+	}
+
 	// 注册路由处理函数
 	RegisterHandler("ping", pingHandler)
 	RegisterHandler("notifyChangePort", notifyChangePortHandler)
 	RegisterHandler("portChanged", portChangedHandler)
+	RegisterHandler("authResult", authResultHandler)
+	RegisterHandler("disconnect", disconnectHandler)
+
+	// 注册NAT类型探测处理函数
+	RegisterHandler("natProbe", natProbeHandler)
 
 	// 注册中转相关处理函数
 	RegisterHandler("enableRelay", enableRelayHandler)
@@ -238,9 +345,19 @@ func main() {
 	RegisterHandler("relayLatencyTest", relayLatencyTestHandler)
 	// 注册中转延迟回复处理函数
 	RegisterHandler("relayLatencyReply", relayLatencyReplyHandler)
+	// 注册中转模式下重新打洞处理函数
+	RegisterHandler("repunch", repunchHandler)
 
 	// 自动移除离线节点
 	autoRemoveOfflineClient()
+	// 定期保存客户端身份登记
+	maintainIdentities()
+	// 定期保存虚拟IP租约
+	maintainLeases()
+	// 启动监控指标服务
+	startMetricsServer()
+	// 启动NAT探测端口
+	startProbeServer(probePort)
 	// 启动服务器
 	startUDPServer(17709)
 }
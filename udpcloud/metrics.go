@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/venshao/natun/glog"
+)
+
+// 监控指标：以Prometheus文本格式在可选的HTTP监听地址上输出，未指定 -metrics 时不启动
+// 指标只包含汇总数据，不包含客户端ID和地址；标签值都是固定的原因或已注册的路径，不会被客户端随意构造
+const metricsSampleInterval = time.Second
+
+// 打洞请求的结果
+const (
+	punchRejected      = "rejected"       // 尝试过于频繁被拒绝
+	punchTargetOffline = "target_offline" // 目标客户端不在线
+	punchNoSession     = "no_session"     // 目标客户端回调时找不到NAT会话
+	punchTraversed     = "traversed"      // 已通知双方同时打洞
+	punchAuthOk        = "auth_ok"        // 目标客户端报告密码验证通过
+	punchAuthFailed    = "auth_failed"    // 目标客户端报告密码验证失败
+	punchRelayed       = "relayed"        // 打洞失败后双方启用了中转
+)
+
+// 处理请求失败的原因
+const (
+	errInvalidJson   = "invalid_json"
+	errMissingPath   = "missing_path"
+	errUnknownPath   = "unknown_path"
+	errUnauthorized  = "unauthorized"
+	errBadRequest    = "bad_request"    // 缺少必要参数
+	errUnknownSender = "unknown_sender" // 无法根据地址识别发送方
+	errNoSession     = "no_session"     // 双方之间没有相应的会话
+	errNoLease       = "no_lease"       // 双方不在同一网络或没有虚拟IP租约
+	errTargetOffline = "target_offline"
+	errPanic         = "panic"
+)
+
+// 中转数据被丢弃的原因
+const (
+	relayDropLength     = "length_mismatch"
+	relayDropUnknownSrc = "unknown_sender"
+	relayDropNoSession  = "no_session"
+	relayDropNoTarget   = "target_offline"
+	relayDropSendError  = "send_error"
+)
+
+// labelPair 两个标签值组成的计数键
+type labelPair struct {
+	first  string
+	second string
+}
+
+// Metrics 注册中心的监控计数
+type Metrics struct {
+	startTime time.Time
+
+	relayBytes   atomic.Uint64 // 已转发的中转数据字节数（不含协议头）
+	relayPackets atomic.Uint64
+	relayRates   atomic.Value // 最近一秒的转发速率 relayRate
+
+	mu            sync.Mutex
+	relayDropped  map[string]uint64    // 原因 -> 丢弃的中转数据包数
+	punchResults  map[string]uint64    // 结果 -> 次数
+	punchRequests uint64               // 收到的打洞请求数
+	handlerErrors map[labelPair]uint64 // (path, 原因) -> 次数
+}
+
+// relayRate 最近一个采样间隔的中转速率
+type relayRate struct {
+	bytes   uint64
+	packets uint64
+}
+
+var metrics = newMetrics()
+
+// metrics 的HTTP监听地址，如 127.0.0.1:9109，为空时不启动
+var metricsAddr string
+
+func newMetrics() *Metrics {
+	m := &Metrics{
+		startTime:     time.Now(),
+		relayDropped:  make(map[string]uint64),
+		punchResults:  make(map[string]uint64),
+		handlerErrors: make(map[labelPair]uint64),
+	}
+	m.relayRates.Store(relayRate{})
+	return m
+}
+
+// RelayForwarded 记录一个成功转发的中转数据包
+func (m *Metrics) RelayForwarded(n int) {
+	m.relayBytes.Add(uint64(n))
+	m.relayPackets.Add(1)
+}
+
+// RelayDropped 记录一个被丢弃的中转数据包
+func (m *Metrics) RelayDropped(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.relayDropped[reason]++
+}
+
+// PunchRequested 记录一次打洞请求
+func (m *Metrics) PunchRequested() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.punchRequests++
+}
+
+// PunchResult 记录打洞请求的结果
+func (m *Metrics) PunchResult(result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.punchResults[result]++
+}
+
+// HandlerError 记录处理请求失败，path 必须是已注册的路径或空字符串
+func (m *Metrics) HandlerError(path string, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlerErrors[labelPair{path, reason}]++
+}
+
+// sampleRelay 每秒计算中转转发速率
+func (m *Metrics) sampleRelay() {
+	go func() {
+		ticker := time.NewTicker(metricsSampleInterval)
+		defer ticker.Stop()
+		var lastBytes, lastPackets uint64
+		for range ticker.C {
+			bytes, packets := m.relayBytes.Load(), m.relayPackets.Load()
+			// 采样间隔为1秒，两次采样之差即为速率
+			m.relayRates.Store(relayRate{bytes: bytes - lastBytes, packets: packets - lastPackets})
+			lastBytes, lastPackets = bytes, packets
+		}
+	}()
+}
+
+// Write 以Prometheus文本格式输出全部指标
+func (m *Metrics) Write(w io.Writer) {
+	clients, natSessions, relaySessions := registry.Counts()
+	writeGauge(w, "natun_registered_clients", "在线的已注册客户端数", uint64(clients))
+	writeGauge(w, "natun_nat_sessions", "进行中的NAT打洞会话数", uint64(natSessions))
+	writeGauge(w, "natun_relay_sessions", "已启用的中转会话数", uint64(relaySessions))
+
+	writeCounter(w, "natun_relay_bytes_total", "已转发的中转数据字节数", m.relayBytes.Load())
+	writeCounter(w, "natun_relay_packets_total", "已转发的中转数据包数", m.relayPackets.Load())
+	rate := m.relayRates.Load().(relayRate)
+	writeGauge(w, "natun_relay_bytes_per_second", "最近一秒的中转转发字节数", rate.bytes)
+	writeGauge(w, "natun_relay_packets_per_second", "最近一秒的中转转发包数", rate.packets)
+
+	m.mu.Lock()
+	punchRequests := m.punchRequests
+	relayDropped := copyCounts(m.relayDropped)
+	punchResults := copyCounts(m.punchResults)
+	handlerErrors := make(map[labelPair]uint64, len(m.handlerErrors))
+	for key, value := range m.handlerErrors {
+		handlerErrors[key] = value
+	}
+	m.mu.Unlock()
+
+	writeLabeledCounter(w, "natun_relay_dropped_packets_total", "被丢弃的中转数据包数", "reason", relayDropped)
+	writeCounter(w, "natun_punch_requests_total", "收到的打洞请求数", punchRequests)
+	writeLabeledCounter(w, "natun_punch_results_total", "打洞请求的结果", "result", punchResults)
+
+	writeHeader(w, "natun_handler_errors_total", "处理请求失败的次数", "counter")
+	keys := make([]labelPair, 0, len(handlerErrors))
+	for key := range handlerErrors {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].first != keys[j].first {
+			return keys[i].first < keys[j].first
+		}
+		return keys[i].second < keys[j].second
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "natun_handler_errors_total{path=%q,reason=%q} %d\n", key.first, key.second, handlerErrors[key])
+	}
+
+	writeGauge(w, "natun_start_time_seconds", "服务器启动时间（Unix时间戳）", uint64(m.startTime.Unix()))
+}
+
+func copyCounts(counts map[string]uint64) map[string]uint64 {
+	copied := make(map[string]uint64, len(counts))
+	for key, value := range counts {
+		copied[key] = value
+	}
+	return copied
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeGauge(w io.Writer, name string, help string, value uint64) {
+	writeHeader(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func writeCounter(w io.Writer, name string, help string, value uint64) {
+	writeHeader(w, name, help, "counter")
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+// writeLabeledCounter 输出带一个标签的计数，按标签值排序
+func writeLabeledCounter(w io.Writer, name string, help string, label string, counts map[string]uint64) {
+	writeHeader(w, name, help, "counter")
+	values := make([]string, 0, len(counts))
+	for value := range counts {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, value, counts[value])
+	}
+}
+
+// metricsHandler 输出 /metrics
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.Write(w)
+}
+
+// startMetricsServer 在 metricsAddr 上启动监控指标的HTTP服务
+func startMetricsServer() {
+	if metricsAddr == "" {
+		return
+	}
+	listener, err := net.Listen("tcp", metricsAddr)
+	if err != nil {
+		glog.Errorf("监控指标服务监听 %s 失败: %v", metricsAddr, err)
+		return
+	}
+	metrics.sampleRelay()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	glog.Infof("监控指标服务已启动，地址: http://%s/metrics", listener.Addr())
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			glog.Errorf("监控指标服务已停止: %v", err)
+		}
+	}()
+}
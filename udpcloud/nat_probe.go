@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"net"
+
+	"github.com/venshao/natun/gjson"
+	"github.com/venshao/natun/glog"
+)
+
+// NAT探测端口，客户端比较从主端口和探测端口看到的映射地址来判断NAT的映射和过滤行为
+var probePort = 17710
+
+// 探测端口的监听，未启动时为nil
+var probeConn *net.UDPConn
+
+// natProbeHandler 返回注册中心看到的客户端映射地址
+// reply 为 "alt" 时改从探测端口回复，客户端能收到说明NAT不按端口过滤入站报文
+func natProbeHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.Json) {
+	replyConn := conn
+	if json.GetString("reply") == "alt" {
+		if probeConn == nil {
+			return
+		}
+		replyConn = probeConn
+	}
+	ip := addr.IP
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+	sendJSON(replyConn, addr, map[string]interface{}{
+		"path":       "natProbeResult",
+		"seq":        json.GetInt64("seq"),
+		"mappedIp":   ip.String(),
+		"mappedPort": addr.Port,
+	})
+}
+
+// startProbeServer 启动NAT探测端口，只处理 natProbe 请求
+func startProbeServer(port int) {
+	listen, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		glog.Errorf("NAT探测端口 %d 监听失败，客户端将无法检测NAT类型: %v", port, err)
+		return
+	}
+	probeConn = listen
+	glog.Infof("NAT探测服务已启动，监听地址: %s", listen.LocalAddr())
+
+	go func() {
+		body := make([]byte, 2048)
+		var backoff readBackoff
+		for {
+			n, clientAddr, err := listen.ReadFromUDP(body)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					glog.Infof("NAT探测服务已停止")
+					return
+				}
+				glog.Errorf("NAT探测端口读取数据失败: %v", err)
+				backoff.wait()
+				continue
+			}
+			backoff.reset()
+			signed, parseJSON, err := ParseSignedMessage(body[:n])
+			if err != nil || parseJSON.GetString("path") != "natProbe" {
+				continue
+			}
+			// 与主端口一样要求有效签名，避免被用来向任意地址发送报文
+			if err := identityRegistry.Verify("natProbe", signed, parseJSON, clientAddr); err != nil {
+				glog.Warningf("拒绝来自 %s 的NAT探测: %v", clientAddr.String(), err)
+				continue
+			}
+			natProbeHandler(listen, clientAddr, "natProbe", parseJSON)
+		}
+	}()
+}
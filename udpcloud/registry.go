@@ -0,0 +1,272 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// Registry 注册中心的全部共享状态
+// 每个UDP报文都在独立的goroutine中处理，所有状态只能通过 Registry 的方法在持有锁时访问，
+// 对外返回的都是副本，避免调用方在锁外读写共享对象
+type Registry struct {
+	mu            sync.RWMutex
+	clients       map[string]*Client       // 客户端id -> 客户端信息
+	addrIndex     map[string]string        // 客户端地址 -> 客户端id
+	natSessions   map[string]*NatSession   // 会话键 -> NAT打洞会话
+	relaySessions map[string]*RelaySession // 会话键 -> 中转会话
+}
+
+// OfflineClient 被移除的离线客户端及其参与的NAT会话
+type OfflineClient struct {
+	clientId string
+	sessions []*NatSession
+}
+
+var registry = NewRegistry()
+
+// NewRegistry 创建空的注册中心状态
+func NewRegistry() *Registry {
+	return &Registry{
+		clients:       make(map[string]*Client),
+		addrIndex:     make(map[string]string),
+		natSessions:   make(map[string]*NatSession),
+		relaySessions: make(map[string]*RelaySession),
+	}
+}
+
+// Beat 记录客户端心跳，返回客户端之前的地址（首次上线返回nil）
+func (r *Registry) Beat(clientId string, conn *net.UDPConn, addr *net.UDPAddr, beatTime int64) *net.UDPAddr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client := r.clients[clientId]
+	if client == nil {
+		r.clients[clientId] = &Client{addr: addr, conn: conn, lastBeatTime: beatTime}
+		r.addrIndex[addr.String()] = clientId
+		return nil
+	}
+	prevAddr := client.addr
+	r.setClientAddr(clientId, client, conn, addr)
+	client.lastBeatTime = beatTime
+	return prevAddr
+}
+
+// RefreshClient 更新客户端地址信息，不刷新心跳时间
+func (r *Registry) RefreshClient(clientId string, conn *net.UDPConn, addr *net.UDPAddr, now int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client := r.clients[clientId]
+	if client == nil {
+		r.clients[clientId] = &Client{addr: addr, conn: conn, lastBeatTime: now}
+		r.addrIndex[addr.String()] = clientId
+		return
+	}
+	r.setClientAddr(clientId, client, conn, addr)
+}
+
+// SetCandidates 更新客户端上报的IPv6候选地址和路由器映射地址
+func (r *Registry) SetCandidates(clientId string, candidates []*net.UDPAddr, mapped *net.UDPAddr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if client := r.clients[clientId]; client != nil {
+		client.candidates = candidates
+		client.mapped = mapped
+	}
+}
+
+// SetNatInfo 更新客户端上报的NAT类型和端口分配步长
+func (r *Registry) SetNatInfo(clientId string, natType string, portDelta int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if client := r.clients[clientId]; client != nil {
+		client.natType = natType
+		client.portDelta = portDelta
+	}
+}
+
+// setClientAddr 更新客户端地址并维护地址索引，调用方需持有写锁
+func (r *Registry) setClientAddr(clientId string, client *Client, conn *net.UDPConn, addr *net.UDPAddr) {
+	if client.addr != nil && r.addrIndex[client.addr.String()] == clientId {
+		delete(r.addrIndex, client.addr.String())
+	}
+	client.addr = addr
+	client.conn = conn
+	r.addrIndex[addr.String()] = clientId
+}
+
+// GetClient 获取客户端信息的副本
+func (r *Registry) GetClient(clientId string) (Client, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	client := r.clients[clientId]
+	if client == nil {
+		return Client{}, false
+	}
+	return *client, true
+}
+
+// Counts 在线客户端数、NAT会话数和已启用的中转会话数
+func (r *Registry) Counts() (clients int, natSessions int, relaySessions int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, session := range r.relaySessions {
+		if session.enabled {
+			relaySessions++
+		}
+	}
+	return len(r.clients), len(r.natSessions), relaySessions
+}
+
+// ClientIdByAddr 根据地址获取客户端ID，地址未登记时返回空字符串
+func (r *Registry) ClientIdByAddr(addr *net.UDPAddr) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.addrIndex[addr.String()]
+}
+
+// RemoveOfflineClients 移除超过 timeout 秒没有心跳的客户端，并清理其参与的全部NAT会话
+func (r *Registry) RemoveOfflineClients(now int64, timeout int64) []OfflineClient {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var removed []OfflineClient
+	for clientId, client := range r.clients {
+		if now-client.lastBeatTime <= timeout {
+			continue
+		}
+		delete(r.clients, clientId)
+		if r.addrIndex[client.addr.String()] == clientId {
+			delete(r.addrIndex, client.addr.String())
+		}
+		offline := OfflineClient{clientId: clientId}
+		for sessionKey, session := range r.natSessions {
+			if session.peerOneId == clientId || session.peerTwoId == clientId {
+				delete(r.natSessions, sessionKey)
+				copied := *session
+				offline.sessions = append(offline.sessions, &copied)
+			}
+		}
+		removed = append(removed, offline)
+	}
+	return removed
+}
+
+// PutNatSession 记录两个客户端之间新的NAT会话
+// 新的连接请求说明双方之间之前的连接已失效，同时清除其中转会话
+func (r *Registry) PutNatSession(session *NatSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sessionKey := getSessionKey(session.peerOneId, session.peerTwoId)
+	r.natSessions[sessionKey] = session
+	delete(r.relaySessions, sessionKey)
+}
+
+// GetNatSession 获取两个客户端之间NAT会话的副本
+func (r *Registry) GetNatSession(id1 string, id2 string) (*NatSession, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	session := r.natSessions[getSessionKey(id1, id2)]
+	if session == nil {
+		return nil, false
+	}
+	copied := *session
+	return &copied, true
+}
+
+// GetNatSessions 获取客户端参与的全部NAT会话的副本
+func (r *Registry) GetNatSessions(clientId string) []*NatSession {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var sessions []*NatSession
+	for _, session := range r.natSessions {
+		if session.peerOneId == clientId || session.peerTwoId == clientId {
+			copied := *session
+			sessions = append(sessions, &copied)
+		}
+	}
+	return sessions
+}
+
+// RemoveNatSession 删除两个客户端之间的NAT会话，返回被删除会话的副本
+func (r *Registry) RemoveNatSession(id1 string, id2 string) (*NatSession, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sessionKey := getSessionKey(id1, id2)
+	session := r.natSessions[sessionKey]
+	if session == nil {
+		return nil, false
+	}
+	delete(r.natSessions, sessionKey)
+	copied := *session
+	return &copied, true
+}
+
+// UpdateNatSession 在持有锁时修改两个客户端之间的NAT会话，返回修改后的副本
+func (r *Registry) UpdateNatSession(id1 string, id2 string, update func(session *NatSession)) (*NatSession, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	session := r.natSessions[getSessionKey(id1, id2)]
+	if session == nil {
+		return nil, false
+	}
+	update(session)
+	copied := *session
+	return &copied, true
+}
+
+// EnableRelay 在中转会话中登记源客户端的虚拟IP和握手字段
+// 双方之间必须存在NAT会话（即经过了连接请求），且双方都登记后才启用中转会话，
+// 避免任意客户端单方面向其他客户端中转数据；ready 表示双方都已就绪，此时返回目标客户端的虚拟IP
+func (r *Registry) EnableRelay(srcId string, targetId string, srcVip string, handshake map[string]interface{}) (targetVip string, ready bool, exists bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sessionKey := getSessionKey(srcId, targetId)
+	if r.natSessions[sessionKey] == nil {
+		return "", false, false
+	}
+	session := r.relaySessions[sessionKey]
+	if session == nil {
+		session = &RelaySession{
+			clientOneId: srcId,
+			clientTwoId: targetId,
+			vips:        make(map[string]string),
+			handshakes:  make(map[string]map[string]interface{}),
+		}
+		r.relaySessions[sessionKey] = session
+	}
+	session.vips[srcId] = srcVip
+	session.handshakes[srcId] = handshake
+	targetVip, targetExists := session.vips[targetId]
+	_, targetHandshake := session.handshakes[targetId]
+	ready = targetExists && targetHandshake
+	if ready {
+		session.enabled = true
+	}
+	return targetVip, ready, true
+}
+
+// RelayEnabled 两个客户端之间是否存在已启用的中转会话
+func (r *Registry) RelayEnabled(id1 string, id2 string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	session := r.relaySessions[getSessionKey(id1, id2)]
+	return session != nil && session.enabled
+}
+
+// RelayHandshake 获取客户端在与对等节点的中转会话中登记的握手字段副本
+func (r *Registry) RelayHandshake(clientId string, peerId string) map[string]interface{} {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	copied := make(map[string]interface{})
+	if session := r.relaySessions[getSessionKey(clientId, peerId)]; session != nil {
+		for field, value := range session.handshakes[clientId] {
+			copied[field] = value
+		}
+	}
+	return copied
+}
+
+// DisableRelay 删除两个客户端之间的中转会话及其握手字段
+func (r *Registry) DisableRelay(id1 string, id2 string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.relaySessions, getSessionKey(id1, id2))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+)
+
+func testAddr(i int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(198, 51, 100, byte(i%250+1)), Port: 20000 + i}
+}
+
+func TestRegistryBeatAndAddrIndex(t *testing.T) {
+	r := NewRegistry()
+	first := testAddr(1)
+	if prev := r.Beat("a", nil, first, 100); prev != nil {
+		t.Fatalf("首次心跳返回了之前的地址 %v", prev)
+	}
+	if id := r.ClientIdByAddr(first); id != "a" {
+		t.Fatalf("ClientIdByAddr = %q, want a", id)
+	}
+
+	second := testAddr(2)
+	if prev := r.Beat("a", nil, second, 101); prev == nil || prev.String() != first.String() {
+		t.Fatalf("更换地址后返回的之前地址 = %v, want %v", prev, first)
+	}
+	if id := r.ClientIdByAddr(first); id != "" {
+		t.Fatalf("旧地址仍然指向 %q", id)
+	}
+	if id := r.ClientIdByAddr(second); id != "a" {
+		t.Fatalf("新地址 ClientIdByAddr = %q, want a", id)
+	}
+}
+
+func TestRegistryEnableRelayRequiresSessionAndBothSides(t *testing.T) {
+	r := NewRegistry()
+	if _, _, exists := r.EnableRelay("a", "b", "10.10.10.2", nil); exists {
+		t.Fatal("没有NAT会话时启用了中转会话")
+	}
+	if r.RelayEnabled("a", "b") {
+		t.Fatal("没有NAT会话时中转会话已启用")
+	}
+
+	r.PutNatSession(&NatSession{peerOneId: "a", peerTwoId: "b"})
+	if _, ready, exists := r.EnableRelay("a", "b", "10.10.10.2", map[string]interface{}{"spk": "x"}); !exists || ready {
+		t.Fatalf("单方请求 exists=%v ready=%v, want true false", exists, ready)
+	}
+	if r.RelayEnabled("a", "b") {
+		t.Fatal("只有一方请求时中转会话已启用")
+	}
+	vip, ready, _ := r.EnableRelay("b", "a", "10.10.10.3", map[string]interface{}{"spk": "y"})
+	if !ready || vip != "10.10.10.2" {
+		t.Fatalf("双方请求 ready=%v vip=%q, want true 10.10.10.2", ready, vip)
+	}
+	if !r.RelayEnabled("a", "b") || !r.RelayEnabled("b", "a") {
+		t.Fatal("双方请求后中转会话未启用")
+	}
+	if handshake := r.RelayHandshake("a", "b"); handshake["spk"] != "x" {
+		t.Fatalf("RelayHandshake = %v", handshake)
+	}
+
+	// 新的连接请求清除之前的中转会话
+	r.PutNatSession(&NatSession{peerOneId: "b", peerTwoId: "a"})
+	if r.RelayEnabled("a", "b") {
+		t.Fatal("新的NAT会话没有清除中转会话")
+	}
+}
+
+func TestRegistryRemoveOfflineClients(t *testing.T) {
+	r := NewRegistry()
+	r.Beat("a", nil, testAddr(1), 100)
+	r.Beat("b", nil, testAddr(2), 100)
+	r.Beat("c", nil, testAddr(3), 125)
+	r.PutNatSession(&NatSession{peerOneId: "a", peerTwoId: "b"})
+	r.PutNatSession(&NatSession{peerOneId: "b", peerTwoId: "c"})
+
+	removed := r.RemoveOfflineClients(131, 30)
+	if len(removed) != 2 {
+		t.Fatalf("移除了%d个客户端, want 2", len(removed))
+	}
+	for _, offline := range removed {
+		if offline.clientId == "c" {
+			t.Fatal("未超时的客户端被移除")
+		}
+	}
+	if _, ok := r.GetClient("c"); !ok {
+		t.Fatal("未超时的客户端不存在")
+	}
+	if id := r.ClientIdByAddr(testAddr(1)); id != "" {
+		t.Fatalf("已移除客户端的地址仍然指向 %q", id)
+	}
+	if clients, natSessions, _ := r.Counts(); clients != 1 || natSessions != 0 {
+		t.Fatalf("Counts = %d clients %d sessions, want 1 0", clients, natSessions)
+	}
+}
+
+// TestRegistryConcurrentAccess 并发调用 Registry 的方法，配合 go test -race 检查数据竞争
+func TestRegistryConcurrentAccess(t *testing.T) {
+	r := NewRegistry()
+	const workers = 16
+	const rounds = 200
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			self := fmt.Sprintf("c%d", w)
+			peer := fmt.Sprintf("c%d", (w+1)%workers)
+			for i := 0; i < rounds; i++ {
+				addr := testAddr(w*rounds + i)
+				r.Beat(self, nil, addr, int64(i))
+				r.SetCandidates(self, nil, addr)
+				r.SetNatInfo(self, "OPEN", i%3)
+				r.ClientIdByAddr(addr)
+				r.GetClient(peer)
+				r.PutNatSession(&NatSession{peerOneId: self, peerTwoId: peer})
+				r.UpdateNatSession(self, peer, func(session *NatSession) {
+					session.pakeReply = "reply"
+				})
+				r.GetNatSessions(self)
+				r.EnableRelay(self, peer, "10.10.10.2", map[string]interface{}{"spk": self})
+				r.RelayEnabled(self, peer)
+				r.RelayHandshake(self, peer)
+				r.Counts()
+				if i%10 == 0 {
+					r.DisableRelay(self, peer)
+					r.RemoveNatSession(self, peer)
+				}
+			}
+		}(w)
+	}
+	// 同时按超时清理离线客户端
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			r.RemoveOfflineClients(int64(i), 50)
+		}
+	}()
+	wg.Wait()
+
+	// 每个客户端的地址索引只指向其最新地址
+	for w := 0; w < workers; w++ {
+		self := fmt.Sprintf("c%d", w)
+		client, ok := r.GetClient(self)
+		if !ok {
+			continue
+		}
+		if id := r.ClientIdByAddr(client.addr); id != self {
+			t.Fatalf("%s 的地址 %v 指向 %q", self, client.addr, id)
+		}
+	}
+}
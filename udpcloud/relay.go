@@ -12,48 +12,65 @@ type RelaySession struct {
 	clientOneId string
 	clientTwoId string
 	enabled     bool
+	vips        map[string]string                 // 客户端id -> 虚拟IP
+	handshakes  map[string]map[string]interface{} // 客户端id -> 待转交给对方的握手字段
 }
 
-// 中转会话映射
-var relaySessions = make(map[string]*RelaySession)
+// 握手字段名，服务器只负责原样转交，无法据此得到会话密钥
+// vip6 为客户端的IPv6虚拟地址，客户端启用了IPv6时改为由网络的IPv6虚拟网段和租约地址计算的值；
+// 握手MAC覆盖 vip、vip6 和 seq，客户端声明的地址与租约不一致时对等节点校验MAC失败，拒绝该握手
+var handshakeFields = []string{"spk", "epk", "seq", "mac", "vip6"}
 
-// 客户端虚拟IP映射
-var clientVips = make(map[string]string)
-
-// enableRelayHandler 启用中转模式
+// enableRelayHandler 启用中转模式，双方都请求后才启用中转会话
 func enableRelayHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.Json) {
 	srcId := json.GetString("srcId")
 	targetId := json.GetString("targetId")
-	srcVip := json.GetString("vip") // 获取源客户端的虚拟IP
 
 	if srcId == "" || targetId == "" {
 		glog.Warningf("[RELAY]启用中转模式失败：缺少必要参数")
+		metrics.HandlerError(path, errBadRequest)
 		return
 	}
 
-	// 保存源客户端的虚拟IP
-	clientVips[srcId] = srcVip
+	// 转交给对方的虚拟IP以注册中心分配的租约为准，忽略客户端声明的地址，避免冒用其他客户端的虚拟IP
+	srcVip, srcVip6, leased := ipam.Lookup(srcId, targetId)
+	if !leased {
+		glog.Warningf("[RELAY]启用中转模式失败：%s 与 %s 不在同一网络或没有虚拟IP租约", srcId, targetId)
+		metrics.HandlerError(path, errNoLease)
+		return
+	}
+	if claimed := json.GetString("vip"); claimed != srcVip {
+		glog.Warningf("[RELAY]%s 声明的虚拟IP %s 与租约 %s 不一致，以租约为准", srcId, claimed, srcVip)
+	}
 
-	// 创建或更新中转会话
-	sessionKey := getSessionKey(srcId, targetId)
-	relaySessions[sessionKey] = &RelaySession{
-		clientOneId: srcId,
-		clientTwoId: targetId,
-		enabled:     true,
+	// 保存源客户端的虚拟IP和握手字段，创建或更新中转会话
+	// 握手字段由服务器转交给对等节点完成密钥交换
+	handshake := make(map[string]interface{})
+	for _, field := range handshakeFields {
+		handshake[field] = json.GetString(field)
+	}
+	if handshake["vip6"] != "" {
+		handshake["vip6"] = srcVip6
+	}
+	targetVip, ready, exists := registry.EnableRelay(srcId, targetId, srcVip, handshake)
+	if !exists {
+		glog.Warningf("[RELAY]启用中转模式失败：%s 与 %s 之间没有NAT会话", srcId, targetId)
+		metrics.HandlerError(path, errNoSession)
+		return
 	}
 
-	glog.Infof("[RELAY]已启用中转模式：%s <-> %s，源客户端虚拟IP：%s", srcId, targetId, srcVip)
+	glog.Infof("[RELAY]%s 请求启用与 %s 的中转模式，源客户端虚拟IP：%s", srcId, targetId, srcVip)
 
 	// 检查是否两个客户端都已注册虚拟IP
-	targetVip, targetExists := clientVips[targetId]
-	if targetExists {
+	if ready {
 		// 两个客户端都已注册，可以交换虚拟IP
-		notifyRelayEnabled(srcId, targetId, targetVip) // 源客户端收到目标客户端的虚拟IP
-		notifyRelayEnabled(targetId, srcId, srcVip)    // 目标客户端收到源客户端的虚拟IP
-		glog.Infof("[RELAY]虚拟IP交换完成：%s(%s) <-> %s(%s)", srcId, srcVip, targetId, targetVip)
+		notifyRelayEnabled(srcId, targetId, targetVip) // 源客户端收到目标客户端的虚拟IP和握手字段
+		notifyRelayEnabled(targetId, srcId, srcVip)    // 目标客户端收到源客户端的虚拟IP和握手字段
+		metrics.PunchResult(punchRelayed)
+		glog.Infof("[RELAY]已启用中转模式，虚拟IP交换完成：%s(%s) <-> %s(%s)", srcId, srcVip, targetId, targetVip)
 	} else {
-		// 目标客户端还未注册，等待目标客户端注册
-		glog.Debugf("[RELAY]等待目标客户端 %s 注册虚拟IP", targetId)
+		// 目标客户端还未请求，中转会话暂不启用
+		glog.Debugf("[RELAY]等待目标客户端 %s 请求启用中转模式", targetId)
 	}
 }
 
@@ -64,34 +81,37 @@ func relayLatencyTestHandler(conn *net.UDPConn, addr *net.UDPAddr, path string,
 
 	if targetId == "" {
 		glog.Warningf("[RELAY]中转延迟测试失败：缺少targetId参数")
+		metrics.HandlerError(path, errBadRequest)
 		return
 	}
 
 	// 获取发送方ID
-	srcId := getClientIdByAddr(addr)
+	srcId := senderId(addr, json)
 	if srcId == "" {
 		glog.Warningf("[RELAY]无法识别发送方：%s", addr.String())
+		metrics.HandlerError(path, errUnknownSender)
 		return
 	}
 
 	// 检查中转会话是否存在
-	sessionKey := getSessionKey(srcId, targetId)
-	session := relaySessions[sessionKey]
-	if session == nil || !session.enabled {
+	if !registry.RelayEnabled(srcId, targetId) {
 		glog.Warningf("[RELAY]中转会话不存在或未启用：%s -> %s", srcId, targetId)
+		metrics.HandlerError(path, errNoSession)
 		return
 	}
 
 	// 获取目标客户端
-	targetClient := clientMap[targetId]
-	if targetClient == nil {
+	targetClient, exists := registry.GetClient(targetId)
+	if !exists {
 		glog.Warningf("[RELAY]目标客户端不存在：%s", targetId)
+		metrics.HandlerError(path, errTargetOffline)
 		return
 	}
 
 	// 转发延迟测试包
 	sendJSON(targetClient.conn, targetClient.addr, map[string]interface{}{
 		"path":      "relayLatencyTest",
+		"srcId":     srcId,
 		"timestamp": timestamp,
 	})
 
@@ -105,34 +125,37 @@ func relayLatencyReplyHandler(conn *net.UDPConn, addr *net.UDPAddr, path string,
 
 	if targetId == "" {
 		glog.Warningf("[RELAY]中转延迟回复失败：缺少targetId参数")
+		metrics.HandlerError(path, errBadRequest)
 		return
 	}
 
 	// 获取发送方ID
-	srcId := getClientIdByAddr(addr)
+	srcId := senderId(addr, json)
 	if srcId == "" {
 		glog.Warningf("[RELAY]无法识别发送方：%s", addr.String())
+		metrics.HandlerError(path, errUnknownSender)
 		return
 	}
 
 	// 检查中转会话是否存在
-	sessionKey := getSessionKey(srcId, targetId)
-	session := relaySessions[sessionKey]
-	if session == nil || !session.enabled {
+	if !registry.RelayEnabled(srcId, targetId) {
 		glog.Warningf("[RELAY]中转会话不存在或未启用：%s -> %s", srcId, targetId)
+		metrics.HandlerError(path, errNoSession)
 		return
 	}
 
 	// 获取目标客户端
-	targetClient := clientMap[targetId]
-	if targetClient == nil {
+	targetClient, exists := registry.GetClient(targetId)
+	if !exists {
 		glog.Warningf("[RELAY]目标客户端不存在：%s", targetId)
+		metrics.HandlerError(path, errTargetOffline)
 		return
 	}
 
 	// 转发延迟回复包
 	sendJSON(targetClient.conn, targetClient.addr, map[string]interface{}{
 		"path":      "relayLatencyReply",
+		"srcId":     srcId,
 		"timestamp": timestamp,
 	})
 
@@ -147,36 +170,65 @@ func getSessionKey(id1, id2 string) string {
 	return id2 + "_" + id1
 }
 
-// getClientIdByAddr 根据地址获取客户端ID
-func getClientIdByAddr(addr *net.UDPAddr) string {
-	for clientId, client := range clientMap {
-		if client.addr.String() == addr.String() {
-			return clientId
-		}
-	}
-	return ""
-}
-
 // notifyRelayEnabled 通知客户端中转模式已启用
 func notifyRelayEnabled(clientId string, peerId string, peerVip string) {
-	client := clientMap[clientId]
-	if client == nil {
+	client, exists := registry.GetClient(clientId)
+	if !exists {
 		glog.Warningf("[RELAY]客户端不存在：%s", clientId)
 		return
 	}
 
-	sendJSON(client.conn, client.addr, map[string]interface{}{
+	resp := map[string]interface{}{
 		"path":   "relayEnabled",
 		"peerId": peerId,
 		"vip":    peerVip, // 发送对等节点的虚拟IP
-	})
+	}
+	for field, value := range registry.RelayHandshake(peerId, clientId) {
+		resp[field] = value
+	}
+	sendJSON(client.conn, client.addr, resp)
 
 	glog.Debugf("[RELAY]已通知客户端 %s 中转模式已启用，对等节点虚拟IP：%s", clientId, peerVip)
 }
 
 // disableRelay 禁用中转模式
 func disableRelay(srcId, targetId string) {
-	sessionKey := getSessionKey(srcId, targetId)
-	delete(relaySessions, sessionKey)
+	registry.DisableRelay(srcId, targetId)
 	glog.Infof("[RELAY]已禁用中转模式：%s <-> %s", srcId, targetId)
 }
+
+// repunchHandler 中转模式下客户端请求重新打洞，向双方同时下发对方的最新地址
+func repunchHandler(conn *net.UDPConn, addr *net.UDPAddr, path string, json *gjson.Json) {
+	targetId := json.GetString("targetId")
+	srcId := senderId(addr, json)
+	if srcId == "" || targetId == "" {
+		glog.Warningf("[RELAY]重新打洞失败：无法识别发送方 %s 或缺少targetId参数", addr.String())
+		metrics.HandlerError(path, errBadRequest)
+		return
+	}
+
+	// 只有已建立中转会话的双方才能请求重新打洞
+	if !registry.RelayEnabled(srcId, targetId) {
+		glog.Warningf("[RELAY]中转会话不存在或未启用：%s -> %s", srcId, targetId)
+		metrics.HandlerError(path, errNoSession)
+		return
+	}
+
+	srcClient, srcExists := registry.GetClient(srcId)
+	targetClient, targetExists := registry.GetClient(targetId)
+	if !srcExists || !targetExists {
+		glog.Warningf("[RELAY]重新打洞失败：%s 或 %s 不在线", srcId, targetId)
+		metrics.HandlerError(path, errTargetOffline)
+		return
+	}
+	srcClientData := buildNatClientJson(&srcClient, srcId, targetId)
+	targetClientData := buildNatClientJson(&targetClient, targetId, srcId)
+	if len(srcClientData) == 0 || len(targetClientData) == 0 {
+		return
+	}
+	srcClientData["path"] = "repunch"
+	targetClientData["path"] = "repunch"
+	sendJSON(srcClient.conn, srcClient.addr, targetClientData)
+	sendJSON(targetClient.conn, targetClient.addr, srcClientData)
+	glog.Debugf("[RELAY]通知 %s 和 %s 重新打洞", srcId, targetId)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -47,10 +48,38 @@ func sendJSON(conn *net.UDPConn, addr *net.UDPAddr, data interface{}) {
 	}
 }
 
+// 读取失败后的等待时间，连续失败时逐次加倍
+const (
+	readBackoffMin = 10 * time.Millisecond
+	readBackoffMax = time.Second
+)
+
+// readBackoff 套接字读取持续失败时退避，避免空转占满CPU和日志
+type readBackoff struct {
+	delay time.Duration
+}
+
+func (b *readBackoff) wait() {
+	if b.delay == 0 {
+		b.delay = readBackoffMin
+	} else if b.delay < readBackoffMax {
+		b.delay *= 2
+	}
+	if b.delay > readBackoffMax {
+		b.delay = readBackoffMax
+	}
+	time.Sleep(b.delay)
+}
+
+// reset 读取成功后重置等待时间
+func (b *readBackoff) reset() {
+	b.delay = 0
+}
+
 // 启动UDP服务器
 func startUDPServer(port int) {
+	// 不指定IP时同时监听IPv4和IPv6
 	addr := &net.UDPAddr{
-		IP:   net.IPv4(0, 0, 0, 0),
 		Port: port,
 	}
 	listen, err := net.ListenUDP("udp", addr)
@@ -62,12 +91,19 @@ func startUDPServer(port int) {
 	glog.Infof("UDP服务已启动，监听地址: %s", addr)
 
 	body := make([]byte, 65536) // 增大缓冲区到64KB，支持更大的UDP包
+	var backoff readBackoff
 	for {
 		n, clientAddr, err := listen.ReadFromUDP(body)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				glog.Infof("UDP服务已停止")
+				return
+			}
 			glog.Errorf("读取数据失败: %v", err)
+			backoff.wait()
 			continue
 		}
+		backoff.reset()
 
 		// 复制数据到新的切片，避免goroutine间的数据竞争
 		data := make([]byte, n)
@@ -75,6 +111,15 @@ func startUDPServer(port int) {
 
 		// 异步处理请求
 		go func(data []byte, addr *net.UDPAddr) {
+			// 单个请求处理出错不影响服务器运行
+			path := ""
+			defer func() {
+				if err := recover(); err != nil {
+					glog.Errorf("处理来自 %s 的请求 %s 时发生异常: %v", addr.String(), path, err)
+					metrics.HandlerError(path, errPanic)
+				}
+			}()
+
 			// 检查是否为统一协议的数据包
 			if len(data) >= 5 && data[0] == 0x12 && data[1] == 0x34 && data[2] == 0x56 && data[3] == 0x78 {
 				mode := data[4]
@@ -90,61 +135,114 @@ func startUDPServer(port int) {
 							// 检查数据长度是否匹配
 							if len(relayData) != dataLen {
 								glog.Errorf("[RELAY]中转数据长度不匹配: 期望%d, 实际%d", dataLen, len(relayData))
+								metrics.RelayDropped(relayDropLength)
 								return
 							}
 
 							// 转发数据到目标客户端
-							relayDataToClient(listen, targetId, data, addr)
+							relayDataToClient(listen, targetId, relayData, addr)
 							return
 						}
 					}
 				}
 			}
 
-			// 处理JSON协议的控制消息
+			// 处理JSON协议的控制消息，消息封装在带签名的 {"body":...,"sig":...} 中
 			content := string(data)
 
 			if !strings.Contains(content, "\"path\":\"relayData\"") && !strings.Contains(content, "\"fragment\":") {
 				glog.Debugf("收到来自 %s 的请求: %s", addr.String(), content)
 			}
-			parseJSON, err := gjson.LoadContent(content)
+			signed, parseJSON, err := ParseSignedMessage(data)
 			if err != nil {
 				glog.Warningf("JSON解析失败: %v 原始内容: %s", err, content)
+				metrics.HandlerError("", errInvalidJson)
 				sendError(listen, addr, "", "无效的JSON格式")
 				return
 			}
 
 			// 获取请求路径
-			path := parseJSON.GetString("path")
-			if path == "" {
+			requestPath := parseJSON.GetString("path")
+			if requestPath == "" {
+				metrics.HandlerError("", errMissingPath)
 				sendError(listen, addr, path, "缺少必要字段: path")
 				return
 			}
 
 			// 路由匹配
-			if handler, exists := router[path]; exists {
+			if handler, exists := router[requestPath]; exists {
+				path = requestPath
+				// 所有客户端消息都必须带有已登记身份的有效签名
+				if err := identityRegistry.Verify(path, signed, parseJSON, addr); err != nil {
+					glog.Warningf("拒绝来自 %s 的请求 %s: %v", addr.String(), path, err)
+					metrics.HandlerError(path, errUnauthorized)
+					sendError(listen, addr, path, "身份校验失败")
+					return
+				}
 				handler(listen, addr, path, parseJSON)
 			} else {
-				sendError(listen, addr, path, "注册中心不支持此请求路径: "+path)
+				// 未注册的路径不作为标签值，避免客户端随意构造
+				metrics.HandlerError("", errUnknownPath)
+				sendError(listen, addr, requestPath, "注册中心不支持此请求路径: "+requestPath)
 			}
 		}(data, clientAddr)
 	}
 }
 
+// senderId 返回经 Verify 校验签名的发送方ID，发送方必须是在线的已登记客户端，否则返回空字符串
+// 来源地址只用于一致性检查：客户端更换地址或在运营商级NAT后共用地址时仍以签名的ID为准
+func senderId(addr *net.UDPAddr, json *gjson.Json) string {
+	id := json.GetString("id")
+	client, exists := registry.GetClient(id)
+	if !exists {
+		return ""
+	}
+	if client.addr == nil || client.addr.String() != addr.String() {
+		glog.Debugf("客户端 %s 的消息来自 %s，与登记的地址 %v 不一致", id, addr.String(), client.addr)
+	}
+	return id
+}
+
 // relayDataToClient 转发二进制数据到目标客户端
-func relayDataToClient(conn *net.UDPConn, targetId string, data []byte, fromAddr *net.UDPAddr) {
+// 只转发已登记客户端之间存在已启用中转会话的数据，并把帧头中的目标ID改写为经过验证的发送方ID
+func relayDataToClient(conn *net.UDPConn, targetId string, payload []byte, fromAddr *net.UDPAddr) {
+	// 发送方必须是已登记的客户端，且地址与其最近一次心跳一致
+	srcId := registry.ClientIdByAddr(fromAddr)
+	if srcId == "" {
+		glog.Warningf("[RELAY]丢弃来自未登记地址 %s 的中转数据", fromAddr.String())
+		metrics.RelayDropped(relayDropUnknownSrc)
+		return
+	}
+
+	// 双方之间必须存在已启用的中转会话
+	if !registry.RelayEnabled(srcId, targetId) {
+		glog.Warningf("[RELAY]丢弃中转数据：%s -> %s 没有已启用的中转会话", srcId, targetId)
+		metrics.RelayDropped(relayDropNoSession)
+		return
+	}
+
 	// 查找目标客户端
-	targetClient := clientMap[targetId]
-	if targetClient == nil {
+	targetClient, exists := registry.GetClient(targetId)
+	if !exists {
 		glog.Warningf("[RELAY]目标客户端不存在：%s", targetId)
+		metrics.RelayDropped(relayDropNoTarget)
 		return
 	}
 
-	// 直接转发原始数据包，targetId已经是正确的目标ID
-	_, err := conn.WriteToUDP(data, targetClient.addr)
+	// 协议格式: [魔数4B] + [0x02] + [srcId长度(1B)] + [srcId] + [数据长度(2B)] + [数据]
+	srcIdBytes := []byte(srcId)
+	packet := make([]byte, 0, 4+1+1+len(srcIdBytes)+2+len(payload))
+	packet = append(packet, 0x12, 0x34, 0x56, 0x78, 0x02, byte(len(srcIdBytes)))
+	packet = append(packet, srcIdBytes...)
+	packet = append(packet, byte(len(payload)>>8), byte(len(payload)&0xFF))
+	packet = append(packet, payload...)
+
+	_, err := conn.WriteToUDP(packet, targetClient.addr)
 	if err != nil {
 		glog.Errorf("[RELAY]转发数据到客户端 %s 失败：%v", targetId, err)
+		metrics.RelayDropped(relayDropSendError)
 	} else {
-		//glog.Debugf("[RELAY]转发数据%d字节到客户端 %s", len(data), targetId)
+		metrics.RelayForwarded(len(payload))
+		//glog.Debugf("[RELAY]转发数据%d字节：%s -> %s", len(payload), srcId, targetId)
 	}
 }
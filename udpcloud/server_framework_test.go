@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/venshao/natun/gjson"
+)
+
+// TestSenderIdUsesSignedId 发送方以签名的ID为准，来源地址与登记的地址不同时仍能识别
+func TestSenderIdUsesSignedId(t *testing.T) {
+	saved := registry
+	registry = NewRegistry()
+	defer func() { registry = saved }()
+
+	registry.Beat("a", nil, testAddr(1), 100)
+	msg := gjson.New(map[string]interface{}{"id": "a"})
+	if id := senderId(testAddr(1), msg); id != "a" {
+		t.Fatalf("senderId = %q, want a", id)
+	}
+	// 地址变化或与其他客户端共用地址
+	registry.Beat("b", nil, testAddr(2), 100)
+	if id := senderId(testAddr(2), msg); id != "a" {
+		t.Fatalf("来自其他地址时 senderId = %q, want a", id)
+	}
+	if id := senderId(testAddr(1), gjson.New(map[string]interface{}{"id": "c"})); id != "" {
+		t.Fatalf("未登记的客户端 senderId = %q, want 空", id)
+	}
+}